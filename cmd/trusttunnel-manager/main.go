@@ -1,12 +1,17 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	trusttunnel "github.com/jounts/TrustTunnel4keenetic"
 	"github.com/jounts/TrustTunnel4keenetic/internal/api"
@@ -23,12 +28,16 @@ func main() {
 	devMode := flag.Bool("dev", false, "development mode (proxy to Vite)")
 	showVer := flag.Bool("version", false, "print version and exit")
 	configPath := flag.String("config", "/opt/trusttunnel_client/manager.conf", "manager config path")
+	routingCmd := flag.String("routing", "", "run a smart-routing command and exit ("+strings.Join(routing.Commands, ", ")+")")
 	flag.Parse()
 
 	if *showVer {
 		fmt.Println("trusttunnel-manager", version)
 		os.Exit(0)
 	}
+	if *routingCmd != "" {
+		os.Exit(runRoutingCommand(*routingCmd))
+	}
 
 	service.SetManagerVersion(version)
 
@@ -36,9 +45,19 @@ func main() {
 
 	svcManager := service.NewManager()
 	cfgManager := service.NewConfigManager()
-	updater := service.NewUpdater()
+	instances := service.NewInstances()
+	events := service.NewEventLog()
 	ndmClient := ndm.NewClient("http://localhost:79")
+	updater := service.NewUpdater(events)
+	updater.SetVerifyPolicy(cfg.updateVerify)
+	updater.SetWatchWindow(time.Duration(cfg.updateWatchWindow) * time.Second)
+	updater.SetTimeZoneSource(ndmClient.TimeZone)
+	failover := service.NewFailover(instances, events)
+	prober := service.NewProber(instances, events)
+	jobs := service.NewJobs(events)
 	routingMgr := routing.NewManager()
+	scheduler := service.NewScheduler(instances, routingMgr, events)
+	scheduler.SetTimeZoneSource(ndmClient.TimeZone)
 	sysInfo := platform.NewInfo()
 
 	// Ensure vpn_mode in client TOML matches the selected mode
@@ -48,6 +67,12 @@ func main() {
 		}
 	}
 
+	go failover.Run(context.Background())
+	go prober.Run(context.Background())
+	go updater.RunAuto(context.Background())
+	go scheduler.Run(context.Background())
+	go routingMgr.RunOverrides(context.Background())
+
 	var staticFS http.FileSystem
 	if *devMode {
 		log.Println("Development mode: serving from web/dist or proxy to Vite")
@@ -65,7 +90,13 @@ func main() {
 	router := api.NewRouter(api.Dependencies{
 		ServiceManager: svcManager,
 		ConfigManager:  cfgManager,
+		Instances:      instances,
 		Updater:        updater,
+		Events:         events,
+		Failover:       failover,
+		Prober:         prober,
+		Jobs:           jobs,
+		Scheduler:      scheduler,
 		NDMClient:      ndmClient,
 		RoutingManager: routingMgr,
 		SystemInfo:     sysInfo,
@@ -73,8 +104,19 @@ func main() {
 		Auth:           authCfg,
 	})
 
+	ln, err := net.Listen("tcp", cfg.addr)
+	if err != nil {
+		log.Fatalf("Server error: %v", err)
+	}
 	log.Printf("trusttunnel-manager %s listening on %s", version, cfg.addr)
-	if err := http.ListenAndServe(cfg.addr, router); err != nil {
+
+	// A self-update is confirmed once the new binary is actually serving
+	go func() {
+		time.Sleep(5 * time.Second)
+		service.ConfirmManagerUpdate(events)
+	}()
+
+	if err := http.Serve(ln, router); err != nil {
 		log.Fatalf("Server error: %v", err)
 	}
 }
@@ -82,6 +124,11 @@ func main() {
 type appConfig struct {
 	addr     string
 	authMode string // "ndm" (default), "none"
+	// updateVerify is "checksum" (default) or "signature"
+	updateVerify string
+	// updateWatchWindow is how long (seconds) a client update is watched
+	// before it is considered good
+	updateWatchWindow int
 }
 
 func loadConfig(path, defaultAddr string) appConfig {
@@ -101,6 +148,10 @@ func loadConfig(path, defaultAddr string) appConfig {
 			cfg.addr = v
 		case "AUTH_MODE":
 			cfg.authMode = v
+		case "UPDATE_VERIFY":
+			cfg.updateVerify = v
+		case "UPDATE_WATCH_WINDOW":
+			cfg.updateWatchWindow, _ = strconv.Atoi(v)
 		}
 	}
 	return cfg
@@ -155,3 +206,18 @@ func buildAuthConfig(cfg appConfig) api.AuthConfig {
 		}
 	}
 }
+
+// runRoutingCommand runs a smart-routing command for the init script and
+// NDM hooks, logging to the client log like the former shell functions.
+func runRoutingCommand(cmd string) int {
+	if f, err := os.OpenFile("/opt/var/log/trusttunnel.log", os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644); err == nil {
+		log.SetOutput(f)
+		defer f.Close()
+	}
+	if err := routing.NewManager().RunCommand(cmd); err != nil {
+		log.Printf("[smart-routing] ERROR: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
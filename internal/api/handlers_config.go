@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"io"
 	"net/http"
+
+	"github.com/jounts/TrustTunnel4keenetic/internal/ndm"
+	"github.com/jounts/TrustTunnel4keenetic/internal/service"
 )
 
 func (h *handlers) getConfig(w http.ResponseWriter, r *http.Request) {
@@ -92,7 +95,18 @@ func (h *handlers) putMode(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.deps.NDMClient.RecreateInterface(req.Mode, req.TunIdx, req.ProxyIdx); err != nil {
+	ifCfg := ndm.InterfaceConfig{
+		Mode:         req.Mode,
+		TunIdx:       req.TunIdx,
+		ProxyIdx:     req.ProxyIdx,
+		IPv6:         h.deps.ConfigManager.EndpointHasIPv6(),
+		DefaultRoute: h.deps.ServiceManager.Name() == service.DefaultInstance,
+	}
+	if mode, err := h.deps.ConfigManager.ReadMode(); err == nil {
+		ifCfg.SocksPort = mode.SocksPort
+	}
+
+	if err := h.deps.NDMClient.RecreateInterface(ifCfg); err != nil {
 		writeError(w, http.StatusInternalServerError, "config saved but interface error: "+err.Error())
 		return
 	}
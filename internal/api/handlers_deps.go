@@ -0,0 +1,49 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/jounts/TrustTunnel4keenetic/internal/service"
+)
+
+type depsInstallRequest struct {
+	// Packages to install; empty installs the missing required ones
+	Packages []string `json:"packages"`
+}
+
+func (h *handlers) fwBackend() string {
+	if h.deps.RoutingManager == nil {
+		return "unknown"
+	}
+	return h.deps.RoutingManager.FWBackend()
+}
+
+func (h *handlers) getDeps(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, service.CheckDeps(h.fwBackend()))
+}
+
+// installDeps starts a background job running opkg update and opkg install;
+// the UI follows its output via /api/jobs/{id}.
+func (h *handlers) installDeps(w http.ResponseWriter, r *http.Request) {
+	var req depsInstallRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	backend := h.fwBackend()
+	job, err := h.deps.Jobs.Start("deps", "", func(ctx context.Context, j *service.Job) (any, error) {
+		st, err := service.InstallDeps(ctx, j, backend, req.Packages)
+		if err != nil {
+			return nil, err
+		}
+		return st, nil
+	})
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
@@ -0,0 +1,129 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/jounts/TrustTunnel4keenetic/internal/routing"
+)
+
+// lanIfaceRe matches a Linux interface name
+var lanIfaceRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+
+type dnsConfigRequest struct {
+	Policy   string `json:"dns_policy"`
+	BlockDoT string `json:"dns_block_dot"`
+	// LanIface lists the LAN bridges to protect, space-separated
+	LanIface string `json:"dns_lan_iface"`
+}
+
+type dnsConfigResponse struct {
+	dnsConfigRequest
+	// Bridges are the LAN bridges found on the router
+	Bridges []string `json:"lan_bridges"`
+}
+
+func (h *handlers) dnsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getDNS(w, r)
+	case http.MethodPut:
+		h.putDNS(w, r)
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handlers) getDNS(w http.ResponseWriter, r *http.Request) {
+	mode, err := h.deps.ConfigManager.ReadMode()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	bridges := routing.LanBridges()
+	if bridges == nil {
+		bridges = []string{}
+	}
+	writeJSON(w, http.StatusOK, dnsConfigResponse{
+		dnsConfigRequest: dnsConfigRequest{
+			Policy:   mode.DNSPolicy,
+			BlockDoT: mode.DNSBlockDoT,
+			LanIface: mode.DNSLanIface,
+		},
+		Bridges: bridges,
+	})
+}
+
+func (h *handlers) putDNS(w http.ResponseWriter, r *http.Request) {
+	var req dnsConfigRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if req.Policy == "" {
+		req.Policy = "off"
+	}
+	if req.Policy != "off" && req.Policy != "redirect" {
+		writeError(w, http.StatusBadRequest, "dns_policy must be 'off' or 'redirect'")
+		return
+	}
+	if req.BlockDoT != "yes" {
+		req.BlockDoT = "no"
+	}
+	// Without dns_lan_iface the stored bridges are kept
+	if strings.TrimSpace(req.LanIface) == "" {
+		if cur, err := h.deps.ConfigManager.ReadMode(); err == nil {
+			req.LanIface = cur.DNSLanIface
+		}
+	}
+	ifaces := strings.Fields(strings.ReplaceAll(req.LanIface, ",", " "))
+	if len(ifaces) == 0 {
+		ifaces = []string{"br0"}
+	}
+	for _, iface := range ifaces {
+		if !lanIfaceRe.MatchString(iface) {
+			writeError(w, http.StatusBadRequest, "invalid interface name: "+iface)
+			return
+		}
+	}
+
+	if err := h.deps.ConfigManager.WriteDNSConfig(req.Policy, req.BlockDoT, strings.Join(ifaces, " ")); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	mode, _ := h.deps.ConfigManager.ReadMode()
+	if h.deps.RoutingManager != nil && mode != nil && mode.Mode == "tun" {
+		if err := h.deps.RoutingManager.ApplyDNSPolicy(); err != nil {
+			writeError(w, http.StatusInternalServerError, "config saved but apply failed: "+err.Error())
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (h *handlers) dnsLeakTest(w http.ResponseWriter, r *http.Request) {
+	if h.deps.RoutingManager == nil {
+		writeError(w, http.StatusInternalServerError, "routing manager not initialized")
+		return
+	}
+
+	mode, err := h.deps.ConfigManager.ReadMode()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	policy := mode.DNSPolicy
+	if mode.Mode != "tun" {
+		policy = "off"
+	}
+
+	writeJSON(w, http.StatusOK, h.deps.RoutingManager.DNSLeakTest(policy, mode.SRDNSPort, strings.Fields(mode.DNSLanIface)))
+}
@@ -0,0 +1,128 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type failoverConfigRequest struct {
+	Enabled       string `json:"fo_enabled"`
+	Source        string `json:"fo_source"`
+	Profiles      string `json:"fo_profiles"`
+	Threshold     int    `json:"fo_threshold"`
+	Failback      string `json:"fo_failback"`
+	FailbackAfter int    `json:"fo_failback_after"`
+}
+
+type failoverSwitchRequest struct {
+	Index int `json:"index"`
+}
+
+func (h *handlers) failoverHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getFailover(w, r)
+	case http.MethodPut:
+		h.putFailover(w, r)
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handlers) getFailover(w http.ResponseWriter, r *http.Request) {
+	if h.deps.Failover == nil {
+		writeError(w, http.StatusInternalServerError, "failover not initialized")
+		return
+	}
+	mode, err := h.deps.ConfigManager.ReadMode()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	status, err := h.deps.Failover.Status(h.deps.ServiceManager.Name())
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"config": failoverConfigRequest{
+			Enabled:       mode.FOEnabled,
+			Source:        mode.FOSource,
+			Profiles:      mode.FOProfiles,
+			Threshold:     mode.FOThreshold,
+			Failback:      mode.FOFailback,
+			FailbackAfter: mode.FOFailbackAfter,
+		},
+		"status": status,
+	})
+}
+
+func (h *handlers) putFailover(w http.ResponseWriter, r *http.Request) {
+	var req failoverConfigRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if req.Enabled != "yes" {
+		req.Enabled = "no"
+	}
+	if req.Failback != "yes" {
+		req.Failback = "no"
+	}
+	if req.Source == "" {
+		req.Source = "addresses"
+	}
+	if req.Source != "addresses" && req.Source != "profiles" {
+		writeError(w, http.StatusBadRequest, "fo_source must be 'addresses' or 'profiles'")
+		return
+	}
+	req.Profiles = strings.Join(strings.Fields(req.Profiles), " ")
+	if req.Source == "profiles" && req.Enabled == "yes" && req.Profiles == "" {
+		writeError(w, http.StatusBadRequest, "fo_profiles is required for the 'profiles' source")
+		return
+	}
+	if req.Threshold < 1 {
+		req.Threshold = 2
+	}
+	if req.FailbackAfter < 60 {
+		req.FailbackAfter = 600
+	}
+
+	if err := h.deps.ConfigManager.WriteFailoverConfig(req.Enabled, req.Source, req.Profiles,
+		req.Threshold, req.Failback, req.FailbackAfter); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (h *handlers) failoverSwitch(w http.ResponseWriter, r *http.Request) {
+	if h.deps.Failover == nil {
+		writeError(w, http.StatusInternalServerError, "failover not initialized")
+		return
+	}
+	var req failoverSwitchRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if err := h.deps.Failover.Switch(h.deps.ServiceManager.Name(), req.Index); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (h *handlers) getEvents(w http.ResponseWriter, r *http.Request) {
+	limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+	if limit <= 0 {
+		limit = 50
+	}
+	writeJSON(w, http.StatusOK, h.deps.Events.List(limit))
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/jounts/TrustTunnel4keenetic/internal/ndm"
+	"github.com/jounts/TrustTunnel4keenetic/internal/service"
+)
+
+func (h *handlers) instancesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, h.deps.Instances.List())
+	case http.MethodPost:
+		h.createInstance(w, r)
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handlers) createInstance(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 64*1024))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "failed to read body")
+		return
+	}
+
+	var spec service.InstanceSpec
+	if err := json.Unmarshal(body, &spec); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid JSON: "+err.Error())
+		return
+	}
+
+	if err := h.deps.Instances.Create(spec); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	_, cfg, err := h.deps.Instances.Get(spec.Name)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	mode, _ := cfg.ReadMode()
+	if err := h.deps.NDMClient.RecreateInterface(ndm.InterfaceConfig{
+		Mode:      mode.Mode,
+		TunIdx:    mode.TunIdx,
+		ProxyIdx:  mode.ProxyIdx,
+		SocksPort: mode.SocksPort,
+		IPv6:      cfg.EndpointHasIPv6(),
+	}); err != nil {
+		writeError(w, http.StatusInternalServerError, "instance created but interface error: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, map[string]string{"status": "created", "name": spec.Name})
+}
+
+// instanceHandler serves /api/instances/{name} and dispatches
+// /api/instances/{name}/... to the per-instance endpoints.
+func (h *handlers) instanceHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/instances/")
+	name, sub, _ := strings.Cut(rest, "/")
+
+	if sub == "" {
+		switch r.Method {
+		case http.MethodDelete:
+			h.deleteInstance(w, name)
+		case http.MethodOptions:
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+		return
+	}
+
+	svcMgr, cfgMgr, err := h.deps.Instances.Get(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+
+	deps := h.deps
+	deps.ServiceManager = svcMgr
+	deps.ConfigManager = cfgMgr
+
+	mux := http.NewServeMux()
+	registerInstanceRoutes(mux, &handlers{deps: deps})
+
+	r2 := r.Clone(r.Context())
+	r2.URL.Path = "/api/" + sub
+	mux.ServeHTTP(w, r2)
+}
+
+func (h *handlers) deleteInstance(w http.ResponseWriter, name string) {
+	_, cfg, err := h.deps.Instances.Get(name)
+	if err != nil {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	mode, _ := cfg.ReadMode()
+
+	if err := h.deps.Instances.Delete(name); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	ifName := "Proxy" + strconv.Itoa(mode.ProxyIdx)
+	if mode.Mode == "tun" {
+		ifName = "OpkgTun" + strconv.Itoa(mode.TunIdx)
+	}
+	if err := h.deps.NDMClient.RemoveInterface(ifName); err != nil {
+		writeError(w, http.StatusInternalServerError, "instance deleted but interface error: "+err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "deleted", "name": name})
+}
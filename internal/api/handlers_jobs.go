@@ -0,0 +1,66 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/jounts/TrustTunnel4keenetic/internal/service"
+)
+
+type tuneRequest struct {
+	Apply bool `json:"apply"`
+}
+
+func (h *handlers) listJobs(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.deps.Jobs.List())
+}
+
+// jobHandler serves GET /api/jobs/{id} and POST /api/jobs/{id}/cancel.
+func (h *handlers) jobHandler(w http.ResponseWriter, r *http.Request) {
+	rest := strings.TrimPrefix(r.URL.Path, "/api/jobs/")
+	id, action, _ := strings.Cut(rest, "/")
+
+	switch {
+	case r.Method == http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && action == "":
+		job, ok := h.deps.Jobs.Get(id)
+		if !ok {
+			writeError(w, http.StatusNotFound, "job not found")
+			return
+		}
+		writeJSON(w, http.StatusOK, job)
+	case r.Method == http.MethodPost && action == "cancel":
+		if err := h.deps.Jobs.Cancel(id); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startTune launches the upstream protocol / anti-DPI tuning job for the
+// instance.
+func (h *handlers) startTune(w http.ResponseWriter, r *http.Request) {
+	var req tuneRequest
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+	}
+
+	m := h.deps.ServiceManager
+	job, err := h.deps.Jobs.Start("tune", m.Name(), func(ctx context.Context, j *service.Job) (any, error) {
+		return service.Tune(ctx, j, m, req.Apply)
+	})
+	if err != nil {
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
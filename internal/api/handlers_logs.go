@@ -10,18 +10,17 @@ import (
 	"time"
 )
 
-const clientLogPath = "/opt/var/log/trusttunnel.log"
 const managerLogPath = "/opt/var/log/trusttunnel_manager.log"
 
-func logPathFromRequest(r *http.Request) string {
+func (h *handlers) logPathFromRequest(r *http.Request) string {
 	if r.URL.Query().Get("source") == "manager" {
 		return managerLogPath
 	}
-	return clientLogPath
+	return h.deps.ServiceManager.LogFile()
 }
 
 func (h *handlers) getLogs(w http.ResponseWriter, r *http.Request) {
-	logPath := logPathFromRequest(r)
+	logPath := h.logPathFromRequest(r)
 
 	lines := 100
 	if v := r.URL.Query().Get("lines"); v != "" {
@@ -44,7 +43,7 @@ func (h *handlers) getLogs(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *handlers) streamLogs(w http.ResponseWriter, r *http.Request) {
-	logPath := logPathFromRequest(r)
+	logPath := h.logPathFromRequest(r)
 
 	flusher, ok := w.(http.Flusher)
 	if !ok {
@@ -85,7 +84,7 @@ func (h *handlers) streamLogs(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *handlers) clearLogs(w http.ResponseWriter, r *http.Request) {
-	for _, p := range []string{clientLogPath, managerLogPath} {
+	for _, p := range []string{h.deps.ServiceManager.LogFile(), managerLogPath} {
 		if err := os.Truncate(p, 0); err != nil && !os.IsNotExist(err) {
 			writeError(w, http.StatusInternalServerError, "failed to clear "+p+": "+err.Error())
 			return
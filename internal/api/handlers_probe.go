@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+type probeSettingsRequest struct {
+	Auto       string `json:"ep_probe_auto"`
+	Interval   int    `json:"ep_probe_interval"`
+	Hysteresis int    `json:"ep_probe_hysteresis"`
+}
+
+// endpointProbe measures all [endpoint] addresses. GET only measures; POST
+// also moves the best address to the front (subject to hysteresis) and
+// restarts the client.
+func (h *handlers) endpointProbe(w http.ResponseWriter, r *http.Request) {
+	var apply bool
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		apply = true
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.deps.Prober == nil {
+		writeError(w, http.StatusInternalServerError, "prober not initialized")
+		return
+	}
+	res, err := h.deps.Prober.Probe(h.deps.ServiceManager.Name(), apply)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (h *handlers) probeSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		mode, err := h.deps.ConfigManager.ReadMode()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, probeSettingsRequest{
+			Auto:       mode.EPProbeAuto,
+			Interval:   mode.EPProbeInterval,
+			Hysteresis: mode.EPProbeHysteresis,
+		})
+	case http.MethodPut:
+		h.putProbeSettings(w, r)
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handlers) putProbeSettings(w http.ResponseWriter, r *http.Request) {
+	var req probeSettingsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	if req.Auto != "yes" {
+		req.Auto = "no"
+	}
+	if req.Interval < 60 {
+		req.Interval = 600
+	}
+	if req.Hysteresis < 0 || req.Hysteresis > 90 {
+		writeError(w, http.StatusBadRequest, "ep_probe_hysteresis must be 0..90")
+		return
+	}
+
+	if err := h.deps.ConfigManager.WriteProbeConfig(req.Auto, req.Interval, req.Hysteresis); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
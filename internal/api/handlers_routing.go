@@ -2,11 +2,19 @@ package api
 
 import (
 	"encoding/json"
+	"errors"
 	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jounts/TrustTunnel4keenetic/internal/ndm"
+	"github.com/jounts/TrustTunnel4keenetic/internal/routing"
+	"github.com/jounts/TrustTunnel4keenetic/internal/service"
 )
 
 type routingConfigRequest struct {
 	Enabled     string `json:"sr_enabled"`
+	Policy      string `json:"sr_policy"`
 	HomeCountry string `json:"sr_home_country"`
 	DNSPort     int    `json:"sr_dns_port"`
 	DNSUpstream string `json:"sr_dns_upstream"`
@@ -46,9 +54,13 @@ func (h *handlers) getRouting(w http.ResponseWriter, r *http.Request) {
 		stats = h.deps.RoutingManager.GetStats()
 	}
 
+	if mode.SRPolicy == "" {
+		mode.SRPolicy = routing.PolicyTunnelDefault
+	}
 	resp := routingInfoResponse{
 		Config: routingConfigRequest{
 			Enabled:     mode.SREnabled,
+			Policy:      mode.SRPolicy,
 			HomeCountry: mode.SRHomeCountry,
 			DNSPort:     mode.SRDNSPort,
 			DNSUpstream: mode.SRDNSUpstream,
@@ -68,6 +80,13 @@ func (h *handlers) putRouting(w http.ResponseWriter, r *http.Request) {
 	if req.Enabled == "" {
 		req.Enabled = "no"
 	}
+	if req.Policy == "" {
+		req.Policy = routing.PolicyTunnelDefault
+	}
+	if !routing.ValidPolicy(req.Policy) {
+		writeError(w, http.StatusBadRequest, "sr_policy must be tunnel_default or direct_default")
+		return
+	}
 	if req.HomeCountry == "" {
 		req.HomeCountry = "RU"
 	}
@@ -78,12 +97,17 @@ func (h *handlers) putRouting(w http.ResponseWriter, r *http.Request) {
 		req.DNSUpstream = "1.1.1.1"
 	}
 
-	if err := h.deps.ConfigManager.WriteSRConfig(req.Enabled, req.HomeCountry, req.DNSUpstream, req.DNSPort); err != nil {
+	if err := h.deps.ConfigManager.WriteSRConfig(req.Enabled, req.Policy, req.HomeCountry, req.DNSUpstream, req.DNSPort); err != nil {
 		writeError(w, http.StatusInternalServerError, err.Error())
 		return
 	}
 
 	if h.deps.RoutingManager != nil && req.Enabled == "yes" {
+		if st := service.CheckDeps(h.fwBackend()); !st.Ready {
+			writeError(w, http.StatusPreconditionFailed,
+				"config saved but missing packages: "+strings.Join(st.Missing, ", ")+" (install them via /api/deps/install)")
+			return
+		}
 		if err := h.deps.RoutingManager.Apply(); err != nil {
 			writeError(w, http.StatusInternalServerError, "config saved but apply failed: "+err.Error())
 			return
@@ -139,6 +163,54 @@ func (h *handlers) putRoutingDomains(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
+// routingBypassHandler serves bypass_domains.txt, the domains routed
+// directly even when they match domains.txt.
+func (h *handlers) routingBypassHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getRoutingBypass(w, r)
+	case http.MethodPut:
+		h.putRoutingBypass(w, r)
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handlers) getRoutingBypass(w http.ResponseWriter, r *http.Request) {
+	if h.deps.RoutingManager == nil {
+		writeJSON(w, http.StatusOK, routingDomainsRequest{Domains: ""})
+		return
+	}
+	domains, err := h.deps.RoutingManager.GetBypassDomains()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, routingDomainsRequest{Domains: domains})
+}
+
+func (h *handlers) putRoutingBypass(w http.ResponseWriter, r *http.Request) {
+	var req routingDomainsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if h.deps.RoutingManager == nil {
+		writeError(w, http.StatusInternalServerError, "routing manager not initialized")
+		return
+	}
+
+	if err := h.deps.RoutingManager.SaveBypassDomains(req.Domains); err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
 func (h *handlers) updateRoutingNets(w http.ResponseWriter, r *http.Request) {
 	if h.deps.RoutingManager == nil {
 		writeError(w, http.StatusInternalServerError, "routing manager not initialized")
@@ -152,3 +224,202 @@ func (h *handlers) updateRoutingNets(w http.ResponseWriter, r *http.Request) {
 
 	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 }
+
+func (h *handlers) routingStaticHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getRoutingStatic(w, r)
+	case http.MethodPut:
+		h.putRoutingStatic(w, r)
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handlers) getRoutingStatic(w http.ResponseWriter, r *http.Request) {
+	if h.deps.RoutingManager == nil {
+		writeJSON(w, http.StatusOK, routing.StaticLists{Tunnel: []routing.StaticEntry{}, Direct: []routing.StaticEntry{}})
+		return
+	}
+	lists, err := h.deps.RoutingManager.GetStatic()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, lists)
+}
+
+func (h *handlers) putRoutingStatic(w http.ResponseWriter, r *http.Request) {
+	var req routing.StaticLists
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if h.deps.RoutingManager == nil {
+		writeError(w, http.StatusInternalServerError, "routing manager not initialized")
+		return
+	}
+
+	lists, err := h.deps.RoutingManager.SaveStatic(req)
+	if lists == nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "lists saved but apply failed: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, lists)
+}
+
+type routingDevicesRequest struct {
+	Devices []routing.DevicePolicy `json:"devices"`
+}
+
+// routingDevicesHandler serves the per-device policies (tunnel, direct or
+// smart) keyed by MAC or IPv4 address.
+func (h *handlers) routingDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		h.getRoutingDevices(w, r)
+	case http.MethodPut:
+		h.putRoutingDevices(w, r)
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handlers) getRoutingDevices(w http.ResponseWriter, r *http.Request) {
+	if h.deps.RoutingManager == nil {
+		writeJSON(w, http.StatusOK, routingDevicesRequest{Devices: []routing.DevicePolicy{}})
+		return
+	}
+	devices, err := h.deps.RoutingManager.GetDevices()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, routingDevicesRequest{Devices: devices})
+}
+
+func (h *handlers) putRoutingDevices(w http.ResponseWriter, r *http.Request) {
+	var req routingDevicesRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if h.deps.RoutingManager == nil {
+		writeError(w, http.StatusInternalServerError, "routing manager not initialized")
+		return
+	}
+
+	devices, err := h.deps.RoutingManager.SaveDevices(req.Devices)
+	if devices == nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "devices saved but apply failed: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, routingDevicesRequest{Devices: devices})
+}
+
+// getRoutingHosts lists the router's LAN hosts for the device picker.
+func (h *handlers) getRoutingHosts(w http.ResponseWriter, r *http.Request) {
+	if h.deps.NDMClient == nil {
+		writeJSON(w, http.StatusOK, []ndm.Host{})
+		return
+	}
+	hosts, err := h.deps.NDMClient.Hosts()
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, hosts)
+}
+
+type routingOverrideRequest struct {
+	Kind   string `json:"kind"`
+	Target string `json:"target"`
+	Policy string `json:"policy"`
+	// TTL is the lifetime in seconds
+	TTL int `json:"ttl"`
+}
+
+// routingOverridesHandler serves GET /api/routing/overrides (active
+// overrides with their remaining time) and POST (new override).
+func (h *handlers) routingOverridesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		if h.deps.RoutingManager == nil {
+			writeJSON(w, http.StatusOK, map[string]any{"overrides": []routing.Override{}})
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"overrides": h.deps.RoutingManager.GetOverrides()})
+	case http.MethodPost:
+		h.postRoutingOverride(w, r)
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (h *handlers) postRoutingOverride(w http.ResponseWriter, r *http.Request) {
+	var req routingOverrideRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+
+	if h.deps.RoutingManager == nil {
+		writeError(w, http.StatusInternalServerError, "routing manager not initialized")
+		return
+	}
+
+	o := routing.Override{Kind: req.Kind, Target: req.Target, Policy: req.Policy}
+	override, err := h.deps.RoutingManager.AddOverride(o, time.Duration(req.TTL)*time.Second)
+	if override == nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "override saved but apply failed: "+err.Error())
+		return
+	}
+	writeJSON(w, http.StatusCreated, override)
+}
+
+// routingOverrideHandler serves DELETE /api/routing/overrides/{id}.
+func (h *handlers) routingOverrideHandler(w http.ResponseWriter, r *http.Request) {
+	id := extractPathSuffix(r.URL.Path, "/api/routing/overrides/")
+	if id == "" || strings.Contains(id, "/") || h.deps.RoutingManager == nil {
+		writeError(w, http.StatusNotFound, "override not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodDelete:
+		err := h.deps.RoutingManager.RemoveOverride(id)
+		if errors.Is(err, routing.ErrOverrideNotFound) {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "override removed but apply failed: "+err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
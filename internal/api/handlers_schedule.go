@@ -0,0 +1,81 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jounts/TrustTunnel4keenetic/internal/service"
+)
+
+const schedulePreviewCount = 5
+
+// scheduleHandler serves GET /api/schedule (rules and active ones) and
+// POST /api/schedule (new rule).
+func (h *handlers) scheduleHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, h.deps.Scheduler.Status())
+	case http.MethodPost:
+		var req service.ScheduleRule
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		rule, err := h.deps.Scheduler.Create(req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusCreated, rule)
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// scheduleRuleHandler serves PUT and DELETE /api/schedule/{id}.
+func (h *handlers) scheduleRuleHandler(w http.ResponseWriter, r *http.Request) {
+	id := extractPathSuffix(r.URL.Path, "/api/schedule/")
+	if id == "" || strings.Contains(id, "/") {
+		writeError(w, http.StatusNotFound, "rule not found")
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		var req service.ScheduleRule
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		rule, err := h.deps.Scheduler.Update(id, req)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, rule)
+	case http.MethodDelete:
+		if err := h.deps.Scheduler.Delete(id); err != nil {
+			writeError(w, http.StatusNotFound, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// getSchedulePreview returns the next transitions, 5 unless ?n= is given.
+func (h *handlers) getSchedulePreview(w http.ResponseWriter, r *http.Request) {
+	n := schedulePreviewCount
+	if v, err := strconv.Atoi(r.URL.Query().Get("n")); err == nil && v > 0 && v <= 50 {
+		n = v
+	}
+	writeJSON(w, http.StatusOK, h.deps.Scheduler.Preview(time.Now(), n))
+}
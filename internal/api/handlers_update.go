@@ -1,9 +1,30 @@
 package api
 
 import (
+	"context"
+	"encoding/json"
+	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/jounts/TrustTunnel4keenetic/internal/service"
 )
 
+type installRequest struct {
+	Tag string `json:"tag"`
+}
+
+// readInstallTag returns the optional release tag from the request body; an
+// empty body installs the latest release on the configured channel.
+func readInstallTag(r *http.Request) (string, bool) {
+	var req installRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		return "", false
+	}
+	return req.Tag, service.ValidTag(req.Tag)
+}
+
 func (h *handlers) checkUpdate(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Query().Get("force") == "true" {
 		h.deps.Updater.InvalidateCache()
@@ -16,20 +37,158 @@ func (h *handlers) checkUpdate(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, info)
 }
 
+// installUpdate starts a background job that downloads and installs the
+// client; the UI follows its progress via /api/jobs/{id}.
 func (h *handlers) installUpdate(w http.ResponseWriter, r *http.Request) {
-	result, err := h.deps.Updater.Install()
+	h.startUpdateJob(w, r, h.deps.Updater.Install)
+}
+
+func (h *handlers) installManagerUpdate(w http.ResponseWriter, r *http.Request) {
+	h.startUpdateJob(w, r, h.deps.Updater.InstallManager)
+}
+
+func (h *handlers) startUpdateJob(w http.ResponseWriter, r *http.Request,
+	install func(context.Context, *service.Job, string) (*service.UpdateResult, error)) {
+	tag, ok := readInstallTag(r)
+	if !ok {
+		writeError(w, http.StatusBadRequest, "invalid request body")
+		return
+	}
+	job, err := h.deps.Jobs.Start("update", "", func(ctx context.Context, j *service.Job) (any, error) {
+		res, err := install(ctx, j, tag)
+		if err != nil {
+			return nil, err
+		}
+		return res, nil
+	})
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeError(w, http.StatusConflict, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusAccepted, job)
+}
+
+func (h *handlers) rollbackUpdate(w http.ResponseWriter, r *http.Request) {
+	result, err := h.deps.Updater.Rollback("manual rollback")
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	writeJSON(w, http.StatusOK, result)
 }
 
-func (h *handlers) installManagerUpdate(w http.ResponseWriter, r *http.Request) {
-	result, err := h.deps.Updater.InstallManager()
+// getChangelog returns the release notes between the installed and the
+// latest versions.
+func (h *handlers) getChangelog(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.deps.Updater.Changelog())
+}
+
+func (h *handlers) listReleases(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.deps.Updater.Releases())
+}
+
+func (h *handlers) updateSettingsHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, h.deps.Updater.Settings())
+	case http.MethodPut:
+		var req service.UpdateSettings
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, "invalid request body")
+			return
+		}
+		if err := h.deps.Updater.WriteSettings(req); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+const maxUploadSize = 64 << 20
+
+// uploadUpdate installs a client tarball or manager binary sent as the
+// multipart field "file", with optional "component", "version", "sums"
+// (SHA256SUMS) and "sig" (its signature). The file is streamed straight
+// into DOWNLOAD_DIR, so it takes space only once.
+func (h *handlers) uploadUpdate(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize)
+	mr, err := r.MultipartReader()
 	if err != nil {
-		writeError(w, http.StatusInternalServerError, err.Error())
+		writeError(w, http.StatusBadRequest, "invalid upload: "+err.Error())
+		return
+	}
+
+	var up service.Upload
+	defer func() {
+		if up.Path != "" {
+			os.Remove(up.Path)
+		}
+	}()
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid upload: "+err.Error())
+			return
+		}
+		switch part.FormName() {
+		case "file":
+			if up.Path != "" {
+				writeError(w, http.StatusBadRequest, "only one file may be uploaded")
+				return
+			}
+			up.Name = filepath.Base(part.FileName())
+			// The request size bounds the file size; a chunked request
+			// has none, so the upload limit is reserved instead
+			need := r.ContentLength
+			if need < 0 || need > maxUploadSize {
+				need = maxUploadSize
+			}
+			up.Path, err = h.deps.Updater.StageUpload(part, need)
+		case "sums":
+			up.Sums, err = readPart(part)
+		case "sig":
+			up.Sig, err = readPart(part)
+		case "component":
+			var v []byte
+			v, err = readPart(part)
+			up.Component = string(v)
+		case "version":
+			var v []byte
+			v, err = readPart(part)
+			up.Version = string(v)
+		}
+		part.Close()
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if up.Path == "" {
+		writeError(w, http.StatusBadRequest, "file is required")
+		return
+	}
+	if !service.ValidTag(up.Version) {
+		writeError(w, http.StatusBadRequest, "invalid version")
+		return
+	}
+
+	result, err := h.deps.Updater.InstallUpload(up)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
 		return
 	}
 	writeJSON(w, http.StatusOK, result)
 }
+
+// readPart returns the content of a small multipart field.
+func readPart(part io.Reader) ([]byte, error) {
+	return io.ReadAll(io.LimitReader(part, 1<<20))
+}
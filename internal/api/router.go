@@ -13,7 +13,13 @@ import (
 type Dependencies struct {
 	ServiceManager *service.Manager
 	ConfigManager  *service.ConfigManager
+	Instances      *service.Instances
 	Updater        *service.Updater
+	Events         *service.EventLog
+	Failover       *service.Failover
+	Prober         *service.Prober
+	Jobs           *service.Jobs
+	Scheduler      *service.Scheduler
 	NDMClient      *ndm.Client
 	RoutingManager *routing.Manager
 	SystemInfo     *platform.Info
@@ -25,19 +31,37 @@ func NewRouter(deps Dependencies) http.Handler {
 	mux := http.NewServeMux()
 	h := &handlers{deps: deps}
 
-	mux.HandleFunc("/api/status", methodOnly("GET", h.getStatus))
-	mux.HandleFunc("/api/service/", methodOnly("POST", h.serviceAction))
-	mux.HandleFunc("/api/config", h.configHandler)
-	mux.HandleFunc("/api/mode", h.modeHandler)
-	mux.HandleFunc("/api/logs", h.logsHandler)
-	mux.HandleFunc("/api/logs/stream", h.streamLogs)
+	registerInstanceRoutes(mux, h)
+	mux.HandleFunc("/api/instances", h.instancesHandler)
+	mux.HandleFunc("/api/instances/", h.instanceHandler)
 	mux.HandleFunc("/api/update/check", methodOnly("GET", h.checkUpdate))
 	mux.HandleFunc("/api/update/install", methodOnly("POST", h.installUpdate))
 	mux.HandleFunc("/api/update/install-manager", methodOnly("POST", h.installManagerUpdate))
+	mux.HandleFunc("/api/update/rollback", methodOnly("POST", h.rollbackUpdate))
+	mux.HandleFunc("/api/update/releases", methodOnly("GET", h.listReleases))
+	mux.HandleFunc("/api/update/changelog", methodOnly("GET", h.getChangelog))
+	mux.HandleFunc("/api/update/settings", h.updateSettingsHandler)
+	mux.HandleFunc("/api/update/upload", methodOnly("POST", h.uploadUpdate))
 	mux.HandleFunc("/api/system", methodOnly("GET", h.getSystem))
 	mux.HandleFunc("/api/routing", h.routingHandler)
 	mux.HandleFunc("/api/routing/domains", h.routingDomainsHandler)
+	mux.HandleFunc("/api/routing/bypass-domains", h.routingBypassHandler)
+	mux.HandleFunc("/api/routing/static", h.routingStaticHandler)
+	mux.HandleFunc("/api/routing/devices", h.routingDevicesHandler)
+	mux.HandleFunc("/api/routing/hosts", methodOnly("GET", h.getRoutingHosts))
+	mux.HandleFunc("/api/routing/overrides", h.routingOverridesHandler)
+	mux.HandleFunc("/api/routing/overrides/", h.routingOverrideHandler)
 	mux.HandleFunc("/api/routing/update-nets", methodOnly("POST", h.updateRoutingNets))
+	mux.HandleFunc("/api/deps", methodOnly("GET", h.getDeps))
+	mux.HandleFunc("/api/deps/install", methodOnly("POST", h.installDeps))
+	mux.HandleFunc("/api/dns", h.dnsHandler)
+	mux.HandleFunc("/api/dns/leak-test", methodOnly("GET", h.dnsLeakTest))
+	mux.HandleFunc("/api/events", methodOnly("GET", h.getEvents))
+	mux.HandleFunc("/api/jobs", methodOnly("GET", h.listJobs))
+	mux.HandleFunc("/api/jobs/", h.jobHandler)
+	mux.HandleFunc("/api/schedule", h.scheduleHandler)
+	mux.HandleFunc("/api/schedule/preview", methodOnly("GET", h.getSchedulePreview))
+	mux.HandleFunc("/api/schedule/", h.scheduleRuleHandler)
 
 	apiHandler := withAuth(deps.Auth, withCORS(mux))
 
@@ -55,6 +79,23 @@ func NewRouter(deps Dependencies) http.Handler {
 	return withLogging(root)
 }
 
+// registerInstanceRoutes registers the endpoints that act on a single tunnel
+// instance. They are served at /api/... for the default instance and at
+// /api/instances/{name}/... for named ones.
+func registerInstanceRoutes(mux *http.ServeMux, h *handlers) {
+	mux.HandleFunc("/api/status", methodOnly("GET", h.getStatus))
+	mux.HandleFunc("/api/service/", methodOnly("POST", h.serviceAction))
+	mux.HandleFunc("/api/config", h.configHandler)
+	mux.HandleFunc("/api/mode", h.modeHandler)
+	mux.HandleFunc("/api/logs", h.logsHandler)
+	mux.HandleFunc("/api/logs/stream", h.streamLogs)
+	mux.HandleFunc("/api/failover", h.failoverHandler)
+	mux.HandleFunc("/api/failover/switch", methodOnly("POST", h.failoverSwitch))
+	mux.HandleFunc("/api/endpoint/probe", h.endpointProbe)
+	mux.HandleFunc("/api/endpoint/probe/settings", h.probeSettingsHandler)
+	mux.HandleFunc("/api/tune", methodOnly("POST", h.startTune))
+}
+
 type handlers struct {
 	deps Dependencies
 }
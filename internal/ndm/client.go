@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -29,6 +30,31 @@ type rciStatus struct {
 	Message string `json:"message,omitempty"`
 }
 
+const tunPrefixLen = 128
+
+// InterfaceConfig describes the NDM interface of a tunnel instance.
+type InterfaceConfig struct {
+	Mode      string
+	TunIdx    int
+	ProxyIdx  int
+	SocksPort int
+	// IPv6 adds an IPv6 address and default route on the OpkgTun interface
+	IPv6 bool
+	// DefaultRoute makes the OpkgTun interface the default route; only the
+	// default instance owns it, others are selected via NDM policies.
+	DefaultRoute bool
+}
+
+// tunAddress returns the point-to-point address of OpkgTun{idx}. Each index
+// gets its own /30 so several instances can run side by side.
+func tunAddress(idx int) string {
+	return fmt.Sprintf("172.16.219.%d", 2+4*idx)
+}
+
+func tunAddress6(idx int) string {
+	return fmt.Sprintf("fd16:219::%x", 2+4*idx)
+}
+
 type Client struct {
 	baseURL    string
 	httpClient *http.Client
@@ -64,30 +90,34 @@ func (c *Client) ShowInterface(name string) (map[string]any, error) {
 	return result, nil
 }
 
-func (c *Client) RecreateInterface(mode string, tunIdx, proxyIdx int) error {
-	if mode == "socks5" {
+// RecreateInterface switches the NDM interface of an instance to cfg.Mode.
+func (c *Client) RecreateInterface(cfg InterfaceConfig) error {
+	if cfg.Mode == "socks5" {
 		// Remove TUN interface when switching to SOCKS5
-		tunName := fmt.Sprintf("OpkgTun%d", tunIdx)
+		tunName := fmt.Sprintf("OpkgTun%d", cfg.TunIdx)
 		if err := c.RemoveInterface(tunName); err != nil {
 			log.Printf("ndmc: failed to remove %s (may not exist): %v", tunName, err)
 		}
-		return c.setupProxyInterface(proxyIdx)
+		return c.setupProxyInterface(cfg.ProxyIdx, cfg.SocksPort)
 	}
 	// Remove Proxy interface when switching to TUN
-	proxyName := fmt.Sprintf("Proxy%d", proxyIdx)
+	proxyName := fmt.Sprintf("Proxy%d", cfg.ProxyIdx)
 	if err := c.RemoveInterface(proxyName); err != nil {
 		log.Printf("ndmc: failed to remove %s (may not exist): %v", proxyName, err)
 	}
-	return c.setupTunInterface(tunIdx)
+	return c.setupTunInterface(cfg)
 }
 
-func (c *Client) setupProxyInterface(idx int) error {
+func (c *Client) setupProxyInterface(idx, socksPort int) error {
+	if socksPort == 0 {
+		socksPort = 1080
+	}
 	name := fmt.Sprintf("Proxy%d", idx)
 	commands := []string{
 		fmt.Sprintf("interface %s", name),
 		fmt.Sprintf("interface %s description \"TrustTunnel Proxy %d\"", name, idx),
 		fmt.Sprintf("interface %s proxy protocol socks5", name),
-		fmt.Sprintf("interface %s proxy upstream 127.0.0.1 1080", name),
+		fmt.Sprintf("interface %s proxy upstream 127.0.0.1 %d", name, socksPort),
 		fmt.Sprintf("interface %s proxy connect", name),
 	}
 
@@ -100,20 +130,35 @@ func (c *Client) setupProxyInterface(idx int) error {
 	return c.runRCI(commands)
 }
 
-func (c *Client) setupTunInterface(idx int) error {
+func (c *Client) setupTunInterface(cfg InterfaceConfig) error {
+	idx := cfg.TunIdx
 	name := fmt.Sprintf("OpkgTun%d", idx)
 	commands := []string{
 		fmt.Sprintf("interface %s", name),
 		fmt.Sprintf("interface %s description \"TrustTunnel TUN %d\"", name, idx),
-		fmt.Sprintf("interface %s ip address 172.16.219.2 255.255.255.255", name),
+		fmt.Sprintf("interface %s ip address %s 255.255.255.255", name, tunAddress(idx)),
 		fmt.Sprintf("interface %s ip global auto", name),
 		fmt.Sprintf("interface %s ip mtu 1280", name),
 		fmt.Sprintf("interface %s ip tcp adjust-mss pmtu", name),
 		fmt.Sprintf("interface %s security-level public", name),
 		fmt.Sprintf("interface %s up", name),
-		fmt.Sprintf("ip route default 172.16.219.2 %s", name),
-		"system configuration save",
 	}
+	if cfg.DefaultRoute {
+		commands = append(commands, fmt.Sprintf("ip route default %s %s", tunAddress(idx), name))
+	}
+	if cfg.IPv6 {
+		commands = append(commands,
+			fmt.Sprintf("interface %s ipv6 address %s/%d", name, tunAddress6(idx), tunPrefixLen))
+		if cfg.DefaultRoute {
+			commands = append(commands, fmt.Sprintf("ipv6 route ::/0 %s", name))
+		}
+	} else {
+		commands = append(commands,
+			fmt.Sprintf("no interface %s ipv6 address", name),
+			fmt.Sprintf("no ipv6 route ::/0 %s", name),
+		)
+	}
+	commands = append(commands, "system configuration save")
 	return c.runRCI(commands)
 }
 
@@ -124,7 +169,11 @@ func (c *Client) RemoveInterface(name string) error {
 	}
 	// Clean up default route pointing to TUN interfaces
 	if strings.HasPrefix(name, "OpkgTun") {
-		cmds = append(cmds, fmt.Sprintf("no ip route default 172.16.219.2 %s", name))
+		idx, _ := strconv.Atoi(strings.TrimPrefix(name, "OpkgTun"))
+		cmds = append(cmds,
+			fmt.Sprintf("no ip route default %s %s", tunAddress(idx), name),
+			fmt.Sprintf("no ipv6 route ::/0 %s", name),
+		)
 	}
 	cmds = append(cmds, "system configuration save")
 	return c.runRCI(cmds)
@@ -295,3 +344,73 @@ func detectVersionViaRCI() string {
 	}
 	return result.Title
 }
+
+// Host is a LAN device known to the router.
+type Host struct {
+	MAC    string `json:"mac"`
+	IP     string `json:"ip"`
+	Name   string `json:"name"`
+	Active bool   `json:"active"`
+}
+
+// Hosts returns the router's host list ("show ip hotspot"). Name is the
+// name given in the web UI, or the DHCP hostname.
+func (c *Client) Hosts() ([]Host, error) {
+	resp, err := c.httpClient.Get(c.baseURL + "/rci/show/ip/hotspot")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("rci: show ip hotspot: HTTP %d", resp.StatusCode)
+	}
+
+	var result struct {
+		Host []struct {
+			MAC      string `json:"mac"`
+			IP       string `json:"ip"`
+			Name     string `json:"name"`
+			Hostname string `json:"hostname"`
+			Active   bool   `json:"active"`
+		} `json:"host"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("rci: show ip hotspot: %w", err)
+	}
+	hosts := make([]Host, 0, len(result.Host))
+	for _, h := range result.Host {
+		name := h.Name
+		if name == "" {
+			name = h.Hostname
+		}
+		hosts = append(hosts, Host{MAC: strings.ToLower(h.MAC), IP: h.IP, Name: name, Active: h.Active})
+	}
+	return hosts, nil
+}
+
+// TimeZone returns the router's time zone ("show clock date"): the locality
+// set in the web UI and its POSIX TZ rule, e.g. "Moscow" and "MSK-3".
+func (c *Client) TimeZone() (string, string, error) {
+	resp, err := c.httpClient.Get(c.baseURL + "/rci/show/clock/date")
+	if err != nil {
+		return "", "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", "", fmt.Errorf("rci: show clock date: HTTP %d", resp.StatusCode)
+	}
+
+	var result struct {
+		TZ struct {
+			Locality string `json:"locality"`
+			Rule     string `json:"rule"`
+		} `json:"tz"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", "", fmt.Errorf("rci: show clock date: %w", err)
+	}
+	if result.TZ.Rule == "" && result.TZ.Locality == "" {
+		return "", "", fmt.Errorf("rci: show clock date: no time zone")
+	}
+	return result.TZ.Locality, result.TZ.Rule, nil
+}
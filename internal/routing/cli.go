@@ -0,0 +1,50 @@
+package routing
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Commands lists the smart-routing commands of "trusttunnel-manager
+// -routing", used by smart-routing.sh.
+var Commands = []string{
+	"start", "stop", "restore", "plan", "update-nets", "save-gateway",
+	"dnsmasq-start", "dnsmasq-stop", "dnsmasq-reload",
+}
+
+// RunCommand runs one smart-routing command; plan prints the pending
+// changes.
+func (m *Manager) RunCommand(cmd string) error {
+	switch cmd {
+	case "start":
+		return m.Start()
+	case "stop":
+		return m.Stop()
+	case "restore":
+		return m.Restore()
+	case "plan":
+		d, err := m.Plan()
+		if err != nil {
+			return err
+		}
+		if d.Empty() {
+			fmt.Println("up to date")
+		}
+		for _, line := range d.Summary() {
+			fmt.Println(line)
+		}
+		return nil
+	case "update-nets":
+		return m.UpdateNets()
+	case "save-gateway":
+		return m.SaveOrigGateway()
+	case "dnsmasq-start":
+		return m.StartDnsmasq()
+	case "dnsmasq-stop":
+		m.StopDnsmasq()
+		return nil
+	case "dnsmasq-reload":
+		return m.reloadDnsmasq()
+	}
+	return fmt.Errorf("unknown routing command %q (expected one of: %s)", cmd, strings.Join(Commands, ", "))
+}
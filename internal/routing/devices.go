@@ -0,0 +1,171 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+const (
+	devicesPath = "/opt/trusttunnel_client/routing/devices.json"
+
+	setDevTunnelMAC = "tt_dev_tunnel_mac"
+	setDevTunnelIP  = "tt_dev_tunnel_ip"
+	setDevDirectMAC = "tt_dev_direct_mac"
+	setDevDirectIP  = "tt_dev_direct_ip"
+	devMaxElem      = 256
+)
+
+// Device policies: where all traffic of a LAN host goes.
+const (
+	DeviceTunnel = "tunnel"
+	DeviceDirect = "direct"
+	// DeviceSmart leaves the host to the lists and the routing policy,
+	// like a host without an entry
+	DeviceSmart = "smart"
+)
+
+// DevicePolicy routes a LAN host, identified by its MAC or IPv4 address.
+type DevicePolicy struct {
+	Key    string `json:"key"`
+	Name   string `json:"name,omitempty"`
+	Policy string `json:"policy"`
+}
+
+// GetDevices returns the stored device policies.
+func (m *Manager) GetDevices() ([]DevicePolicy, error) {
+	data, err := os.ReadFile(devicesPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []DevicePolicy{}, nil
+		}
+		return nil, err
+	}
+	devices := []DevicePolicy{}
+	if err := json.Unmarshal(data, &devices); err != nil {
+		return nil, fmt.Errorf("%s: %w", devicesPath, err)
+	}
+	return devices, nil
+}
+
+// SaveDevices validates and stores the device policies and loads them into
+// their sets when smart routing is running. Like SaveStatic, it returns the
+// stored list with the error of a failed apply.
+func (m *Manager) SaveDevices(devices []DevicePolicy) ([]DevicePolicy, error) {
+	out, err := cleanDevices(devices)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.MarshalIndent(out, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(routingDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(devicesPath, append(data, '\n'), 0644); err != nil {
+		return nil, err
+	}
+	if err := m.Restore(); err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+// cleanDevices canonicalizes the keys and rejects unknown policies and
+// hosts listed twice.
+func cleanDevices(devices []DevicePolicy) ([]DevicePolicy, error) {
+	out := []DevicePolicy{}
+	seen := make(map[string]bool)
+	for _, d := range devices {
+		key, ok := DeviceKey(d.Key)
+		if !ok {
+			return nil, fmt.Errorf("invalid device %q: need a MAC or IPv4 address", d.Key)
+		}
+		switch d.Policy {
+		case DeviceTunnel, DeviceDirect, DeviceSmart:
+		default:
+			return nil, fmt.Errorf("%s: policy must be tunnel, direct or smart", key)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("%s is listed twice", key)
+		}
+		seen[key] = true
+		name := strings.TrimSpace(strings.ReplaceAll(d.Name, "\n", " "))
+		out = append(out, DevicePolicy{Key: key, Name: name, Policy: d.Policy})
+	}
+	return out, nil
+}
+
+// DeviceKey canonicalizes a device key: a MAC or a single IPv4 address.
+func DeviceKey(s string) (string, bool) {
+	if mac, ok := canonicalMAC(s); ok {
+		return mac, true
+	}
+	a, err := netip.ParseAddr(strings.TrimSpace(s))
+	if err != nil || !a.Unmap().Is4() {
+		return "", false
+	}
+	return a.Unmap().String(), true
+}
+
+// deviceMembers are the members of the device sets.
+type deviceMembers struct {
+	TunnelMAC, TunnelIP []string
+	DirectMAC, DirectIP []string
+}
+
+// readDeviceMembers splits the stored policies, replaced by those of the
+// overlay, by set; smart devices are in none of them.
+func (m *Manager) readDeviceMembers() deviceMembers {
+	var dm deviceMembers
+	devices, err := m.GetDevices()
+	if err != nil {
+		logf("WARNING: %v", err)
+	}
+	overlay := effectiveOverlay().Devices
+	for i, d := range devices {
+		if p, ok := overlay[d.Key]; ok {
+			devices[i].Policy = p
+			delete(overlay, d.Key)
+		}
+	}
+	for key, p := range overlay {
+		devices = append(devices, DevicePolicy{Key: key, Policy: p})
+	}
+	for _, d := range devices {
+		_, isMAC := canonicalMAC(d.Key)
+		switch {
+		case d.Policy == DeviceTunnel && isMAC:
+			dm.TunnelMAC = append(dm.TunnelMAC, d.Key)
+		case d.Policy == DeviceTunnel:
+			dm.TunnelIP = append(dm.TunnelIP, d.Key)
+		case d.Policy == DeviceDirect && isMAC:
+			dm.DirectMAC = append(dm.DirectMAC, d.Key)
+		case d.Policy == DeviceDirect:
+			dm.DirectIP = append(dm.DirectIP, d.Key)
+		}
+	}
+	return dm
+}
+
+// deviceSets returns the device sets and the rules matching them by
+// source, which go ahead of the destination lists. tunnel is the rule for
+// tunnelled hosts under the current routing policy.
+func deviceSets(dm deviceMembers, tunnel uint32) ([]Set, []MangleRule) {
+	sets := []Set{
+		{SetSpec: SetSpec{Name: setDevDirectMAC, MAC: true, MaxElem: devMaxElem}, Members: dm.DirectMAC},
+		{SetSpec: SetSpec{Name: setDevDirectIP, MaxElem: devMaxElem}, Members: dm.DirectIP},
+		{SetSpec: SetSpec{Name: setDevTunnelMAC, MAC: true, MaxElem: devMaxElem}, Members: dm.TunnelMAC},
+		{SetSpec: SetSpec{Name: setDevTunnelIP, MaxElem: devMaxElem}, Members: dm.TunnelIP},
+	}
+	rules := []MangleRule{
+		{Set: setDevDirectMAC, Src: true, Mark: directMark},
+		{Set: setDevDirectIP, Src: true, Mark: directMark},
+		{Set: setDevTunnelMAC, Src: true, Mark: tunnel},
+		{Set: setDevTunnelIP, Src: true, Mark: tunnel},
+	}
+	return sets, rules
+}
@@ -0,0 +1,221 @@
+package routing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// leakProbeZone answers TXT queries with the address of the recursive
+// resolver that contacted its authoritative server ("ns" record).
+const leakProbeZone = "whoami.ds.akahelp.net"
+
+const systemResolver = "127.0.0.1:53"
+
+type LeakProbe struct {
+	Resolver string `json:"resolver"`
+	Name     string `json:"name"`
+	Upstream string `json:"upstream"`
+	RTTMs    int64  `json:"rtt_ms"`
+	Error    string `json:"error,omitempty"`
+}
+
+// LanRedirect reports whether the firewall redirects the DNS of a LAN
+// bridge to the tunnel resolver.
+type LanRedirect struct {
+	Iface string `json:"iface"`
+	// Configured is set for the bridges listed in DNS_LAN_IFACE
+	Configured bool `json:"configured"`
+	Redirected bool `json:"redirected"`
+}
+
+type LeakTestResult struct {
+	Policy     string        `json:"policy"`
+	Tunnel     LeakProbe     `json:"tunnel"`
+	System     LeakProbe     `json:"system"`
+	Interfaces []LanRedirect `json:"interfaces"`
+	Leak       bool          `json:"leak"`
+	// Reasons lists the measurements that make up a leak
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+func (m *Manager) ApplyDNSPolicy() error {
+	out, err := m.runScript("sr_dns_guard_stop; sr_dns_guard_start")
+	if err != nil {
+		return fmt.Errorf("apply dns policy: %w: %s", err, out)
+	}
+	return nil
+}
+
+func (m *Manager) StopDNSPolicy() error {
+	out, err := m.runScript("sr_dns_guard_stop")
+	if err != nil {
+		return fmt.Errorf("stop dns policy: %w: %s", err, out)
+	}
+	return nil
+}
+
+// DNSLeakTest resolves a unique probe name through the tunnel resolver (the
+// smart-routing dnsmasq on dnsPort) and through the router's own resolver,
+// and reports which upstream answered each query. Queries sent by the
+// router itself do not pass the PREROUTING redirect, so the LAN side is
+// checked in the firewall: every bridge in lanIfaces and every bridge found
+// on the router must redirect port 53 to dnsPort. The result is a leak when
+// a bridge is not redirected, the tunnel resolver does not answer or both
+// resolvers reach the same upstream.
+func (m *Manager) DNSLeakTest(policy string, dnsPort int, lanIfaces []string) *LeakTestResult {
+	res := &LeakTestResult{
+		Policy: policy,
+		Tunnel: probeResolver(fmt.Sprintf("127.0.0.1:%d", dnsPort)),
+		System: probeResolver(systemResolver),
+	}
+
+	redirected := dnsRedirects(dnsPort)
+	configured := make(map[string]bool, len(lanIfaces))
+	for _, iface := range lanIfaces {
+		configured[iface] = true
+	}
+	ifaces := append([]string{}, lanIfaces...)
+	for _, br := range LanBridges() {
+		if !configured[br] {
+			ifaces = append(ifaces, br)
+		}
+	}
+	for _, iface := range ifaces {
+		r := LanRedirect{Iface: iface, Configured: configured[iface], Redirected: redirected[iface]}
+		res.Interfaces = append(res.Interfaces, r)
+		if !r.Redirected {
+			res.Reasons = append(res.Reasons, fmt.Sprintf("DNS from %s is not redirected to port %d", iface, dnsPort))
+		}
+	}
+
+	switch {
+	case res.Tunnel.Upstream == "":
+		res.Reasons = append(res.Reasons, "tunnel resolver did not answer")
+	case res.Tunnel.Upstream == res.System.Upstream:
+		res.Reasons = append(res.Reasons, "tunnel and system resolvers reach the same upstream "+res.Tunnel.Upstream)
+	}
+	res.Leak = len(res.Reasons) > 0
+	return res
+}
+
+// LanBridges returns the bridges on the router, the LAN segments of NDM
+// (br0 Home, br1 Guest, ...).
+func LanBridges() []string {
+	dirs, _ := filepath.Glob("/sys/class/net/*/bridge")
+	var out []string
+	for _, d := range dirs {
+		out = append(out, filepath.Base(filepath.Dir(d)))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// dnsRedirects returns the interfaces whose udp port 53 the firewall
+// redirects to port, as set up by fw_setup_dns_redirect.
+func dnsRedirects(port int) map[string]bool {
+	out := map[string]bool{}
+	to := strconv.Itoa(port)
+	if !hasCommand("iptables") {
+		rules, err := run("", "nft", "list", "chain", "ip", "trusttunnel", "dns_redirect")
+		if err != nil {
+			return out
+		}
+		for _, line := range strings.Split(rules, "\n") {
+			if iface, ok := parseNftRedirect(line, to); ok {
+				out[iface] = true
+			}
+		}
+		return out
+	}
+
+	chain, err := run("", "iptables", "-t", "nat", "-S", "TT_DNS")
+	if err != nil || !strings.Contains(chain, "-p udp") || !strings.Contains(chain, "--to-ports "+to) {
+		return out
+	}
+	rules, err := run("", "iptables", "-t", "nat", "-S", "PREROUTING")
+	if err != nil {
+		return out
+	}
+	for _, line := range strings.Split(rules, "\n") {
+		f := strings.Fields(line)
+		if len(f) == 6 && f[0] == "-A" && f[2] == "-i" && f[4] == "-j" && f[5] == "TT_DNS" {
+			out[f[3]] = true
+		}
+	}
+	return out
+}
+
+// parseNftRedirect parses a rule of the dns_redirect chain:
+// iifname "br0" udp dport 53 redirect to :5354. Older nft print the port
+// as "domain".
+func parseNftRedirect(line, port string) (string, bool) {
+	f := strings.Fields(line)
+	if len(f) != 8 || f[0] != "iifname" || f[2] != "udp" || f[3] != "dport" ||
+		(f[4] != "53" && f[4] != "domain") || f[5] != "redirect" || f[7] != ":"+port {
+		return "", false
+	}
+	return strings.Trim(f[1], `"`), true
+}
+
+func probeResolver(server string) LeakProbe {
+	p := LeakProbe{Resolver: server, Name: uniqueProbeName()}
+
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			d := net.Dialer{Timeout: 3 * time.Second}
+			return d.DialContext(ctx, network, server)
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 8*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	records, err := r.LookupTXT(ctx, p.Name)
+	p.RTTMs = time.Since(start).Milliseconds()
+	if err != nil {
+		p.Error = err.Error()
+		return p
+	}
+
+	p.Upstream = parseProbeTXT(records)
+	if p.Upstream == "" {
+		p.Error = "probe answer has no resolver address"
+	}
+	return p
+}
+
+// parseProbeTXT extracts the resolver address from probe TXT records.
+// The character-strings of a record are concatenated by the resolver, so
+// ["ns" "192.0.2.1"] arrives as "ns192.0.2.1".
+func parseProbeTXT(records []string) string {
+	for _, rec := range records {
+		rec = strings.TrimSpace(rec)
+		if strings.HasPrefix(rec, "ns") {
+			if ip := net.ParseIP(strings.TrimSpace(rec[2:])); ip != nil {
+				return ip.String()
+			}
+		}
+		if ip := net.ParseIP(rec); ip != nil {
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+func uniqueProbeName() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("tt%d.%s", time.Now().UnixNano(), leakProbeZone)
+	}
+	return "tt" + hex.EncodeToString(b) + "." + leakProbeZone
+}
@@ -0,0 +1,135 @@
+package routing
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	dnsmasqConf     = "/opt/trusttunnel_client/routing/dnsmasq-sr.conf"
+	dnsmasqResolved = "/opt/var/run/dnsmasq-sr-resolved.conf"
+	routingLogFile  = "/opt/var/log/trusttunnel.log"
+)
+
+// readDomains returns the domains of a list file, skipping comments and
+// blank lines.
+func readDomains(path string) []string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var domains []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		d := strings.Join(strings.Fields(scanner.Text()), "")
+		if d == "" || strings.HasPrefix(d, "#") {
+			continue
+		}
+		domains = append(domains, d)
+	}
+	return domains
+}
+
+// setDirective returns the dnsmasq line adding the addresses of domain to
+// a set: nftset for the nftables backend, ipset otherwise. With v6 the AAAA
+// answers go to the IPv6 twin of the set.
+func setDirective(backend, domain, set string, v6 bool) string {
+	if backend == "nftables" {
+		line := fmt.Sprintf("nftset=/%s/4#inet#trusttunnel#%s", domain, set)
+		if v6 {
+			line += fmt.Sprintf(",6#inet#trusttunnel#%s6", set)
+		}
+		return line
+	}
+	if v6 {
+		// dnsmasq adds each address to the set of its family
+		return fmt.Sprintf("ipset=/%s/%s,%s6", domain, set, set)
+	}
+	return fmt.Sprintf("ipset=/%s/%s", domain, set)
+}
+
+func writeDnsmasqConf(cfg Config, backend string, v6 bool) error {
+	if err := os.MkdirAll(routingDir, 0755); err != nil {
+		return err
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "port=%d\nno-resolv\nno-hosts\nserver=%s\ncache-size=1500\nmin-cache-ttl=300\nlog-facility=%s\n",
+		cfg.DNSPort, cfg.DNSUpstream, routingLogFile)
+
+	var resolved strings.Builder
+	for _, d := range readDomains(domainsPath) {
+		resolved.WriteString(setDirective(backend, d, setTunnel, v6) + "\n")
+	}
+	for _, d := range readDomains(bypassPath) {
+		resolved.WriteString(setDirective(backend, d, setBypass, v6) + "\n")
+	}
+	for _, p := range []string{DeviceDirect, DeviceTunnel} {
+		for _, d := range overrideDomains(p) {
+			o := Override{Kind: OverrideDomain, Policy: p}
+			resolved.WriteString(setDirective(backend, d, o.set(), v6) + "\n")
+		}
+	}
+	if err := os.WriteFile(dnsmasqResolved, []byte(resolved.String()), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintf(&sb, "conf-file=%s\n", dnsmasqResolved)
+	return os.WriteFile(dnsmasqConf, []byte(sb.String()), 0644)
+}
+
+// startDnsmasq (re)starts the smart-routing dnsmasq instance with a fresh
+// config; set directives are only read at startup.
+func (m *Manager) startDnsmasq(cfg Config, fw FirewallBackend) error {
+	stopDnsmasq()
+	if err := writeDnsmasqConf(cfg, fw.Name(), m.routesIPv6(fw)); err != nil {
+		return fmt.Errorf("dnsmasq config: %w", err)
+	}
+	if _, err := run("", "dnsmasq", "--conf-file="+dnsmasqConf, "--pid-file="+dnsmasqPID); err != nil {
+		logf("ERROR: failed to start dnsmasq: %v", err)
+		return fmt.Errorf("start dnsmasq: %w", err)
+	}
+	logf("Dnsmasq started on port %d (pid: %s)", cfg.DNSPort, strings.TrimSpace(readFile(dnsmasqPID)))
+	return nil
+}
+
+func dnsmasqPid() int {
+	pid, _ := strconv.Atoi(strings.TrimSpace(readFile(dnsmasqPID)))
+	return pid
+}
+
+func stopDnsmasq() {
+	pid := dnsmasqPid()
+	os.Remove(dnsmasqPID)
+	if pid <= 0 || syscall.Kill(pid, 0) != nil {
+		return
+	}
+	syscall.Kill(pid, syscall.SIGTERM)
+	for i := 0; i < 20 && syscall.Kill(pid, 0) == nil; i++ {
+		time.Sleep(100 * time.Millisecond)
+	}
+	logf("Dnsmasq stopped (pid: %d)", pid)
+}
+
+// StartDnsmasq starts the smart-routing dnsmasq, also used by DNS leak
+// protection.
+func (m *Manager) StartDnsmasq() error {
+	fw, err := m.backend()
+	if err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("dnsmasq"); err != nil {
+		return fmt.Errorf("dnsmasq is not installed (opkg install dnsmasq-full)")
+	}
+	return m.startDnsmasq(loadConfig(), fw)
+}
+
+// StopDnsmasq stops the smart-routing dnsmasq.
+func (m *Manager) StopDnsmasq() {
+	stopDnsmasq()
+}
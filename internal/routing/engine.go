@@ -0,0 +1,422 @@
+package routing
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// State is the kernel state smart routing wants, or finds. Applying a
+// state with no sets, rules or routes removes smart routing. Rules is the
+// IPv4 chain and Rules6 the IPv6 one (see splitRules).
+type State struct {
+	Sets        []Set
+	Rules       []MangleRule
+	Rules6      []MangleRule
+	Routes      []Route
+	PolicyRules []PolicyRule
+	// Tables are the routing tables owned by smart routing: routes and
+	// policy rules for them that are not in the state are removed.
+	Tables []int
+}
+
+func (s *State) set(name string) (Set, bool) {
+	for _, set := range s.Sets {
+		if set.Name == name {
+			return set, true
+		}
+	}
+	return Set{}, false
+}
+
+// SetChange adds and removes members of an existing set.
+type SetChange struct {
+	Name string
+	Add  []string
+	Del  []string
+}
+
+// Diff is the list of changes turning the current state into the desired
+// one.
+type Diff struct {
+	CreateSets  []SetSpec
+	ReplaceSets []Set
+	UpdateSets  []SetChange
+	DestroySets []string
+
+	// SetRules replaces the chain with Rules; ClearRules removes it. The
+	// *6 fields do the same for the IPv6 chain.
+	SetRules    bool
+	Rules       []MangleRule
+	ClearRules  bool
+	SetRules6   bool
+	Rules6      []MangleRule
+	ClearRules6 bool
+
+	ReplaceRoutes  []Route
+	FlushTables    []int
+	FlushTables6   []int
+	AddPolicyRules []PolicyRule
+	DelPolicyRules []PolicyRule
+}
+
+// Empty reports whether the states already match.
+func (d *Diff) Empty() bool {
+	return len(d.CreateSets) == 0 && len(d.ReplaceSets) == 0 && len(d.UpdateSets) == 0 &&
+		len(d.DestroySets) == 0 && !d.SetRules && !d.ClearRules && !d.SetRules6 && !d.ClearRules6 &&
+		len(d.ReplaceRoutes) == 0 && len(d.FlushTables) == 0 && len(d.FlushTables6) == 0 &&
+		len(d.AddPolicyRules) == 0 && len(d.DelPolicyRules) == 0
+}
+
+// Summary describes the changes, one per line.
+func (d *Diff) Summary() []string {
+	var out []string
+	for _, s := range d.CreateSets {
+		out = append(out, "create set "+s.Name)
+	}
+	for _, s := range d.ReplaceSets {
+		out = append(out, fmt.Sprintf("recreate set %s (%d members)", s.Name, len(s.Members)))
+	}
+	for _, c := range d.UpdateSets {
+		out = append(out, fmt.Sprintf("set %s: +%d -%d", c.Name, len(c.Add), len(c.Del)))
+	}
+	if d.SetRules {
+		out = append(out, "mangle chain: "+rulesString(d.Rules))
+	}
+	if d.ClearRules {
+		out = append(out, "remove mangle chain")
+	}
+	if d.SetRules6 {
+		out = append(out, "ipv6 mangle chain: "+rulesString(d.Rules6))
+	}
+	if d.ClearRules6 {
+		out = append(out, "remove ipv6 mangle chain")
+	}
+	for _, r := range d.ReplaceRoutes {
+		if r.Gateway == "" {
+			out = append(out, fmt.Sprintf("%stable %d: default dev %s", familyPrefix(r.V6), r.Table, r.Dev))
+			continue
+		}
+		out = append(out, fmt.Sprintf("%stable %d: default via %s dev %s", familyPrefix(r.V6), r.Table, r.Gateway, r.Dev))
+	}
+	for _, t := range d.FlushTables {
+		out = append(out, fmt.Sprintf("flush table %d", t))
+	}
+	for _, t := range d.FlushTables6 {
+		out = append(out, fmt.Sprintf("ipv6 flush table %d", t))
+	}
+	for _, r := range d.AddPolicyRules {
+		out = append(out, familyPrefix(r.V6)+"add rule "+r.String())
+	}
+	for _, r := range d.DelPolicyRules {
+		out = append(out, familyPrefix(r.V6)+"delete rule "+r.String())
+	}
+	for _, s := range d.DestroySets {
+		out = append(out, "destroy set "+s)
+	}
+	return out
+}
+
+func rulesString(rules []MangleRule) string {
+	s := make([]string, len(rules))
+	for i, r := range rules {
+		s[i] = r.String()
+	}
+	return strings.Join(s, "; ")
+}
+
+func familyPrefix(v6 bool) string {
+	if v6 {
+		return "ipv6 "
+	}
+	return ""
+}
+
+func (r PolicyRule) String() string {
+	if r.NoDefault {
+		return fmt.Sprintf("table %d without default routes", r.Table)
+	}
+	return fmt.Sprintf("fwmark %#x table %d", r.Mark, r.Table)
+}
+
+// splitRules splits a rule list into the IPv4 and IPv6 chains by the
+// family of the sets: rules on IPv4 sets go to the first, rules on IPv6
+// sets to the second, and rules on MAC sets and catch-all rules to both.
+// Without v6 the IPv6 chain is empty.
+func splitRules(sets []Set, rules []MangleRule, v6 bool) (rules4, rules6 []MangleRule) {
+	specs := make(map[string]SetSpec, len(sets))
+	for _, s := range sets {
+		specs[s.Name] = s.SetSpec
+	}
+	for _, r := range rules {
+		spec := specs[r.Set]
+		if r.Set == "" || !spec.V6 {
+			rules4 = append(rules4, r)
+		}
+		if v6 && (r.Set == "" || spec.V6 || spec.MAC) {
+			rules6 = append(rules6, r)
+		}
+	}
+	return rules4, rules6
+}
+
+// computeDiff compares a snapshot with the desired state. Members of
+// dynamic sets are never compared.
+func computeDiff(cur, want *State) *Diff {
+	d := &Diff{}
+
+	for _, w := range want.Sets {
+		c, ok := cur.set(w.Name)
+		switch {
+		case !ok:
+			d.CreateSets = append(d.CreateSets, w.SetSpec)
+			if !w.Dynamic && len(w.Members) > 0 {
+				d.UpdateSets = append(d.UpdateSets, SetChange{Name: w.Name, Add: w.Members})
+			}
+		case c.SetSpec != w.SetSpec:
+			d.ReplaceSets = append(d.ReplaceSets, w)
+		case !w.Dynamic:
+			add, del := diffMembers(c.Members, w.Members)
+			if len(add) > 0 || len(del) > 0 {
+				d.UpdateSets = append(d.UpdateSets, SetChange{Name: w.Name, Add: add, Del: del})
+			}
+		}
+	}
+	for _, c := range cur.Sets {
+		if _, ok := want.set(c.Name); !ok {
+			d.DestroySets = append(d.DestroySets, c.Name)
+		}
+	}
+
+	// Recreating a set clears both chains
+	switch {
+	case len(want.Rules) == 0:
+		d.ClearRules = cur.Rules != nil
+	case len(d.ReplaceSets) > 0 || !slices.Equal(cur.Rules, want.Rules):
+		d.SetRules = true
+		d.Rules = want.Rules
+	}
+	switch {
+	case len(want.Rules6) == 0:
+		d.ClearRules6 = cur.Rules6 != nil
+	case len(d.ReplaceSets) > 0 || !slices.Equal(cur.Rules6, want.Rules6):
+		d.SetRules6 = true
+		d.Rules6 = want.Rules6
+	}
+
+	for _, t := range want.Tables {
+		for _, v6 := range []bool{false, true} {
+			w, wok := findRoute(want.Routes, t, v6)
+			c, cok := findRoute(cur.Routes, t, v6)
+			switch {
+			case wok && (!cok || c != w):
+				d.ReplaceRoutes = append(d.ReplaceRoutes, w)
+			case !wok && cok && v6:
+				d.FlushTables6 = append(d.FlushTables6, t)
+			case !wok && cok:
+				d.FlushTables = append(d.FlushTables, t)
+			}
+		}
+	}
+	for _, r := range want.PolicyRules {
+		if !slices.Contains(cur.PolicyRules, r) {
+			d.AddPolicyRules = append(d.AddPolicyRules, r)
+		}
+	}
+	for _, r := range cur.PolicyRules {
+		if !slices.Contains(want.PolicyRules, r) {
+			d.DelPolicyRules = append(d.DelPolicyRules, r)
+		}
+	}
+	return d
+}
+
+func findRoute(routes []Route, table int, v6 bool) (Route, bool) {
+	for _, r := range routes {
+		if r.Table == table && r.V6 == v6 {
+			return r, true
+		}
+	}
+	return Route{}, false
+}
+
+// diffMembers returns the members to add to cur and to delete from it to
+// get want.
+func diffMembers(cur, want []string) (add, del []string) {
+	have := make(map[string]bool, len(cur))
+	for _, m := range cur {
+		have[m] = true
+	}
+	need := make(map[string]bool, len(want))
+	for _, m := range want {
+		need[m] = true
+		if !have[m] {
+			add = append(add, m)
+		}
+	}
+	for _, m := range cur {
+		if !need[m] {
+			del = append(del, m)
+		}
+	}
+	sort.Strings(add)
+	sort.Strings(del)
+	return add, del
+}
+
+// Engine applies desired states through a FirewallBackend, changing only
+// what differs from the current state.
+type Engine struct {
+	fw FirewallBackend
+}
+
+func NewEngine(fw FirewallBackend) *Engine {
+	return &Engine{fw: fw}
+}
+
+func (e *Engine) Backend() FirewallBackend {
+	return e.fw
+}
+
+// Snapshot reads the current state. Members are read only for sets the
+// desired state manages.
+func (e *Engine) Snapshot(want *State) (*State, error) {
+	specs, err := e.fw.Sets()
+	if err != nil {
+		return nil, fmt.Errorf("list sets: %w", err)
+	}
+	cur := &State{Tables: want.Tables}
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		s := Set{SetSpec: specs[name]}
+		if w, ok := want.set(name); ok && !w.Dynamic && w.SetSpec == s.SetSpec {
+			if s.Members, err = e.fw.SetMembers(name); err != nil {
+				return nil, fmt.Errorf("read set %s: %w", name, err)
+			}
+		}
+		cur.Sets = append(cur.Sets, s)
+	}
+	if cur.Rules, err = e.fw.MangleRules(false); err != nil {
+		return nil, fmt.Errorf("read mangle chain: %w", err)
+	}
+	if e.fw.IPv6() {
+		if cur.Rules6, err = e.fw.MangleRules(true); err != nil {
+			return nil, fmt.Errorf("read ipv6 mangle chain: %w", err)
+		}
+	}
+	if cur.Routes, err = e.fw.Routes(want.Tables); err != nil {
+		return nil, fmt.Errorf("read routes: %w", err)
+	}
+	if cur.PolicyRules, err = e.fw.PolicyRules(want.Tables); err != nil {
+		return nil, fmt.Errorf("read policy rules: %w", err)
+	}
+	return cur, nil
+}
+
+// Plan returns the changes Apply would make.
+func (e *Engine) Plan(want *State) (*Diff, error) {
+	cur, err := e.Snapshot(want)
+	if err != nil {
+		return nil, err
+	}
+	return computeDiff(cur, want), nil
+}
+
+// Apply brings the kernel to the desired state. Sets are created and
+// loaded before the chain referencing them changes, and removed after.
+// On error the remaining changes are skipped; the next Apply picks them up.
+func (e *Engine) Apply(want *State) (*Diff, error) {
+	d, err := e.Plan(want)
+	if err != nil {
+		return nil, err
+	}
+	return d, e.apply(d)
+}
+
+func (e *Engine) apply(d *Diff) error {
+	// A set in use by a chain cannot be recreated
+	if len(d.ReplaceSets) > 0 {
+		if err := e.fw.ClearMangle(false); err != nil {
+			return fmt.Errorf("clear mangle chain: %w", err)
+		}
+		if e.fw.IPv6() {
+			if err := e.fw.ClearMangle(true); err != nil {
+				return fmt.Errorf("clear ipv6 mangle chain: %w", err)
+			}
+		}
+	}
+	for _, s := range d.CreateSets {
+		if err := e.fw.CreateSet(s); err != nil {
+			return fmt.Errorf("create set %s: %w", s.Name, err)
+		}
+	}
+	for _, s := range d.ReplaceSets {
+		if err := e.fw.ReplaceSet(s.SetSpec, s.Members); err != nil {
+			return fmt.Errorf("recreate set %s: %w", s.Name, err)
+		}
+	}
+	for _, c := range d.UpdateSets {
+		if err := e.fw.UpdateSet(c.Name, c.Add, c.Del); err != nil {
+			return fmt.Errorf("update set %s: %w", c.Name, err)
+		}
+	}
+
+	if d.SetRules {
+		if err := e.fw.SetMangleRules(false, d.Rules); err != nil {
+			return fmt.Errorf("set mangle chain: %w", err)
+		}
+	}
+	if d.ClearRules {
+		if err := e.fw.ClearMangle(false); err != nil {
+			return fmt.Errorf("clear mangle chain: %w", err)
+		}
+	}
+	if d.SetRules6 {
+		if err := e.fw.SetMangleRules(true, d.Rules6); err != nil {
+			return fmt.Errorf("set ipv6 mangle chain: %w", err)
+		}
+	}
+	if d.ClearRules6 {
+		if err := e.fw.ClearMangle(true); err != nil {
+			return fmt.Errorf("clear ipv6 mangle chain: %w", err)
+		}
+	}
+
+	for _, r := range d.ReplaceRoutes {
+		if err := e.fw.ReplaceRoute(r); err != nil {
+			return fmt.Errorf("%sroute table %d: %w", familyPrefix(r.V6), r.Table, err)
+		}
+	}
+	for _, r := range d.AddPolicyRules {
+		if err := e.fw.AddPolicyRule(r); err != nil {
+			return fmt.Errorf("%sadd rule %s: %w", familyPrefix(r.V6), r, err)
+		}
+	}
+	for _, r := range d.DelPolicyRules {
+		if err := e.fw.DelPolicyRule(r); err != nil {
+			return fmt.Errorf("%sdelete rule %s: %w", familyPrefix(r.V6), r, err)
+		}
+	}
+	for _, t := range d.FlushTables {
+		if err := e.fw.FlushTable(t, false); err != nil {
+			return fmt.Errorf("flush table %d: %w", t, err)
+		}
+	}
+	for _, t := range d.FlushTables6 {
+		if err := e.fw.FlushTable(t, true); err != nil {
+			return fmt.Errorf("ipv6 flush table %d: %w", t, err)
+		}
+	}
+
+	for _, name := range d.DestroySets {
+		if err := e.fw.DestroySet(name); err != nil {
+			return fmt.Errorf("destroy set %s: %w", name, err)
+		}
+	}
+	return nil
+}
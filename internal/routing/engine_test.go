@@ -0,0 +1,346 @@
+package routing
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testInputs(policy string, v6 bool) inputs {
+	in := inputs{
+		Policy:       policy,
+		Domestic:     []string{"5.0.0.0/8", "2a00::/16"},
+		StaticDirect: []string{"198.51.100.7", "2001:db8::/32"},
+		StaticTunnel: []string{"203.0.113.0/24"},
+		Devices:      deviceMembers{DirectMAC: []string{"aa:bb:cc:dd:ee:ff"}},
+		Overrides: []Override{
+			{Kind: OverrideCIDR, Target: "2001:db8:1::/48", Policy: DeviceDirect, Expires: time.Now().Add(time.Hour)},
+		},
+		Gateway: Route{Gateway: "192.0.2.1", Dev: "eth3"},
+		TunDev:  "tun0",
+	}
+	if v6 {
+		in.Gateway6 = Route{Gateway: "fe80::1", Dev: "eth3"}
+	}
+	return in
+}
+
+// mustConverge applies want and checks that planning it again finds
+// nothing to do.
+func mustConverge(t *testing.T, e *Engine, want *State) {
+	t.Helper()
+	if _, err := e.Apply(want); err != nil {
+		t.Fatalf("apply: %v", err)
+	}
+	d, err := e.Plan(want)
+	if err != nil {
+		t.Fatalf("plan: %v", err)
+	}
+	if !d.Empty() {
+		t.Fatalf("not converged:\n%s", strings.Join(d.Summary(), "\n"))
+	}
+}
+
+func TestApplyConverges(t *testing.T) {
+	for _, policy := range []string{PolicyTunnelDefault, PolicyDirectDefault} {
+		for _, v6 := range []bool{false, true} {
+			fw := NewFakeBackend()
+			e := NewEngine(fw)
+			want := desiredState(testInputs(policy, v6))
+			mustConverge(t, e, want)
+
+			if !slices.Equal(fw.Chain, want.Rules) || !slices.Equal(fw.Chain6, want.Rules6) {
+				t.Errorf("%s v6=%v: chains differ from the state", policy, v6)
+			}
+			if got := len(fw.Chain6) > 0; got != v6 {
+				t.Errorf("%s v6=%v: ipv6 chain present = %v", policy, v6, got)
+			}
+			// A second Apply changes nothing
+			fw.Calls = nil
+			mustConverge(t, e, want)
+			if len(fw.Calls) != 0 {
+				t.Errorf("%s v6=%v: idle apply made calls %v", policy, v6, fw.Calls)
+			}
+		}
+	}
+}
+
+func TestApplyUpdatesMembers(t *testing.T) {
+	fw := NewFakeBackend()
+	e := NewEngine(fw)
+	in := testInputs(PolicyTunnelDefault, true)
+	mustConverge(t, e, desiredState(in))
+
+	in.Domestic = []string{"5.0.0.0/8", "31.0.0.0/8"}
+	fw.Calls = nil
+	mustConverge(t, e, desiredState(in))
+	want := []string{"update tt_domestic +1 -0", "update tt_domestic6 +0 -1"}
+	if !slices.Equal(fw.Calls, want) {
+		t.Errorf("calls = %v, want %v", fw.Calls, want)
+	}
+}
+
+func TestReplaceSetResetsBothChains(t *testing.T) {
+	fw := NewFakeBackend()
+	e := NewEngine(fw)
+	want := desiredState(testInputs(PolicyTunnelDefault, true))
+	mustConverge(t, e, want)
+
+	// A changed spec recreates the set, which a chain must not reference
+	for i := range want.Sets {
+		if want.Sets[i].Name == setDomestic {
+			want.Sets[i].MaxElem *= 2
+		}
+	}
+	fw.Calls = nil
+	mustConverge(t, e, want)
+
+	clear4 := slices.Index(fw.Calls, "clear chain")
+	clear6 := slices.Index(fw.Calls, "ipv6 clear chain")
+	replace := slices.IndexFunc(fw.Calls, func(c string) bool { return strings.HasPrefix(c, "replace "+setDomestic+" ") })
+	set4 := slices.IndexFunc(fw.Calls, func(c string) bool { return strings.HasPrefix(c, "chain ") })
+	set6 := slices.IndexFunc(fw.Calls, func(c string) bool { return strings.HasPrefix(c, "ipv6 chain ") })
+	if clear4 < 0 || clear6 < 0 || replace < 0 || set4 < 0 || set6 < 0 {
+		t.Fatalf("missing calls: %v", fw.Calls)
+	}
+	if clear4 > replace || clear6 > replace || replace > set4 || replace > set6 {
+		t.Errorf("chains not cleared before the set is replaced and set after: %v", fw.Calls)
+	}
+	if got := len(fw.Members[setDomestic]); got != 1 {
+		t.Errorf("replaced set has %d members, want 1", got)
+	}
+}
+
+func TestStoppedStateRemovesEverything(t *testing.T) {
+	for _, policy := range []string{PolicyTunnelDefault, PolicyDirectDefault} {
+		fw := NewFakeBackend()
+		e := NewEngine(fw)
+		mustConverge(t, e, desiredState(testInputs(policy, true)))
+		mustConverge(t, e, stoppedState())
+
+		if len(fw.Specs) != 0 || fw.Chain != nil || fw.Chain6 != nil || len(fw.RouteList) != 0 || len(fw.Rules) != 0 {
+			t.Errorf("%s: left behind sets %d, chains %v %v, routes %v, rules %v",
+				policy, len(fw.Specs), fw.Chain, fw.Chain6, fw.RouteList, fw.Rules)
+		}
+	}
+}
+
+func TestDisablingIPv6RemovesIPv6State(t *testing.T) {
+	fw := NewFakeBackend()
+	e := NewEngine(fw)
+	mustConverge(t, e, desiredState(testInputs(PolicyDirectDefault, true)))
+	mustConverge(t, e, desiredState(testInputs(PolicyDirectDefault, false)))
+
+	if fw.Chain6 != nil {
+		t.Errorf("ipv6 chain left: %v", fw.Chain6)
+	}
+	for name, spec := range fw.Specs {
+		if spec.V6 {
+			t.Errorf("ipv6 set %s left", name)
+		}
+	}
+	for _, r := range fw.RouteList {
+		if r.V6 {
+			t.Errorf("ipv6 route left: %+v", r)
+		}
+	}
+	for _, r := range fw.Rules {
+		if r.V6 {
+			t.Errorf("ipv6 rule left: %s", r)
+		}
+	}
+}
+
+func TestSplitRules(t *testing.T) {
+	sets := []Set{
+		{SetSpec: SetSpec{Name: "v4", Net: true}},
+		{SetSpec: SetSpec{Name: "v6", Net: true, V6: true}},
+		{SetSpec: SetSpec{Name: "mac", MAC: true}},
+	}
+	rules := []MangleRule{
+		{Set: "v4"},
+		{Set: "v6", Mark: directMark},
+		{Set: "mac", Src: true, Mark: tunnelMark},
+		{Mark: directMark},
+	}
+	r4, r6 := splitRules(sets, rules, true)
+	if want := []MangleRule{rules[0], rules[2], rules[3]}; !slices.Equal(r4, want) {
+		t.Errorf("ipv4 chain = %v, want %v", r4, want)
+	}
+	if want := []MangleRule{rules[1], rules[2], rules[3]}; !slices.Equal(r6, want) {
+		t.Errorf("ipv6 chain = %v, want %v", r6, want)
+	}
+	if _, r6 := splitRules(sets, rules, false); r6 != nil {
+		t.Errorf("ipv6 chain without v6 = %v", r6)
+	}
+}
+
+func TestNormalizeCIDRs(t *testing.T) {
+	out, invalid := normalizeCIDRs([]string{
+		"10.1.2.3/8", "10.0.0.0/16", "192.0.2.1/32", "192.0.2.1",
+		"2001:db8::1/32", "2001:db8:1::/48", "::ffff:198.51.100.1", "bogus",
+	})
+	want := []string{"10.0.0.0/8", "192.0.2.1", "198.51.100.1", "2001:db8::/32"}
+	if !slices.Equal(out, want) {
+		t.Errorf("out = %v, want %v", out, want)
+	}
+	if !slices.Equal(invalid, []string{"bogus"}) {
+		t.Errorf("invalid = %v", invalid)
+	}
+}
+
+var chainRules = []MangleRule{
+	{Set: setLocal},
+	{Set: "tt_dev_direct_mac", Src: true, Mark: directMark},
+	{Set: setDomestic, Mark: directMark},
+	{Set: setTunnel, Mark: tunnelMark},
+	{Mark: directMark},
+}
+
+func TestParseIptablesChain(t *testing.T) {
+	// iptables -t mangle -S TT_SMART
+	out := `-N TT_SMART
+-A TT_SMART -m set --match-set tt_local dst -j RETURN
+-A TT_SMART -m set --match-set tt_dev_direct_mac src -j MARK --set-xmark 0x100/0xffffffff
+-A TT_SMART -m set --match-set tt_dev_direct_mac src -j CONNMARK --save-mark --nfmask 0xffffffff --ctmask 0xffffffff
+-A TT_SMART -m set --match-set tt_dev_direct_mac src -j RETURN
+-A TT_SMART -m set --match-set tt_domestic dst -j MARK --set-xmark 0x100/0xffffffff
+-A TT_SMART -m set --match-set tt_domestic dst -j CONNMARK --save-mark --nfmask 0xffffffff --ctmask 0xffffffff
+-A TT_SMART -m set --match-set tt_domestic dst -j RETURN
+-A TT_SMART -m set --match-set tt_tunnel dst -j MARK --set-xmark 0x200/0xffffffff
+-A TT_SMART -m set --match-set tt_tunnel dst -j CONNMARK --save-mark --nfmask 0xffffffff --ctmask 0xffffffff
+-A TT_SMART -m set --match-set tt_tunnel dst -j RETURN
+-A TT_SMART -j MARK --set-xmark 0x100/0xffffffff
+-A TT_SMART -j CONNMARK --save-mark --nfmask 0xffffffff --ctmask 0xffffffff
+-A TT_SMART -j RETURN`
+	if got := parseIptablesChain(out); !slices.Equal(got, chainRules) {
+		t.Errorf("parsed %v, want %v", got, chainRules)
+	}
+	if got := parseIptablesChain(iptablesRestore(chainRules)); !slices.Equal(got, chainRules) {
+		t.Errorf("round trip %v, want %v", got, chainRules)
+	}
+	if got := parseIptablesChain("-N TT_SMART\n"); got == nil || len(got) != 0 {
+		t.Errorf("empty chain = %#v, want empty", got)
+	}
+	// Foreign rules make the chain compare unequal
+	got := parseIptablesChain("-A TT_SMART -p tcp -j ACCEPT")
+	if len(got) != 1 || !strings.HasPrefix(got[0].Set, "?") {
+		t.Errorf("foreign rule = %v", got)
+	}
+}
+
+func TestParseNftChain(t *testing.T) {
+	// nft list chain inet trusttunnel tt_smart
+	out := `table inet trusttunnel {
+	chain tt_smart {
+		ip daddr @tt_local return
+		ether saddr @tt_dev_direct_mac meta mark set 0x00000100 ct mark set mark return
+		ip daddr @tt_domestic meta mark set 0x00000100 ct mark set mark return
+		ip daddr @tt_tunnel meta mark set 0x00000200 ct mark set mark return
+		meta mark set 0x00000100 ct mark set mark return
+	}
+}`
+	if got := parseNftChain(out); !slices.Equal(got, chainRules) {
+		t.Errorf("parsed %v, want %v", got, chainRules)
+	}
+
+	specs := map[string]SetSpec{"tt_dev_direct_mac": {MAC: true}}
+	var sb strings.Builder
+	for _, r := range chainRules {
+		sb.WriteString(nftRule(r, specs[r.Set]) + "\n")
+	}
+	if got := parseNftChain(sb.String()); !slices.Equal(got, chainRules) {
+		t.Errorf("round trip %v, want %v", got, chainRules)
+	}
+	if got := nftRule(MangleRule{Set: "tt_tunnel6"}, SetSpec{V6: true}); got != "ip6 daddr @tt_tunnel6 return" {
+		t.Errorf("ipv6 rule = %q", got)
+	}
+}
+
+func TestParseNftElements(t *testing.T) {
+	out := `table inet trusttunnel {
+	set tt_domestic {
+		type ipv4_addr
+		flags interval
+		elements = { 5.0.0.0/8, 31.0.0.0/8,
+			     192.0.2.1 }
+	}
+}`
+	want := []string{"5.0.0.0/8", "31.0.0.0/8", "192.0.2.1"}
+	if got := parseNftElements(out); !slices.Equal(got, want) {
+		t.Errorf("elements = %v, want %v", got, want)
+	}
+}
+
+func TestParsePolicyRule(t *testing.T) {
+	// ip rule show / ip -6 rule show
+	tests := []struct {
+		line string
+		want PolicyRule
+		ok   bool
+	}{
+		{"0:\tfrom all lookup local", PolicyRule{}, false},
+		{"99:\tfrom all lookup main suppress_prefixlength 0", PolicyRule{Table: mainTable, Priority: 99, NoDefault: true}, true},
+		{"100:\tfrom all fwmark 0x100 lookup 100", PolicyRule{Mark: 0x100, Table: 100, Priority: 100}, true},
+		{"101:\tfrom all fwmark 0x200/0xffffffff lookup 200", PolicyRule{Mark: 0x200, Table: 200, Priority: 101}, true},
+		{"32766:\tfrom all lookup main", PolicyRule{}, false},
+		{"", PolicyRule{}, false},
+	}
+	for _, tt := range tests {
+		got, ok := parsePolicyRule(tt.line)
+		if ok != tt.ok || ok && got != tt.want {
+			t.Errorf("parsePolicyRule(%q) = %+v, %v; want %+v, %v", tt.line, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseIpsetHeader(t *testing.T) {
+	// ipset list -t
+	tests := []struct {
+		out  string
+		want SetSpec
+	}{
+		{`Name: tt_domestic
+Type: hash:net
+Revision: 6
+Header: family inet hashsize 4096 maxelem 65536
+Size in memory: 120456
+References: 1
+Number of entries: 0`, SetSpec{Name: "s", Net: true, MaxElem: 65536}},
+		{`Name: tt_tunnel6
+Type: hash:ip
+Revision: 4
+Header: family inet6 hashsize 1024 maxelem 4096`, SetSpec{Name: "s", V6: true, MaxElem: 4096}},
+		{`Name: tt_ovr_direct_mac
+Type: hash:mac
+Revision: 0
+Header: hashsize 1024 maxelem 256 timeout 0`, SetSpec{Name: "s", MAC: true, MaxElem: 256, Timeout: true}},
+	}
+	for _, tt := range tests {
+		if got := parseIpsetHeader("s", tt.out); got != tt.want {
+			t.Errorf("parseIpsetHeader = %+v, want %+v", got, tt.want)
+		}
+	}
+}
+
+func TestParseNftRedirect(t *testing.T) {
+	// nft list chain ip trusttunnel dns_redirect
+	tests := []struct {
+		line  string
+		iface string
+		ok    bool
+	}{
+		{"\t\tiifname \"br0\" udp dport 53 redirect to :5354", "br0", true},
+		{"\t\tiifname \"br1\" udp dport domain redirect to :5354", "br1", true},
+		{"\t\tiifname \"br0\" tcp dport 53 redirect to :5354", "", false},
+		{"\t\tiifname \"br0\" udp dport 53 redirect to :5353", "", false},
+		{"\tchain dns_redirect {", "", false},
+	}
+	for _, tt := range tests {
+		iface, ok := parseNftRedirect(tt.line, "5354")
+		if ok != tt.ok || iface != tt.iface {
+			t.Errorf("parseNftRedirect(%q) = %q, %v; want %q, %v", tt.line, iface, ok, tt.iface, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+package routing
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FakeBackend is an in-memory FirewallBackend for tests. It records every
+// change in Calls.
+type FakeBackend struct {
+	Specs       map[string]SetSpec
+	Members     map[string]map[string]bool
+	Chain       []MangleRule
+	Chain6      []MangleRule
+	RouteList   []Route
+	Rules       []PolicyRule
+	Gateway     string
+	GatewayDev  string
+	Gateway6    string
+	GatewayDev6 string
+	NoIPv6      bool
+	Calls       []string
+}
+
+func NewFakeBackend() *FakeBackend {
+	return &FakeBackend{
+		Specs:       make(map[string]SetSpec),
+		Members:     make(map[string]map[string]bool),
+		Gateway:     "192.0.2.1",
+		GatewayDev:  "eth3",
+		Gateway6:    "fe80::1",
+		GatewayDev6: "eth3",
+	}
+}
+
+func (f *FakeBackend) record(format string, args ...any) {
+	f.Calls = append(f.Calls, fmt.Sprintf(format, args...))
+}
+
+func (f *FakeBackend) Name() string { return "fake" }
+
+func (f *FakeBackend) IPv6() bool { return !f.NoIPv6 }
+
+func (f *FakeBackend) Sets() (map[string]SetSpec, error) {
+	out := make(map[string]SetSpec, len(f.Specs))
+	for k, v := range f.Specs {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (f *FakeBackend) SetMembers(name string) ([]string, error) {
+	if _, ok := f.Specs[name]; !ok {
+		return nil, fmt.Errorf("set %s does not exist", name)
+	}
+	var out []string
+	for m := range f.Members[name] {
+		out = append(out, m)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+func (f *FakeBackend) CreateSet(spec SetSpec) error {
+	f.record("create %s", spec.Name)
+	if _, ok := f.Specs[spec.Name]; !ok {
+		f.Specs[spec.Name] = spec
+		f.Members[spec.Name] = make(map[string]bool)
+	}
+	return nil
+}
+
+func (f *FakeBackend) ReplaceSet(spec SetSpec, members []string) error {
+	f.record("replace %s %d", spec.Name, len(members))
+	if f.referenced(spec.Name) {
+		return fmt.Errorf("set %s is in use", spec.Name)
+	}
+	f.Specs[spec.Name] = spec
+	f.Members[spec.Name] = make(map[string]bool)
+	for _, m := range members {
+		f.Members[spec.Name][m] = true
+	}
+	return nil
+}
+
+func (f *FakeBackend) UpdateSet(name string, add, del []string) error {
+	f.record("update %s +%d -%d", name, len(add), len(del))
+	set, ok := f.Members[name]
+	if !ok {
+		return fmt.Errorf("set %s does not exist", name)
+	}
+	for _, m := range del {
+		delete(set, m)
+	}
+	for _, m := range add {
+		set[m] = true
+	}
+	return nil
+}
+
+// AddTimed adds the members; they do not expire.
+func (f *FakeBackend) AddTimed(name string, members []string, ttl time.Duration) error {
+	f.record("add %s +%d for %s", name, len(members), ttl)
+	if !f.Specs[name].Timeout {
+		return fmt.Errorf("set %s has no timeout support", name)
+	}
+	for _, m := range members {
+		f.Members[name][m] = true
+	}
+	return nil
+}
+
+func (f *FakeBackend) DestroySet(name string) error {
+	f.record("destroy %s", name)
+	if f.referenced(name) {
+		return fmt.Errorf("set %s is in use", name)
+	}
+	delete(f.Specs, name)
+	delete(f.Members, name)
+	return nil
+}
+
+func (f *FakeBackend) referenced(name string) bool {
+	uses := func(r MangleRule) bool { return r.Set == name }
+	return slices.ContainsFunc(f.Chain, uses) || slices.ContainsFunc(f.Chain6, uses)
+}
+
+func (f *FakeBackend) chain(v6 bool) *[]MangleRule {
+	if v6 {
+		return &f.Chain6
+	}
+	return &f.Chain
+}
+
+func (f *FakeBackend) MangleRules(v6 bool) ([]MangleRule, error) {
+	return slices.Clone(*f.chain(v6)), nil
+}
+
+func (f *FakeBackend) SetMangleRules(v6 bool, rules []MangleRule) error {
+	if v6 && f.NoIPv6 {
+		return fmt.Errorf("no ipv6 support")
+	}
+	names := make([]string, len(rules))
+	for i, r := range rules {
+		if _, ok := f.Specs[r.Set]; r.Set != "" && !ok {
+			return fmt.Errorf("set %s does not exist", r.Set)
+		}
+		names[i] = r.String()
+	}
+	f.record("%schain %s", familyPrefix(v6), strings.Join(names, "; "))
+	chain := f.chain(v6)
+	*chain = slices.Clone(rules)
+	if *chain == nil {
+		*chain = []MangleRule{}
+	}
+	return nil
+}
+
+func (f *FakeBackend) ClearMangle(v6 bool) error {
+	f.record("%sclear chain", familyPrefix(v6))
+	*f.chain(v6) = nil
+	return nil
+}
+
+func (f *FakeBackend) Routes(tables []int) ([]Route, error) {
+	var out []Route
+	for _, r := range f.RouteList {
+		if slices.Contains(tables, r.Table) {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func (f *FakeBackend) ReplaceRoute(r Route) error {
+	f.record("%sroute %d %s %s", familyPrefix(r.V6), r.Table, r.Gateway, r.Dev)
+	f.RouteList = slices.DeleteFunc(f.RouteList, func(x Route) bool { return x.Table == r.Table && x.V6 == r.V6 })
+	f.RouteList = append(f.RouteList, r)
+	return nil
+}
+
+func (f *FakeBackend) FlushTable(table int, v6 bool) error {
+	f.record("%sflush %d", familyPrefix(v6), table)
+	f.RouteList = slices.DeleteFunc(f.RouteList, func(x Route) bool { return x.Table == table && x.V6 == v6 })
+	return nil
+}
+
+func (f *FakeBackend) PolicyRules(tables []int) ([]PolicyRule, error) {
+	var out []PolicyRule
+	for _, r := range f.Rules {
+		if slices.Contains(tables, r.Table) || r.NoDefault {
+			out = append(out, r)
+		}
+	}
+	return out, nil
+}
+
+func (f *FakeBackend) AddPolicyRule(r PolicyRule) error {
+	f.record("%srule add %s", familyPrefix(r.V6), r)
+	f.Rules = append(f.Rules, r)
+	return nil
+}
+
+func (f *FakeBackend) DelPolicyRule(r PolicyRule) error {
+	f.record("%srule del %s", familyPrefix(r.V6), r)
+	f.Rules = slices.DeleteFunc(f.Rules, func(x PolicyRule) bool { return x == r })
+	return nil
+}
+
+func (f *FakeBackend) DefaultGateway(v6 bool) (string, string, error) {
+	gw, dev := f.Gateway, f.GatewayDev
+	if v6 {
+		gw, dev = f.Gateway6, f.GatewayDev6
+	}
+	if dev == "" {
+		return "", "", fmt.Errorf("no default route outside the tunnel")
+	}
+	return gw, dev, nil
+}
@@ -0,0 +1,276 @@
+package routing
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/netip"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+)
+
+// SetSpec describes an address set. Net sets hold CIDRs (ipset hash:net,
+// nft interval set), MAC sets hold hardware addresses (hash:mac, nft
+// ether_addr); the others hold single addresses (hash:ip). V6 sets hold
+// IPv6 addresses. Timeout sets accept members that the kernel removes after
+// a while (see AddTimed).
+type SetSpec struct {
+	Name    string
+	Net     bool
+	MAC     bool
+	V6      bool
+	Timeout bool
+	MaxElem int
+}
+
+// Set is a set in the desired state. Members are canonical (see
+// canonicalCIDR). Dynamic sets are filled by dnsmasq, so the engine creates
+// them but leaves their members alone.
+type Set struct {
+	SetSpec
+	Members []string
+	Dynamic bool
+}
+
+// MangleRule is one entry of the smart-routing chain, evaluated in order;
+// the first match wins. Packets whose destination (or source, with Src) is
+// in Set get Mark, or leave the chain unmarked when Mark is 0. An empty Set
+// matches every packet.
+type MangleRule struct {
+	Set  string
+	Src  bool
+	Mark uint32
+}
+
+func (r MangleRule) String() string {
+	dir := "dst"
+	if r.Src {
+		dir = "src"
+	}
+	set := r.Set
+	if set == "" {
+		set = "*"
+	}
+	if r.Mark == 0 {
+		return fmt.Sprintf("%s %s -> return", set, dir)
+	}
+	return fmt.Sprintf("%s %s -> mark %#x", set, dir, r.Mark)
+}
+
+// Route is the default route of a policy routing table, IPv6 with V6.
+type Route struct {
+	Table   int
+	Gateway string
+	Dev     string
+	V6      bool
+}
+
+// PolicyRule sends packets carrying Mark to Table. With NoDefault and no
+// Mark it looks up Table ignoring its default routes (suppress_prefixlength
+// 0), so more specific routes of the main table still apply to marked
+// packets.
+type PolicyRule struct {
+	Mark      uint32
+	Table     int
+	Priority  int
+	NoDefault bool
+	V6        bool
+}
+
+// FirewallBackend reads and changes the kernel state smart routing uses:
+// address sets, the mangle chains and fwmark policy routing. Only objects
+// owned by smart routing (tt_* sets, the TT_SMART chains, the tables in
+// State.Tables) are reported and changed. The mangle chain and routes
+// exist once per address family; v6 selects the IPv6 one.
+type FirewallBackend interface {
+	Name() string
+	// IPv6 reports whether the backend can set up the IPv6 chain.
+	IPv6() bool
+
+	// Sets returns the existing smart-routing sets.
+	Sets() (map[string]SetSpec, error)
+	// SetMembers returns the canonical members of a set.
+	SetMembers(name string) ([]string, error)
+	CreateSet(spec SetSpec) error
+	// ReplaceSet recreates a set with a new spec and members, atomically
+	// where the backend allows it.
+	ReplaceSet(spec SetSpec, members []string) error
+	UpdateSet(name string, add, del []string) error
+	// AddTimed adds members to a Timeout set that expire after ttl;
+	// members already in the set get the new ttl.
+	AddTimed(name string, members []string, ttl time.Duration) error
+	DestroySet(name string) error
+
+	// MangleRules returns the current smart-routing chain, or nil when it
+	// is not installed.
+	MangleRules(v6 bool) ([]MangleRule, error)
+	// SetMangleRules replaces the chain and hooks it into prerouting.
+	SetMangleRules(v6 bool, rules []MangleRule) error
+	// ClearMangle unhooks and removes the chain.
+	ClearMangle(v6 bool) error
+
+	// Routes returns the default routes of the tables, both families.
+	Routes(tables []int) ([]Route, error)
+	ReplaceRoute(r Route) error
+	FlushTable(table int, v6 bool) error
+	// PolicyRules returns the rules of both families for the tables.
+	PolicyRules(tables []int) ([]PolicyRule, error)
+	AddPolicyRule(r PolicyRule) error
+	DelPolicyRule(r PolicyRule) error
+	// DefaultGateway returns the current non-tunnel default route.
+	DefaultGateway(v6 bool) (gw, dev string, err error)
+}
+
+// NewFirewallBackend picks the backend like ndms-compat.sh: ipset with
+// iptables when both exist, nftables otherwise.
+func NewFirewallBackend() (FirewallBackend, error) {
+	if hasCommand("ipset") && hasCommand("iptables") {
+		return newIptablesBackend(), nil
+	}
+	if hasCommand("nft") {
+		return newNftBackend(), nil
+	}
+	return nil, fmt.Errorf("neither ipset/iptables nor nft is installed")
+}
+
+// firewallBackendName returns the backend NewFirewallBackend picks, or
+// would pick once the missing packages are installed: with iptables but
+// neither ipset nor nft, installing ipset makes it "iptables".
+func firewallBackendName() string {
+	switch {
+	case hasCommand("ipset") && hasCommand("iptables"):
+		return "iptables"
+	case hasCommand("nft"):
+		return "nftables"
+	case hasCommand("iptables"):
+		return "iptables"
+	}
+	return "unknown"
+}
+
+func hasCommand(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// run executes a command, feeding it stdin if given, and returns its
+// output; the error includes the output so callers can show it.
+func run(stdin string, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var out bytes.Buffer
+	cmd.Stdout = &out
+	cmd.Stderr = &out
+	err := cmd.Run()
+	text := strings.TrimSpace(out.String())
+	if err != nil {
+		if text != "" {
+			return text, fmt.Errorf("%s %s: %w: %s", name, firstArg(args), err, text)
+		}
+		return text, fmt.Errorf("%s %s: %w", name, firstArg(args), err)
+	}
+	return text, nil
+}
+
+func firstArg(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	return args[0]
+}
+
+// canonicalCIDR parses an address or CIDR and returns it with host bits
+// cleared; single addresses (/32, /128) are written without a prefix, as
+// ipset and nft list them.
+func canonicalCIDR(s string) (string, bool) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return "", false
+	}
+	if !strings.Contains(s, "/") {
+		addr, err := netip.ParseAddr(s)
+		if err != nil {
+			return "", false
+		}
+		return addr.Unmap().String(), true
+	}
+	p, err := netip.ParsePrefix(s)
+	if err != nil {
+		return "", false
+	}
+	p = p.Masked()
+	if p.Bits() == p.Addr().BitLen() {
+		return p.Addr().String(), true
+	}
+	return p.String(), true
+}
+
+// canonicalMAC parses an Ethernet address and returns it in lower case.
+func canonicalMAC(s string) (string, bool) {
+	hw, err := net.ParseMAC(strings.TrimSpace(s))
+	if err != nil || len(hw) != 6 {
+		return "", false
+	}
+	return hw.String(), true
+}
+
+// canonicalMember canonicalizes a set member read back from the kernel:
+// an address, a CIDR or a MAC.
+func canonicalMember(s string) (string, bool) {
+	if c, ok := canonicalCIDR(s); ok {
+		return c, true
+	}
+	return canonicalMAC(s)
+}
+
+// normalizeCIDRs canonicalizes, sorts and deduplicates a CIDR list and
+// drops networks contained in another entry, so the result can be loaded
+// into an interval set without overlaps. Invalid entries are returned
+// separately.
+func normalizeCIDRs(list []string) (out, invalid []string) {
+	var prefixes []netip.Prefix
+	seen := make(map[netip.Prefix]bool)
+	for _, s := range list {
+		c, ok := canonicalCIDR(s)
+		if !ok {
+			invalid = append(invalid, s)
+			continue
+		}
+		p, err := netip.ParsePrefix(c)
+		if err != nil {
+			a := netip.MustParseAddr(c)
+			p = netip.PrefixFrom(a, a.BitLen())
+		}
+		if !seen[p] {
+			seen[p] = true
+			prefixes = append(prefixes, p)
+		}
+	}
+
+	// Ordered by address with containing networks first, a network is
+	// covered exactly when the last kept one contains it
+	sort.Slice(prefixes, func(i, j int) bool {
+		if prefixes[i].Addr() != prefixes[j].Addr() {
+			return prefixes[i].Addr().Less(prefixes[j].Addr())
+		}
+		return prefixes[i].Bits() < prefixes[j].Bits()
+	})
+	var kept []netip.Prefix
+	for _, p := range prefixes {
+		if n := len(kept); n > 0 && kept[n-1].Bits() <= p.Bits() && kept[n-1].Contains(p.Addr()) {
+			continue
+		}
+		kept = append(kept, p)
+	}
+
+	out = make([]string, 0, len(kept))
+	for _, p := range kept {
+		c, _ := canonicalCIDR(p.String())
+		out = append(out, c)
+	}
+	return out, invalid
+}
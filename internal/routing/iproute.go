@@ -0,0 +1,199 @@
+package routing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// iproute implements the policy routing part of FirewallBackend with the
+// ip command; it is the same for both firewall backends.
+type iproute struct{}
+
+var noDefault struct {
+	sync.Mutex
+	ok, logged bool
+}
+
+// ipHasNoDefault reports whether ip supports suppress_prefixlength, which
+// the IPv6 NoDefault rule needs; the busybox ip does not, ip-full does.
+// Only a positive answer is cached, so installing ip-full takes effect on
+// the next apply.
+func ipHasNoDefault() bool {
+	noDefault.Lock()
+	defer noDefault.Unlock()
+	if noDefault.ok {
+		return true
+	}
+	// ip rule help exits non-zero but prints the usage
+	out, _ := run("", "ip", "rule", "help")
+	noDefault.ok = strings.Contains(out, "suppress_prefixlength")
+	if !noDefault.ok && !noDefault.logged {
+		logf("ip lacks suppress_prefixlength (install ip-full): IPv6 is not routed")
+		noDefault.logged = true
+	}
+	return noDefault.ok
+}
+
+// ipArgs prepends -6 for IPv6.
+func ipArgs(v6 bool, args ...string) []string {
+	if v6 {
+		return append([]string{"-6"}, args...)
+	}
+	return args
+}
+
+func (iproute) Routes(tables []int) ([]Route, error) {
+	var routes []Route
+	for _, t := range tables {
+		for _, v6 := range []bool{false, true} {
+			out, err := run("", "ip", ipArgs(v6, "route", "show", "table", strconv.Itoa(t))...)
+			if err != nil {
+				// A table without routes does not exist yet
+				continue
+			}
+			for _, line := range strings.Split(out, "\n") {
+				if r, ok := parseDefaultRoute(line); ok {
+					r.Table, r.V6 = t, v6
+					routes = append(routes, r)
+				}
+			}
+		}
+	}
+	return routes, nil
+}
+
+func (iproute) ReplaceRoute(r Route) error {
+	args := []string{"route", "replace", "default"}
+	if r.Gateway != "" {
+		args = append(args, "via", r.Gateway)
+	}
+	args = append(args, "dev", r.Dev, "table", strconv.Itoa(r.Table))
+	_, err := run("", "ip", ipArgs(r.V6, args...)...)
+	return err
+}
+
+func (iproute) FlushTable(table int, v6 bool) error {
+	_, err := run("", "ip", ipArgs(v6, "route", "flush", "table", strconv.Itoa(table))...)
+	return err
+}
+
+// PolicyRules returns the fwmark rules for the tables and the NoDefault
+// rules at noDefaultPriority, the only ones smart routing adds for other
+// tables.
+func (iproute) PolicyRules(tables []int) ([]PolicyRule, error) {
+	owned := make(map[int]bool, len(tables))
+	for _, t := range tables {
+		owned[t] = true
+	}
+	var rules []PolicyRule
+	for _, v6 := range []bool{false, true} {
+		out, err := run("", "ip", ipArgs(v6, "rule", "show")...)
+		if err != nil {
+			if v6 {
+				// No IPv6 support
+				break
+			}
+			return nil, err
+		}
+		for _, line := range strings.Split(out, "\n") {
+			r, ok := parsePolicyRule(line)
+			if ok && (owned[r.Table] && !r.NoDefault || r.NoDefault && r.Priority == noDefaultPriority) {
+				r.V6 = v6
+				rules = append(rules, r)
+			}
+		}
+	}
+	return rules, nil
+}
+
+func (iproute) AddPolicyRule(r PolicyRule) error {
+	_, err := run("", "ip", policyRuleArgs("add", r)...)
+	return err
+}
+
+func (iproute) DelPolicyRule(r PolicyRule) error {
+	_, err := run("", "ip", policyRuleArgs("del", r)...)
+	return err
+}
+
+func policyRuleArgs(op string, r PolicyRule) []string {
+	args := []string{"rule", op}
+	if r.NoDefault {
+		args = append(args, "table", strconv.Itoa(r.Table), "suppress_prefixlength", "0")
+	} else {
+		args = append(args, "fwmark", fmt.Sprintf("%#x", r.Mark), "table", strconv.Itoa(r.Table))
+	}
+	return ipArgs(r.V6, append(args, "priority", strconv.Itoa(r.Priority))...)
+}
+
+// DefaultGateway returns the first default route that does not go through
+// a tunnel interface, like sr_save_orig_gateway.
+func (iproute) DefaultGateway(v6 bool) (string, string, error) {
+	out, err := run("", "ip", ipArgs(v6, "route", "show", "default")...)
+	if err != nil {
+		return "", "", err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		r, ok := parseDefaultRoute(line)
+		if !ok || strings.Contains(r.Dev, "tun") {
+			continue
+		}
+		return r.Gateway, r.Dev, nil
+	}
+	return "", "", fmt.Errorf("no default route outside the tunnel")
+}
+
+// parseDefaultRoute parses "default via GW dev DEV ..." or, for
+// point-to-point links, "default dev DEV ...".
+func parseDefaultRoute(line string) (Route, bool) {
+	f := strings.Fields(line)
+	if len(f) == 0 || f[0] != "default" {
+		return Route{}, false
+	}
+	var r Route
+	for i := 1; i+1 < len(f); i++ {
+		switch f[i] {
+		case "via":
+			r.Gateway = f[i+1]
+		case "dev":
+			r.Dev = f[i+1]
+		}
+	}
+	return r, r.Dev != ""
+}
+
+// parsePolicyRule parses an "ip rule show" line such as
+// "100:	from all fwmark 0x100 lookup 100" or
+// "99:	from all lookup main suppress_prefixlength 0".
+func parsePolicyRule(line string) (PolicyRule, bool) {
+	f := strings.Fields(line)
+	if len(f) < 2 {
+		return PolicyRule{}, false
+	}
+	prio, err := strconv.Atoi(strings.TrimSuffix(f[0], ":"))
+	if err != nil {
+		return PolicyRule{}, false
+	}
+	r := PolicyRule{Priority: prio}
+	hasMark, hasTable := false, false
+	for i := 1; i+1 < len(f); i++ {
+		switch f[i] {
+		case "fwmark":
+			mark, _, _ := strings.Cut(f[i+1], "/")
+			if v, err := strconv.ParseUint(mark, 0, 32); err == nil {
+				r.Mark, hasMark = uint32(v), true
+			}
+		case "lookup", "table":
+			if f[i+1] == "main" {
+				r.Table, hasTable = mainTable, true
+			} else if v, err := strconv.Atoi(f[i+1]); err == nil {
+				r.Table, hasTable = v, true
+			}
+		case "suppress_prefixlength":
+			r.NoDefault = f[i+1] == "0"
+		}
+	}
+	return r, hasTable && (hasMark || r.NoDefault)
+}
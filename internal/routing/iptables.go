@@ -0,0 +1,319 @@
+package routing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	setPrefix    = "tt_"
+	smartChain   = "TT_SMART"
+	legacyDirect = "TT_DIRECT"
+	// restoreChunk limits the lines of one ipset restore call
+	restoreChunk = 5000
+)
+
+// iptablesBackend keeps addresses in ipsets and the smart-routing chains in
+// the mangle tables of iptables and ip6tables.
+type iptablesBackend struct {
+	iproute
+}
+
+func newIptablesBackend() *iptablesBackend {
+	return &iptablesBackend{}
+}
+
+func (b *iptablesBackend) Name() string { return "iptables" }
+
+func (b *iptablesBackend) IPv6() bool {
+	return hasCommand("ip6tables") && hasCommand("ip6tables-restore")
+}
+
+// iptablesCmd returns the iptables command of a family.
+func iptablesCmd(v6 bool) string {
+	if v6 {
+		return "ip6tables"
+	}
+	return "iptables"
+}
+
+func (b *iptablesBackend) Sets() (map[string]SetSpec, error) {
+	out, err := run("", "ipset", "list", "-n")
+	if err != nil {
+		return nil, err
+	}
+	sets := make(map[string]SetSpec)
+	for _, name := range strings.Fields(out) {
+		if !strings.HasPrefix(name, setPrefix) {
+			continue
+		}
+		hdr, err := run("", "ipset", "list", name, "-t")
+		if err != nil {
+			return nil, err
+		}
+		sets[name] = parseIpsetHeader(name, hdr)
+	}
+	return sets, nil
+}
+
+// parseIpsetHeader reads the spec from "ipset list -t" output:
+//
+//	Type: hash:net
+//	Header: family inet hashsize 16384 maxelem 65536
+func parseIpsetHeader(name, out string) SetSpec {
+	spec := SetSpec{Name: name}
+	for _, line := range strings.Split(out, "\n") {
+		key, val, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "Type":
+			spec.Net = strings.TrimSpace(val) == "hash:net"
+			spec.MAC = strings.TrimSpace(val) == "hash:mac"
+		case "Header":
+			f := strings.Fields(val)
+			for i := 0; i+1 < len(f); i++ {
+				switch f[i] {
+				case "family":
+					spec.V6 = f[i+1] == "inet6"
+				case "maxelem":
+					spec.MaxElem, _ = strconv.Atoi(f[i+1])
+				case "timeout":
+					spec.Timeout = true
+				}
+			}
+		}
+	}
+	return spec
+}
+
+func (b *iptablesBackend) SetMembers(name string) ([]string, error) {
+	out, err := run("", "ipset", "list", name)
+	if err != nil {
+		return nil, err
+	}
+	var members []string
+	inMembers := false
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "Members:") {
+			inMembers = true
+			continue
+		}
+		if !inMembers {
+			continue
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		if c, ok := canonicalMember(f[0]); ok {
+			members = append(members, c)
+		}
+	}
+	return members, nil
+}
+
+func ipsetCreateArgs(spec SetSpec) string {
+	typ := "hash:ip"
+	if spec.Net {
+		typ = "hash:net"
+	}
+	maxElem := spec.MaxElem
+	if maxElem <= 0 {
+		maxElem = 65536
+	}
+	// "timeout 0" allows per-member timeouts without a default one
+	timeout := ""
+	if spec.Timeout {
+		timeout = " timeout 0"
+	}
+	if spec.MAC {
+		return fmt.Sprintf("%s hash:mac hashsize 1024 maxelem %d%s", spec.Name, maxElem, timeout)
+	}
+	family := "inet"
+	if spec.V6 {
+		family = "inet6"
+	}
+	return fmt.Sprintf("%s %s family %s hashsize 16384 maxelem %d%s", spec.Name, typ, family, maxElem, timeout)
+}
+
+func (b *iptablesBackend) CreateSet(spec SetSpec) error {
+	_, err := run("", "ipset", append([]string{"create"}, strings.Fields(ipsetCreateArgs(spec)+" -exist")...)...)
+	return err
+}
+
+func (b *iptablesBackend) ReplaceSet(spec SetSpec, members []string) error {
+	run("", "ipset", "destroy", spec.Name)
+	if err := b.CreateSet(spec); err != nil {
+		return err
+	}
+	return b.UpdateSet(spec.Name, members, nil)
+}
+
+func (b *iptablesBackend) UpdateSet(name string, add, del []string) error {
+	var lines []string
+	for _, m := range del {
+		lines = append(lines, "del "+name+" "+m)
+	}
+	for _, m := range add {
+		lines = append(lines, "add "+name+" "+m)
+	}
+	for len(lines) > 0 {
+		n := min(len(lines), restoreChunk)
+		if _, err := run(strings.Join(lines[:n], "\n")+"\n", "ipset", "restore", "-!"); err != nil {
+			return err
+		}
+		lines = lines[n:]
+	}
+	return nil
+}
+
+func (b *iptablesBackend) AddTimed(name string, members []string, ttl time.Duration) error {
+	var sb strings.Builder
+	for _, m := range members {
+		fmt.Fprintf(&sb, "add %s %s timeout %d\n", name, m, max(int(ttl.Seconds()), 1))
+	}
+	if sb.Len() == 0 {
+		return nil
+	}
+	_, err := run(sb.String(), "ipset", "restore", "-exist")
+	return err
+}
+
+func (b *iptablesBackend) DestroySet(name string) error {
+	_, err := run("", "ipset", "destroy", name)
+	return err
+}
+
+func (b *iptablesBackend) MangleRules(v6 bool) ([]MangleRule, error) {
+	ipt := iptablesCmd(v6)
+	if _, err := run("", ipt, "-t", "mangle", "-C", "PREROUTING", "-j", smartChain); err != nil {
+		return nil, nil
+	}
+	out, err := run("", ipt, "-t", "mangle", "-S", smartChain)
+	if err != nil {
+		return nil, nil
+	}
+	return parseIptablesChain(out), nil
+}
+
+// parseIptablesChain turns "iptables -S" output back into rules. A marking
+// rule is rendered as MARK, CONNMARK --save-mark and RETURN lines with the
+// same match; lines that do not fit are kept as unknown rules so the chain
+// compares unequal and is rewritten.
+func parseIptablesChain(out string) []MangleRule {
+	rules := []MangleRule{}
+	var pending *MangleRule
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if len(f) < 2 || f[0] != "-A" {
+			continue
+		}
+		var r MangleRule
+		target, mark := "", uint32(0)
+		for i := 2; i < len(f); i++ {
+			switch f[i] {
+			case "--match-set":
+				if i+2 < len(f) {
+					r.Set, r.Src = f[i+1], f[i+2] == "src"
+				}
+			case "-j":
+				if i+1 < len(f) {
+					target = f[i+1]
+				}
+			case "--set-xmark", "--set-mark":
+				if i+1 < len(f) {
+					v, _, _ := strings.Cut(f[i+1], "/")
+					n, _ := strconv.ParseUint(v, 0, 32)
+					mark = uint32(n)
+				}
+			}
+		}
+		switch target {
+		case "MARK":
+			r.Mark = mark
+			pending = &r
+		case "CONNMARK":
+		case "RETURN":
+			if pending != nil && pending.Set == r.Set && pending.Src == r.Src {
+				r.Mark = pending.Mark
+			}
+			pending = nil
+			rules = append(rules, r)
+		default:
+			rules = append(rules, MangleRule{Set: "?" + line})
+		}
+	}
+	if pending != nil {
+		rules = append(rules, MangleRule{Set: "?unterminated"})
+	}
+	return rules
+}
+
+func iptablesMatch(r MangleRule) string {
+	if r.Set == "" {
+		return ""
+	}
+	dir := "dst"
+	if r.Src {
+		dir = "src"
+	}
+	return fmt.Sprintf(" -m set --match-set %s %s", r.Set, dir)
+}
+
+// iptablesRestore renders the chain as an iptables-restore script; its
+// -A lines are what "iptables -S" lists back.
+func iptablesRestore(rules []MangleRule) string {
+	var sb strings.Builder
+	sb.WriteString("*mangle\n:" + smartChain + " - [0:0]\n")
+	for _, r := range rules {
+		m := iptablesMatch(r)
+		if r.Mark != 0 {
+			fmt.Fprintf(&sb, "-A %s%s -j MARK --set-xmark %#x/0xffffffff\n", smartChain, m, r.Mark)
+			fmt.Fprintf(&sb, "-A %s%s -j CONNMARK --save-mark --nfmask 0xffffffff --ctmask 0xffffffff\n", smartChain, m)
+		}
+		fmt.Fprintf(&sb, "-A %s%s -j RETURN\n", smartChain, m)
+	}
+	sb.WriteString("COMMIT\n")
+	return sb.String()
+}
+
+func (b *iptablesBackend) SetMangleRules(v6 bool, rules []MangleRule) error {
+	ipt := iptablesCmd(v6)
+	// With --noflush only the declared chain is replaced, in one commit
+	if _, err := run(iptablesRestore(rules), ipt+"-restore", "--noflush"); err != nil {
+		return err
+	}
+	if _, err := run("", ipt, "-t", "mangle", "-C", "PREROUTING", "-j", smartChain); err != nil {
+		if _, err := run("", ipt, "-t", "mangle", "-A", "PREROUTING", "-j", smartChain); err != nil {
+			return err
+		}
+	}
+	// Chain of the former shell implementation
+	if !v6 {
+		run("", "iptables", "-t", "mangle", "-F", legacyDirect)
+		run("", "iptables", "-t", "mangle", "-X", legacyDirect)
+	}
+	return nil
+}
+
+func (b *iptablesBackend) ClearMangle(v6 bool) error {
+	ipt := iptablesCmd(v6)
+	for {
+		if _, err := run("", ipt, "-t", "mangle", "-D", "PREROUTING", "-j", smartChain); err != nil {
+			break
+		}
+	}
+	chains := []string{smartChain}
+	if !v6 {
+		chains = append(chains, legacyDirect)
+	}
+	for _, chain := range chains {
+		run("", ipt, "-t", "mangle", "-F", chain)
+		run("", ipt, "-t", "mangle", "-X", chain)
+	}
+	return nil
+}
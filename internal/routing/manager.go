@@ -7,13 +7,16 @@ import (
 	"os/exec"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
 	scriptPath   = "/opt/trusttunnel_client/smart-routing.sh"
 	domainsPath  = "/opt/trusttunnel_client/routing/domains.txt"
+	bypassPath   = "/opt/trusttunnel_client/routing/bypass_domains.txt"
 	netsFile     = "/opt/trusttunnel_client/routing/domestic_nets.txt"
+	netsFile6    = "/opt/trusttunnel_client/routing/domestic_nets6.txt"
 	netsUpdateTS = "/opt/trusttunnel_client/routing/nets_updated_ts"
 	dnsmasqPID   = "/opt/var/run/dnsmasq-sr.pid"
 )
@@ -21,20 +24,59 @@ const (
 type Stats struct {
 	DomesticEntries int    `json:"domestic_entries"`
 	TunnelEntries   int    `json:"tunnel_entries"`
+	BypassEntries   int    `json:"bypass_entries"`
 	DnsmasqRunning  bool   `json:"dnsmasq_running"`
 	NetsUpdated     string `json:"nets_updated"`
 	FWBackend       string `json:"fw_backend"`
 	NDMSMajor       int    `json:"ndms_major"`
+
+	// IPv6 reports whether IPv6 is routed; the *V6 counts are those of
+	// the IPv6 sets
+	IPv6              bool `json:"ipv6"`
+	DomesticEntriesV6 int  `json:"domestic_entries_v6"`
+	TunnelEntriesV6   int  `json:"tunnel_entries_v6"`
+	BypassEntriesV6   int  `json:"bypass_entries_v6"`
 }
 
-type Manager struct{}
+// Manager runs smart routing. The firewall backend is chosen on first use,
+// so packages installed after the manager started are picked up.
+type Manager struct {
+	mu sync.Mutex
+	fw FirewallBackend
+	// ovMu serializes changes to the override list
+	ovMu sync.Mutex
+}
 
 func NewManager() *Manager {
 	return &Manager{}
 }
 
+// NewManagerWithBackend returns a Manager using fw instead of the detected
+// backend.
+func NewManagerWithBackend(fw FirewallBackend) *Manager {
+	return &Manager{fw: fw}
+}
+
 func (m *Manager) GetDomains() (string, error) {
-	data, err := os.ReadFile(domainsPath)
+	return readList(domainsPath)
+}
+
+func (m *Manager) SaveDomains(content string) error {
+	return m.saveList(domainsPath, content)
+}
+
+// GetBypassDomains returns bypass_domains.txt, the domains routed around
+// the tunnel.
+func (m *Manager) GetBypassDomains() (string, error) {
+	return readList(bypassPath)
+}
+
+func (m *Manager) SaveBypassDomains(content string) error {
+	return m.saveList(bypassPath, content)
+}
+
+func readList(path string) (string, error) {
+	data, err := os.ReadFile(path)
 	if err != nil {
 		if os.IsNotExist(err) {
 			return "", nil
@@ -44,32 +86,48 @@ func (m *Manager) GetDomains() (string, error) {
 	return string(data), nil
 }
 
-func (m *Manager) SaveDomains(content string) error {
-	if err := os.MkdirAll("/opt/trusttunnel_client/routing", 0755); err != nil {
+func (m *Manager) saveList(path, content string) error {
+	if err := os.MkdirAll(routingDir, 0755); err != nil {
 		return fmt.Errorf("create routing dir: %w", err)
 	}
-	if err := os.WriteFile(domainsPath, []byte(content), 0644); err != nil {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
 		return err
 	}
 	return m.reloadDnsmasq()
 }
 
+// UpdateNets downloads the country CIDR list and, when smart routing is
+// enabled, loads the changes into tt_domestic.
 func (m *Manager) UpdateNets() error {
-	out, err := m.runScript("sr_update_nets && sr_reload_nets")
-	if err != nil {
-		return fmt.Errorf("update nets: %w: %s", err, out)
+	if err := downloadNets(loadConfig().HomeCountry); err != nil {
+		return fmt.Errorf("update nets: %w", err)
+	}
+	if err := m.Restore(); err != nil {
+		return fmt.Errorf("update nets: %w", err)
 	}
 	return nil
 }
 
 func (m *Manager) GetStats() *Stats {
 	s := &Stats{
-		DomesticEntries: m.ipsetCount("tt_domestic"),
-		TunnelEntries:   m.ipsetCount("tt_tunnel"),
+		DomesticEntries: m.setCount(setDomestic),
+		TunnelEntries:   m.setCount(setTunnel),
+		BypassEntries:   m.setCount(setBypass),
 		DnsmasqRunning:  m.isDnsmasqRunning(),
-		FWBackend:       detectFWBackend(),
+		FWBackend:       m.FWBackend(),
 		NDMSMajor:       detectNDMSMajor(),
 	}
+	if fw, err := m.backend(); err == nil {
+		if fw.IPv6() {
+			rules, _ := fw.MangleRules(true)
+			s.IPv6 = len(rules) > 0
+		}
+		if s.IPv6 {
+			s.DomesticEntriesV6 = m.setCount(setDomestic + "6")
+			s.TunnelEntriesV6 = m.setCount(setTunnel + "6")
+			s.BypassEntriesV6 = m.setCount(setBypass + "6")
+		}
+	}
 
 	if data, err := os.ReadFile(netsUpdateTS); err == nil {
 		ts := strings.TrimSpace(string(data))
@@ -82,20 +140,30 @@ func (m *Manager) GetStats() *Stats {
 	return s
 }
 
-func (m *Manager) Apply() error {
-	out, err := m.runScript("sr_start")
-	if err != nil {
-		return fmt.Errorf("apply smart routing: %w: %s", err, out)
+// FWBackend returns the firewall backend smart routing uses on this router,
+// "iptables" or "nftables", so the dependency check asks for the packages of
+// that backend; "unknown" without either.
+func (m *Manager) FWBackend() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fw != nil {
+		return m.fw.Name()
 	}
-	return nil
+	return firewallBackendName()
 }
 
+// Apply (re)starts smart routing with the current mode.conf settings.
+func (m *Manager) Apply() error {
+	return m.Start()
+}
+
+// reloadDnsmasq restarts the smart-routing dnsmasq if it is running, so it
+// picks up changed domain lists.
 func (m *Manager) reloadDnsmasq() error {
-	out, err := m.runScript("sr_reload_dnsmasq")
-	if err != nil {
-		return fmt.Errorf("reload dnsmasq: %w: %s", err, out)
+	if !m.isDnsmasqRunning() {
+		return nil
 	}
-	return nil
+	return m.StartDnsmasq()
 }
 
 func (m *Manager) runScript(fn string) (string, error) {
@@ -112,32 +180,16 @@ func (m *Manager) runScript(fn string) (string, error) {
 	return strings.TrimSpace(string(out)), err
 }
 
-func (m *Manager) ipsetCount(name string) int {
-	out, err := exec.Command("ipset", "list", name, "-t").CombinedOutput()
-	if err == nil {
-		for _, line := range strings.Split(string(out), "\n") {
-			if strings.HasPrefix(line, "Number of entries:") {
-				parts := strings.Fields(line)
-				if len(parts) >= 4 {
-					n, _ := strconv.Atoi(parts[3])
-					return n
-				}
-			}
-		}
+func (m *Manager) setCount(name string) int {
+	fw, err := m.backend()
+	if err != nil {
+		return 0
 	}
-
-	out, err = exec.Command("nft", "list", "set", "ip", "trusttunnel", name).CombinedOutput()
-	if err == nil {
-		count := 0
-		for _, line := range strings.Split(string(out), "\n") {
-			if strings.Contains(line, "/") || strings.Contains(line, ".") {
-				count++
-			}
-		}
-		return count
+	members, err := fw.SetMembers(name)
+	if err != nil {
+		return 0
 	}
-
-	return 0
+	return len(members)
 }
 
 func (m *Manager) isDnsmasqRunning() bool {
@@ -153,20 +205,6 @@ func (m *Manager) isDnsmasqRunning() bool {
 	return err == nil
 }
 
-func detectFWBackend() string {
-	out, err := exec.Command("iptables", "--version").CombinedOutput()
-	if err == nil {
-		if strings.Contains(string(out), "nf_tables") {
-			return "nftables"
-		}
-		return "iptables"
-	}
-	if _, err := exec.LookPath("nft"); err == nil {
-		return "nftables"
-	}
-	return "unknown"
-}
-
 func detectNDMSMajor() int {
 	data, err := os.ReadFile("/tmp/ndm/version")
 	if err != nil {
@@ -0,0 +1,111 @@
+package routing
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// netsURL is filled in with the family directory ("ipv4" or "ipv6") and
+// the country code.
+const netsURL = "https://raw.githubusercontent.com/herrbischoff/country-ip-blocks/master/%s/%s.cidr"
+
+// netsStale reports whether the country CIDR list is missing or older
+// than netsMaxAge.
+func netsStale() bool {
+	if _, err := os.Stat(netsFile); err != nil {
+		return true
+	}
+	ts, err := strconv.ParseInt(strings.TrimSpace(readFile(netsUpdateTS)), 10, 64)
+	if err != nil {
+		return false
+	}
+	return time.Since(time.Unix(ts, 0)) > netsMaxAge
+}
+
+// downloadNets fetches the IPv4 CIDR blocks of a country into netsFile and
+// the IPv6 ones into netsFile6. The IPv6 list is optional: on a failure it
+// is removed, so it never belongs to another country than the IPv4 one.
+func downloadNets(country string) error {
+	n, err := fetchNets(country, "ipv4", netsFile, 10)
+	if err != nil {
+		return err
+	}
+	os.WriteFile(netsUpdateTS, []byte(strconv.FormatInt(time.Now().Unix(), 10)+"\n"), 0644)
+	logf("Downloaded %d CIDRs for %s", n, country)
+	downloadNets6(country)
+	return nil
+}
+
+// nets6Missing reports whether the IPv6 country list is missing, as on
+// installs from before IPv6 routing or after a failed download.
+func nets6Missing() bool {
+	_, err := os.Stat(netsFile6)
+	return err != nil
+}
+
+// downloadNets6 fetches the IPv6 CIDR blocks of a country into netsFile6,
+// removing the list on a failure.
+func downloadNets6(country string) {
+	if n, err := fetchNets(country, "ipv6", netsFile6, 0); err != nil {
+		logf("WARNING: %v", err)
+		os.Remove(netsFile6)
+	} else {
+		logf("Downloaded %d IPv6 CIDRs for %s", n, country)
+	}
+}
+
+// fetchNets downloads the family list of a country into path and returns
+// the number of networks; a list of minEntries or fewer is rejected.
+func fetchNets(country, family, path string, minEntries int) (int, error) {
+	url := fmt.Sprintf(netsURL, family, strings.ToLower(country))
+	logf("Downloading CIDR list for %s from %s", country, url)
+
+	client := &http.Client{Timeout: 60 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return 0, fmt.Errorf("download %s CIDR list: %w", family, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("download %s CIDR list: HTTP %d", family, resp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 16<<20))
+	if err != nil {
+		return 0, fmt.Errorf("download %s CIDR list: %w", family, err)
+	}
+
+	nets, invalid := normalizeCIDRs(strings.Fields(string(data)))
+	if len(nets) <= minEntries {
+		return 0, fmt.Errorf("downloaded %s CIDR list too small (%d entries)", family, len(nets))
+	}
+	if len(invalid) > 0 {
+		logf("Skipped %d invalid CIDRs", len(invalid))
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(nets, "\n")+"\n"), 0644); err != nil {
+		return 0, err
+	}
+	return len(nets), os.Rename(tmp, path)
+}
+
+// readNets returns the normalized country CIDR lists of both families.
+// The IPv6 list may be missing.
+func readNets() ([]string, error) {
+	data, err := os.ReadFile(netsFile)
+	if err != nil {
+		return nil, fmt.Errorf("no domestic nets file at %s", netsFile)
+	}
+	nets, _ := normalizeCIDRs(strings.Fields(string(data) + "\n" + readFile(netsFile6)))
+	return nets, nil
+}
+
+func readFile(path string) string {
+	data, _ := os.ReadFile(path)
+	return string(data)
+}
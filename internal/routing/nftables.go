@@ -0,0 +1,359 @@
+package routing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	nftTable       = "inet trusttunnel"
+	nftSmartChain  = "tt_smart"
+	nftSmartChain6 = "tt_smart6"
+	nftHookChain   = "prerouting"
+	// nftLegacyTable held the IPv4-only sets and chains of earlier
+	// versions; the DNS guard chains of smart-routing.sh stay there
+	nftLegacyTable = "ip trusttunnel"
+	// nftChunk limits the elements of one add/delete statement
+	nftChunk = 1000
+)
+
+// nftBackend keeps sets and chains in the "inet trusttunnel" table and
+// applies every change as one nft transaction. Each family has its own
+// chain, jumped to from the prerouting hook by nfproto.
+type nftBackend struct {
+	iproute
+}
+
+func newNftBackend() *nftBackend {
+	return &nftBackend{}
+}
+
+func (b *nftBackend) Name() string { return "nftables" }
+
+func (b *nftBackend) IPv6() bool { return true }
+
+func (b *nftBackend) Sets() (map[string]SetSpec, error) {
+	sets := make(map[string]SetSpec)
+	out, err := run("", "nft", "-t", "list", "table", "inet", "trusttunnel")
+	if err != nil {
+		// No table yet
+		return sets, nil
+	}
+	var cur *SetSpec
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		switch {
+		case len(f) >= 2 && f[0] == "set":
+			cur = &SetSpec{Name: f[1]}
+		case cur == nil || len(f) == 0:
+		case f[0] == "}":
+			if strings.HasPrefix(cur.Name, setPrefix) {
+				sets[cur.Name] = *cur
+			}
+			cur = nil
+		case f[0] == "type" && len(f) > 1:
+			cur.MAC = f[1] == "ether_addr"
+			cur.V6 = f[1] == "ipv6_addr"
+		case f[0] == "flags":
+			cur.Net = strings.Contains(line, "interval")
+			cur.Timeout = strings.Contains(line, "timeout")
+		case f[0] == "size" && len(f) > 1:
+			cur.MaxElem, _ = strconv.Atoi(f[1])
+		}
+	}
+	return sets, nil
+}
+
+func (b *nftBackend) SetMembers(name string) ([]string, error) {
+	out, err := run("", "nft", "list", "set", "inet", "trusttunnel", name)
+	if err != nil {
+		return nil, err
+	}
+	return parseNftElements(out), nil
+}
+
+// parseNftElements extracts the members of "elements = { a, b,\n c }".
+func parseNftElements(out string) []string {
+	i := strings.Index(out, "elements = {")
+	if i < 0 {
+		return nil
+	}
+	body := out[i+len("elements = {"):]
+	if j := strings.Index(body, "}"); j >= 0 {
+		body = body[:j]
+	}
+	var members []string
+	for _, e := range strings.FieldsFunc(body, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\t'
+	}) {
+		if c, ok := canonicalMember(e); ok {
+			members = append(members, c)
+		}
+	}
+	return members
+}
+
+func nftSetDecl(spec SetSpec) string {
+	decl := "type ipv4_addr;"
+	switch {
+	case spec.MAC:
+		decl = "type ether_addr;"
+	case spec.V6:
+		decl = "type ipv6_addr;"
+	}
+	var flags []string
+	if spec.Net {
+		flags = append(flags, "interval")
+	}
+	if spec.Timeout {
+		flags = append(flags, "timeout")
+	}
+	if len(flags) > 0 {
+		decl += " flags " + strings.Join(flags, ", ") + ";"
+	}
+	if spec.MaxElem > 0 {
+		decl += fmt.Sprintf(" size %d;", spec.MaxElem)
+	}
+	return fmt.Sprintf("add set %s %s { %s }\n", nftTable, spec.Name, decl)
+}
+
+func nftElements(op, name string, members []string) string {
+	var sb strings.Builder
+	for len(members) > 0 {
+		n := min(len(members), nftChunk)
+		fmt.Fprintf(&sb, "%s element %s %s { %s }\n", op, nftTable, name, strings.Join(members[:n], ", "))
+		members = members[n:]
+	}
+	return sb.String()
+}
+
+func (b *nftBackend) CreateSet(spec SetSpec) error {
+	_, err := run("add table "+nftTable+"\n"+nftSetDecl(spec), "nft", "-f", "-")
+	return err
+}
+
+func (b *nftBackend) ReplaceSet(spec SetSpec, members []string) error {
+	script := "add table " + nftTable + "\n"
+	if _, err := run("", "nft", "list", "set", "inet", "trusttunnel", spec.Name); err == nil {
+		script += fmt.Sprintf("delete set %s %s\n", nftTable, spec.Name)
+	}
+	script += nftSetDecl(spec) + nftElements("add", spec.Name, members)
+	_, err := run(script, "nft", "-f", "-")
+	return err
+}
+
+func (b *nftBackend) UpdateSet(name string, add, del []string) error {
+	script := nftElements("delete", name, del) + nftElements("add", name, add)
+	if script == "" {
+		return nil
+	}
+	_, err := run(script, "nft", "-f", "-")
+	return err
+}
+
+// AddTimed deletes the members first, since adding an existing element
+// keeps its old timeout.
+func (b *nftBackend) AddTimed(name string, members []string, ttl time.Duration) error {
+	if len(members) == 0 {
+		return nil
+	}
+	timed := make([]string, len(members))
+	for i, m := range members {
+		timed[i] = fmt.Sprintf("%s timeout %ds", m, max(int(ttl.Seconds()), 1))
+	}
+	// "add" first makes the "delete" of a missing element succeed
+	script := nftElements("add", name, members) + nftElements("delete", name, members) +
+		nftElements("add", name, timed)
+	_, err := run(script, "nft", "-f", "-")
+	return err
+}
+
+func (b *nftBackend) DestroySet(name string) error {
+	_, err := run("", "nft", "delete", "set", "inet", "trusttunnel", name)
+	return err
+}
+
+// nftChain returns the smart-routing chain of a family.
+func nftChain(v6 bool) string {
+	if v6 {
+		return nftSmartChain6
+	}
+	return nftSmartChain
+}
+
+// hookedChains returns the family chains the prerouting hook jumps to.
+func hookedChains() map[string]bool {
+	hooked := make(map[string]bool)
+	out, err := run("", "nft", "list", "chain", "inet", "trusttunnel", nftHookChain)
+	if err != nil {
+		return hooked
+	}
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		if n := len(f); n >= 2 && f[n-2] == "jump" {
+			hooked[f[n-1]] = true
+		}
+	}
+	return hooked
+}
+
+// hookScript rebuilds the prerouting hook with jumps to the given family
+// chains, or deletes it when there are none.
+func hookScript(v4, v6 bool) string {
+	if !v4 && !v6 {
+		return fmt.Sprintf("delete chain %s %s\n", nftTable, nftHookChain)
+	}
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "add chain %s %s { type filter hook prerouting priority -150; policy accept; }\n", nftTable, nftHookChain)
+	fmt.Fprintf(&sb, "flush chain %s %s\n", nftTable, nftHookChain)
+	if v4 {
+		fmt.Fprintf(&sb, "add rule %s %s meta nfproto ipv4 jump %s\n", nftTable, nftHookChain, nftSmartChain)
+	}
+	if v6 {
+		fmt.Fprintf(&sb, "add rule %s %s meta nfproto ipv6 jump %s\n", nftTable, nftHookChain, nftSmartChain6)
+	}
+	return sb.String()
+}
+
+func (b *nftBackend) MangleRules(v6 bool) ([]MangleRule, error) {
+	chain := nftChain(v6)
+	if !hookedChains()[chain] {
+		return nil, nil
+	}
+	out, err := run("", "nft", "list", "chain", "inet", "trusttunnel", chain)
+	if err != nil {
+		return nil, nil
+	}
+	return parseNftChain(out), nil
+}
+
+// parseNftChain turns the rules of "nft list chain" back into MangleRules;
+// see nftRule for the format.
+func parseNftChain(out string) []MangleRule {
+	rules := []MangleRule{}
+	for _, line := range strings.Split(out, "\n") {
+		line = strings.TrimSpace(line)
+		f := strings.Fields(line)
+		if len(f) == 0 || f[0] == "table" || f[0] == "chain" || f[0] == "}" || f[0] == "type" {
+			continue
+		}
+		if f[len(f)-1] != "return" {
+			rules = append(rules, MangleRule{Set: "?" + line})
+			continue
+		}
+		var r MangleRule
+		for i := 0; i+1 < len(f); i++ {
+			switch {
+			case f[i] == "saddr" || f[i] == "daddr":
+				r.Src = f[i] == "saddr"
+				r.Set = strings.TrimPrefix(f[i+1], "@")
+			case f[i] == "mark" && f[i+1] == "set" && i+2 < len(f) && r.Mark == 0:
+				n, _ := strconv.ParseUint(f[i+2], 0, 32)
+				r.Mark = uint32(n)
+			}
+		}
+		rules = append(rules, r)
+	}
+	return rules
+}
+
+// nftRule renders a rule as "ip daddr @set [meta mark set M ct mark set
+// meta mark] return"; IPv6 sets are matched with "ip6 daddr @set" and MAC
+// sets with "ether saddr @set".
+func nftRule(r MangleRule, spec SetSpec) string {
+	var parts []string
+	if r.Set != "" {
+		dir := "daddr"
+		if r.Src {
+			dir = "saddr"
+		}
+		family := "ip"
+		switch {
+		case spec.MAC:
+			family = "ether"
+		case spec.V6:
+			family = "ip6"
+		}
+		parts = append(parts, family, dir, "@"+r.Set)
+	}
+	if r.Mark != 0 {
+		parts = append(parts, "meta mark set", fmt.Sprintf("%#x", r.Mark), "ct mark set meta mark")
+	}
+	return strings.Join(append(parts, "return"), " ")
+}
+
+func (b *nftBackend) SetMangleRules(v6 bool, rules []MangleRule) error {
+	sets, err := b.Sets()
+	if err != nil {
+		return err
+	}
+	chain := nftChain(v6)
+	hooked := hookedChains()
+	hooked[chain] = true
+
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "add table %s\n", nftTable)
+	fmt.Fprintf(&sb, "add chain %s %s\n", nftTable, chain)
+	fmt.Fprintf(&sb, "flush chain %s %s\n", nftTable, chain)
+	for _, r := range rules {
+		fmt.Fprintf(&sb, "add rule %s %s %s\n", nftTable, chain, nftRule(r, sets[r.Set]))
+	}
+	sb.WriteString(hookScript(hooked[nftSmartChain], hooked[nftSmartChain6]))
+	if _, err := run(sb.String(), "nft", "-f", "-"); err != nil {
+		return err
+	}
+	clearLegacyNft()
+	return nil
+}
+
+func (b *nftBackend) ClearMangle(v6 bool) error {
+	chain := nftChain(v6)
+	hooked := hookedChains()
+	if _, err := run("", "nft", "list", "table", "inet", "trusttunnel"); err == nil {
+		delete(hooked, chain)
+		run(hookScript(hooked[nftSmartChain], hooked[nftSmartChain6]), "nft", "-f", "-")
+		run("", "nft", "delete", "chain", "inet", "trusttunnel", chain)
+	}
+	if !v6 {
+		clearLegacyNft()
+	}
+	return nil
+}
+
+// clearLegacyNft removes the smart-routing chains and sets earlier
+// versions kept in the "ip trusttunnel" table.
+func clearLegacyNft() {
+	out, err := run("", "nft", "-t", "list", "table", "ip", "trusttunnel")
+	if err != nil {
+		return
+	}
+	chains := make(map[string]bool)
+	var sets []string
+	for _, line := range strings.Split(out, "\n") {
+		f := strings.Fields(line)
+		switch {
+		case len(f) >= 2 && f[0] == "chain":
+			chains[f[1]] = true
+		case len(f) >= 2 && f[0] == "set" && strings.HasPrefix(f[1], setPrefix):
+			sets = append(sets, f[1])
+		}
+	}
+	// The hook first, then the chain it jumps to, then the sets
+	var sb strings.Builder
+	for _, chain := range []string{nftHookChain, nftSmartChain} {
+		if chains[chain] {
+			fmt.Fprintf(&sb, "delete chain %s %s\n", nftLegacyTable, chain)
+		}
+	}
+	for _, name := range sets {
+		fmt.Fprintf(&sb, "delete set %s %s\n", nftLegacyTable, name)
+	}
+	if sb.Len() == 0 {
+		return
+	}
+	if _, err := run(sb.String(), "nft", "-f", "-"); err == nil {
+		logf("Removed smart-routing objects of the %s table", nftLegacyTable)
+	}
+}
@@ -0,0 +1,105 @@
+package routing
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"os"
+	"slices"
+)
+
+// overlayPath holds temporary changes on top of mode.conf and the stored
+// lists. It lives in /tmp so it is gone after a reboot, and in a file so
+// the -routing commands run by NDM hooks see it too.
+const overlayPath = "/tmp/trusttunnel_routing_overlay.json"
+
+// Overlay temporarily replaces the routing policy and device policies,
+// e.g. while a schedule rule is active.
+type Overlay struct {
+	Policy  string            `json:"policy,omitempty"`
+	Devices map[string]string `json:"devices,omitempty"`
+}
+
+// overlayFile is the on-disk form: one overlay per owner ("schedule", ...),
+// merged in name order.
+type overlayFile map[string]Overlay
+
+func readOverlays() overlayFile {
+	f := overlayFile{}
+	data, err := os.ReadFile(overlayPath)
+	if err != nil {
+		return f
+	}
+	if err := json.Unmarshal(data, &f); err != nil {
+		logf("WARNING: %s: %v", overlayPath, err)
+	}
+	return f
+}
+
+// effectiveOverlay merges all overlays.
+func effectiveOverlay() Overlay {
+	f := readOverlays()
+	owners := make([]string, 0, len(f))
+	for owner := range f {
+		owners = append(owners, owner)
+	}
+	slices.Sort(owners)
+	out := Overlay{Devices: map[string]string{}}
+	for _, owner := range owners {
+		o := f[owner]
+		if o.Policy != "" {
+			out.Policy = o.Policy
+		}
+		maps.Copy(out.Devices, o.Devices)
+	}
+	return out
+}
+
+// SetOverlay replaces the overlay of owner and re-applies smart routing if
+// the effective overlay changed. A policy change restarts smart routing,
+// since the direct_default policy does not keep the country list loaded.
+func (m *Manager) SetOverlay(owner string, o Overlay) error {
+	if o.Policy != "" && !ValidPolicy(o.Policy) {
+		return fmt.Errorf("invalid policy %q", o.Policy)
+	}
+	devices := make(map[string]string, len(o.Devices))
+	for key, policy := range o.Devices {
+		k, ok := DeviceKey(key)
+		if !ok {
+			return fmt.Errorf("invalid device %q", key)
+		}
+		switch policy {
+		case DeviceTunnel, DeviceDirect, DeviceSmart:
+		default:
+			return fmt.Errorf("%s: policy must be tunnel, direct or smart", k)
+		}
+		devices[k] = policy
+	}
+	o.Devices = devices
+
+	before := effectiveOverlay()
+	f := readOverlays()
+	if o.Policy == "" && len(o.Devices) == 0 {
+		delete(f, owner)
+	} else {
+		f[owner] = o
+	}
+	data, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(overlayPath, data, 0644); err != nil {
+		return err
+	}
+
+	after := effectiveOverlay()
+	switch {
+	case !loadConfig().Enabled:
+		return nil
+	case before.Policy != after.Policy:
+		return m.Start()
+	case !maps.Equal(before.Devices, after.Devices):
+		return m.Restore()
+	}
+	return nil
+}
@@ -0,0 +1,372 @@
+package routing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// overridesPath lists the temporary overrides. Like the overlay it lives in
+// /tmp, so a reboot clears the overrides along with the kernel sets.
+const overridesPath = "/tmp/trusttunnel_routing_overrides.json"
+
+// MaxOverrideTTL is the longest override allowed.
+const MaxOverrideTTL = 7 * 24 * time.Hour
+
+const overrideCheckInterval = 15 * time.Second
+
+// ErrOverrideNotFound is returned by RemoveOverride for an unknown or
+// expired override.
+var ErrOverrideNotFound = errors.New("override not found")
+
+// Override kinds.
+const (
+	// OverrideDevice routes all traffic of a LAN host (MAC or IPv4)
+	OverrideDevice = "device"
+	// OverrideCIDR routes traffic to a network; IPv6 networks apply only
+	// while IPv6 is routed
+	OverrideCIDR = "cidr"
+	// OverrideDomain routes traffic to the addresses a domain resolves to
+	OverrideDomain = "domain"
+	// OverrideTunnel routes all traffic
+	OverrideTunnel = "tunnel"
+)
+
+// Override temporarily sends traffic through the tunnel or directly
+// (Policy is DeviceTunnel or DeviceDirect), ahead of every list, device
+// policy and the routing policy. Device and CIDR overrides are set members
+// with a kernel timeout; domain and whole-tunnel overrides are removed by
+// the manager (RunOverrides).
+type Override struct {
+	ID      string    `json:"id"`
+	Kind    string    `json:"kind"`
+	Target  string    `json:"target,omitempty"`
+	Policy  string    `json:"policy"`
+	Expires time.Time `json:"expires"`
+	// Remaining is the time left in seconds, filled in by GetOverrides
+	Remaining int `json:"remaining"`
+}
+
+// kernelTimed reports whether the kernel expires the override.
+func (o Override) kernelTimed() bool {
+	return o.Kind == OverrideDevice || o.Kind == OverrideCIDR
+}
+
+// set returns the set holding the override, or "" for the whole tunnel.
+func (o Override) set() string {
+	switch o.Kind {
+	case OverrideDevice:
+		if _, isMAC := canonicalMAC(o.Target); isMAC {
+			return "tt_ovr_" + o.Policy + "_mac"
+		}
+		return "tt_ovr_" + o.Policy + "_src"
+	case OverrideCIDR:
+		if strings.Contains(o.Target, ":") {
+			return "tt_ovr_" + o.Policy + "_dst6"
+		}
+		return "tt_ovr_" + o.Policy + "_dst"
+	case OverrideDomain:
+		return "tt_ovr_" + o.Policy + "_dns"
+	}
+	return ""
+}
+
+// overrideSetSpecs are the override sets with the direction they are
+// matched in, direct before tunnel. The destination sets have IPv6 twins.
+var overrideSetSpecs = []struct {
+	SetSpec
+	Src    bool
+	Policy string
+}{
+	{SetSpec{Name: "tt_ovr_direct_mac", MAC: true, Timeout: true, MaxElem: devMaxElem}, true, DeviceDirect},
+	{SetSpec{Name: "tt_ovr_direct_src", Timeout: true, MaxElem: devMaxElem}, true, DeviceDirect},
+	{SetSpec{Name: "tt_ovr_tunnel_mac", MAC: true, Timeout: true, MaxElem: devMaxElem}, true, DeviceTunnel},
+	{SetSpec{Name: "tt_ovr_tunnel_src", Timeout: true, MaxElem: devMaxElem}, true, DeviceTunnel},
+	{SetSpec{Name: "tt_ovr_direct_dst", Net: true, Timeout: true, MaxElem: staticMaxElem}, false, DeviceDirect},
+	{SetSpec{Name: "tt_ovr_tunnel_dst", Net: true, Timeout: true, MaxElem: staticMaxElem}, false, DeviceTunnel},
+	{SetSpec{Name: "tt_ovr_direct_dns", MaxElem: 4096}, false, DeviceDirect},
+	{SetSpec{Name: "tt_ovr_tunnel_dns", MaxElem: 4096}, false, DeviceTunnel},
+}
+
+// overrideSets returns the override sets and their rules, which go right
+// after the local networks. The sets are dynamic: the engine creates them
+// and loadOverrides fills them. tunnel is the rule for tunnelled traffic
+// under the current routing policy.
+func overrideSets(overrides []Override, tunnel uint32, v6 bool) ([]Set, []MangleRule) {
+	mark := func(policy string) uint32 {
+		if policy == DeviceDirect {
+			return directMark
+		}
+		return tunnel
+	}
+	var rules []MangleRule
+	for _, o := range overrides {
+		if o.Kind == OverrideTunnel {
+			rules = append(rules, MangleRule{Mark: mark(o.Policy)})
+		}
+	}
+	var sets []Set
+	for _, s := range overrideSetSpecs {
+		if s.Src {
+			sets = append(sets, Set{SetSpec: s.SetSpec, Dynamic: true})
+			rules = append(rules, MangleRule{Set: s.Name, Src: true, Mark: mark(s.Policy)})
+			continue
+		}
+		sets = append(sets, familySets(s.SetSpec, nil, true, v6)...)
+		rules = append(rules, familyRules(MangleRule{Set: s.Name, Mark: mark(s.Policy)}, v6)...)
+	}
+	return sets, rules
+}
+
+// readOverrides returns the overrides that have not expired at now.
+func readOverrides(now time.Time) []Override {
+	var all []Override
+	data, err := os.ReadFile(overridesPath)
+	if err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, &all); err != nil {
+		logf("WARNING: %s: %v", overridesPath, err)
+		return nil
+	}
+	return slices.DeleteFunc(all, func(o Override) bool { return !o.Expires.After(now) })
+}
+
+func writeOverrides(overrides []Override) error {
+	data, err := json.Marshal(overrides)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(overridesPath, data, 0644)
+}
+
+// overrideDomains returns the domains of the active domain overrides for
+// a policy.
+func overrideDomains(policy string) []string {
+	var out []string
+	for _, o := range readOverrides(time.Now()) {
+		if o.Kind == OverrideDomain && o.Policy == policy {
+			out = append(out, o.Target)
+		}
+	}
+	return out
+}
+
+// GetOverrides returns the active overrides with their remaining time.
+func (m *Manager) GetOverrides() []Override {
+	now := time.Now()
+	out := readOverrides(now)
+	if out == nil {
+		out = []Override{}
+	}
+	for i := range out {
+		out[i].Remaining = int(out[i].Expires.Sub(now).Seconds())
+	}
+	return out
+}
+
+// AddOverride validates o and applies it for ttl, replacing an override of
+// the same target. Smart routing must be enabled.
+func (m *Manager) AddOverride(o Override, ttl time.Duration) (*Override, error) {
+	if err := cleanOverride(&o); err != nil {
+		return nil, err
+	}
+	if ttl <= 0 || ttl > MaxOverrideTTL {
+		return nil, fmt.Errorf("ttl must be between 1 second and %s", MaxOverrideTTL)
+	}
+	if !loadConfig().Enabled {
+		return nil, fmt.Errorf("smart routing is not enabled")
+	}
+	fw, err := m.backend()
+	if err != nil {
+		return nil, err
+	}
+
+	m.ovMu.Lock()
+	defer m.ovMu.Unlock()
+	now := time.Now()
+	o.ID = strconv.FormatInt(now.UnixNano(), 36)
+	o.Expires = now.Add(ttl).Truncate(time.Second)
+	overrides := readOverrides(now)
+	var replaced []Override
+	overrides = slices.DeleteFunc(overrides, func(x Override) bool {
+		if x.Kind == o.Kind && x.Target == o.Target {
+			replaced = append(replaced, x)
+			return true
+		}
+		return false
+	})
+	overrides = append(overrides, o)
+	if err := writeOverrides(overrides); err != nil {
+		return nil, err
+	}
+	m.unloadOverrides(fw, replaced)
+	if err := m.applyOverrides(append(replaced, o)); err != nil {
+		return &o, err
+	}
+	logf("Override %s %s -> %s for %s", o.Kind, o.Target, o.Policy, ttl)
+	o.Remaining = int(o.Expires.Sub(now).Seconds())
+	return &o, nil
+}
+
+// RemoveOverride cancels an override before it expires.
+func (m *Manager) RemoveOverride(id string) error {
+	m.ovMu.Lock()
+	defer m.ovMu.Unlock()
+	overrides := readOverrides(time.Now())
+	i := slices.IndexFunc(overrides, func(o Override) bool { return o.ID == id })
+	if i < 0 {
+		return ErrOverrideNotFound
+	}
+	o := overrides[i]
+	if err := writeOverrides(slices.Delete(overrides, i, i+1)); err != nil {
+		return err
+	}
+	if fw, err := m.backend(); err == nil {
+		m.unloadOverrides(fw, []Override{o})
+	}
+	logf("Override %s %s removed", o.Kind, o.Target)
+	return m.applyOverrides([]Override{o})
+}
+
+// RunOverrides removes expired overrides until ctx is done. Device and CIDR
+// overrides are expired by the kernel; this drops them from the list and
+// undoes domain and whole-tunnel overrides.
+func (m *Manager) RunOverrides(ctx context.Context) {
+	ticker := time.NewTicker(overrideCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.expireOverrides()
+		}
+	}
+}
+
+func (m *Manager) expireOverrides() {
+	m.ovMu.Lock()
+	defer m.ovMu.Unlock()
+	data, err := os.ReadFile(overridesPath)
+	if err != nil {
+		return
+	}
+	var all []Override
+	if json.Unmarshal(data, &all) != nil {
+		return
+	}
+	active := readOverrides(time.Now())
+	if len(active) == len(all) {
+		return
+	}
+	var expired []Override
+	for _, o := range all {
+		if !slices.ContainsFunc(active, func(x Override) bool { return x.ID == o.ID }) {
+			expired = append(expired, o)
+			logf("Override %s %s expired", o.Kind, o.Target)
+		}
+	}
+	if err := writeOverrides(active); err != nil {
+		logf("WARNING: %v", err)
+		return
+	}
+	if fw, err := m.backend(); err == nil {
+		m.unloadOverrides(fw, expired)
+	}
+	if err := m.applyOverrides(expired); err != nil {
+		logf("WARNING: %v", err)
+	}
+}
+
+// applyOverrides brings the kernel and dnsmasq in line with the override
+// list after the given overrides were added or removed.
+func (m *Manager) applyOverrides(changed []Override) error {
+	if !loadConfig().Enabled {
+		return nil
+	}
+	if err := m.Restore(); err != nil {
+		return err
+	}
+	if slices.ContainsFunc(changed, func(o Override) bool { return o.Kind == OverrideDomain }) {
+		return m.reloadDnsmasq()
+	}
+	return nil
+}
+
+// loadOverrides puts the kernel-timed overrides into their sets with the
+// time they have left; applyState calls it, so overrides survive sets being
+// recreated. IPv6 networks are skipped unless v6 is set.
+func loadOverrides(fw FirewallBackend, overrides []Override, v6 bool) error {
+	now := time.Now()
+	for _, o := range overrides {
+		if !o.kernelTimed() || !v6 && strings.Contains(o.Target, ":") {
+			continue
+		}
+		if err := fw.AddTimed(o.set(), []string{o.Target}, o.Expires.Sub(now)); err != nil {
+			return fmt.Errorf("override %s: %w", o.Target, err)
+		}
+	}
+	return nil
+}
+
+// unloadOverrides takes overrides out of their sets. A domain override
+// empties its sets of both families: the addresses of the remaining
+// domains are added back as they are resolved again.
+func (m *Manager) unloadOverrides(fw FirewallBackend, overrides []Override) {
+	for _, o := range overrides {
+		name := o.set()
+		if name == "" {
+			continue
+		}
+		if o.Kind != OverrideDomain {
+			// Kernel-timed members may already be gone
+			fw.UpdateSet(name, nil, []string{o.Target})
+			continue
+		}
+		for _, name := range []string{name, name + "6"} {
+			if del, err := fw.SetMembers(name); err == nil && len(del) > 0 {
+				fw.UpdateSet(name, nil, del)
+			}
+		}
+	}
+}
+
+// cleanOverride canonicalizes the target and checks the kind and policy.
+func cleanOverride(o *Override) error {
+	if o.Policy != DeviceTunnel && o.Policy != DeviceDirect {
+		return fmt.Errorf("policy must be tunnel or direct")
+	}
+	target := strings.TrimSpace(o.Target)
+	switch o.Kind {
+	case OverrideDevice:
+		key, ok := DeviceKey(target)
+		if !ok {
+			return fmt.Errorf("invalid device %q: need a MAC or IPv4 address", target)
+		}
+		o.Target = key
+	case OverrideCIDR:
+		c, ok := canonicalCIDR(target)
+		if !ok {
+			return fmt.Errorf("invalid network %q", target)
+		}
+		o.Target = c
+	case OverrideDomain:
+		d := strings.ToLower(strings.Trim(target, "."))
+		if d == "" || strings.ContainsAny(d, " \t/#") {
+			return fmt.Errorf("invalid domain %q", target)
+		}
+		o.Target = d
+	case OverrideTunnel:
+		o.Target = ""
+	default:
+		return fmt.Errorf("kind must be device, cidr, domain or tunnel")
+	}
+	return nil
+}
@@ -0,0 +1,558 @@
+package routing
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	routingDir      = "/opt/trusttunnel_client/routing"
+	modeConfPath    = "/opt/trusttunnel_client/mode.conf"
+	origGatewayFile = "/opt/var/run/tt_orig_gateway"
+	routingLock     = "/opt/var/run/tt_routing.lock"
+	// ipv6StateFile is written by S99trusttunnel: "tunnel" when the
+	// tunnel carries IPv6 (has_ipv6), "blocked" when LAN IPv6 is dropped
+	ipv6StateFile = "/opt/var/run/trusttunnel_ipv6_state"
+
+	setDomestic = "tt_domestic"
+	setTunnel   = "tt_tunnel"
+	setBypass   = "tt_bypass"
+	setLocal    = "tt_local"
+
+	// directMark sends a packet to directTable, which routes via the
+	// original (ISP) gateway
+	directMark   uint32 = 0x100
+	directTable         = 100
+	rulePriority        = 100
+
+	// tunnelMark sends a packet to tunnelTable, which routes via the tunnel
+	// interface; used by the direct_default policy
+	tunnelMark     uint32 = 0x200
+	tunnelTable           = 200
+	tunnelPriority        = 101
+
+	// noDefaultPriority is the IPv6 rule looking up the main table
+	// without its default routes, ahead of the fwmark rules
+	mainTable         = 254
+	noDefaultPriority = 99
+
+	netsMaxAge = 7 * 24 * time.Hour
+)
+
+const defaultDomains = `# Domains to route through tunnel (one per line)
+# IPs resolved from these domains go to tt_tunnel ipset,
+# overriding the domestic CIDR list.
+# Example:
+# netflix.com
+# youtube.com
+`
+
+const defaultBypassDomains = `# Domains to route directly, bypassing the tunnel (one per line)
+# IPs resolved from these domains go to tt_bypass ipset,
+# overriding domains.txt and the default route via the tunnel.
+# Example:
+# mybank.example
+# sso.corp.example
+`
+
+// Routing policies (SR_POLICY): what happens to traffic matching no list.
+const (
+	// PolicyTunnelDefault tunnels everything except home-country networks
+	// and direct lists
+	PolicyTunnelDefault = "tunnel_default"
+	// PolicyDirectDefault sends everything to the ISP except tunnel lists
+	PolicyDirectDefault = "direct_default"
+)
+
+// ValidPolicy reports whether p is a known SR_POLICY value.
+func ValidPolicy(p string) bool {
+	return p == PolicyTunnelDefault || p == PolicyDirectDefault
+}
+
+// localNets are never marked, so traffic between LAN segments keeps
+// following the main table whatever the policy or device. LAN prefixes of
+// IPv6 are mostly global; marked IPv6 packets first look up the main table
+// without its default routes (noDefaultPriority) to reach them.
+var localNets = []string{
+	"10.0.0.0/8", "100.64.0.0/10", "169.254.0.0/16", "172.16.0.0/12",
+	"192.168.0.0/16", "224.0.0.0/4",
+	"fc00::/7", "fe80::/10", "ff00::/8",
+}
+
+// Config is the smart-routing part of mode.conf.
+type Config struct {
+	Enabled     bool
+	Policy      string
+	HomeCountry string
+	DNSPort     int
+	DNSUpstream string
+	TunIdx      int
+}
+
+// directDefault reports whether unlisted traffic goes to the ISP.
+func (c Config) directDefault() bool {
+	return c.Policy == PolicyDirectDefault
+}
+
+func loadConfig() Config {
+	kv := readKV(modeConfPath)
+	cfg := Config{
+		Enabled:     kv["SR_ENABLED"] == "yes",
+		Policy:      kv["SR_POLICY"],
+		HomeCountry: kv["SR_HOME_COUNTRY"],
+		DNSUpstream: kv["SR_DNS_UPSTREAM"],
+	}
+	cfg.DNSPort, _ = strconv.Atoi(kv["SR_DNS_PORT"])
+	cfg.TunIdx, _ = strconv.Atoi(kv["TUN_IDX"])
+	if p := effectiveOverlay().Policy; p != "" {
+		cfg.Policy = p
+	}
+	if !ValidPolicy(cfg.Policy) {
+		cfg.Policy = PolicyTunnelDefault
+	}
+	if cfg.HomeCountry == "" {
+		cfg.HomeCountry = "RU"
+	}
+	if cfg.DNSPort == 0 {
+		cfg.DNSPort = 5354
+	}
+	if cfg.DNSUpstream == "" {
+		cfg.DNSUpstream = "1.1.1.1"
+	}
+	return cfg
+}
+
+// readKV reads a KEY="value" file such as mode.conf.
+func readKV(path string) map[string]string {
+	values := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			values[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), "\"")
+		}
+	}
+	return values
+}
+
+// inputs are the lists and settings the desired state is built from. The
+// lists hold addresses of both families; with IPv6 the IPv6 ones go to the
+// "6" twins of the sets (see familySets), otherwise they are dropped.
+type inputs struct {
+	Policy       string
+	Domestic     []string
+	StaticTunnel []string
+	StaticDirect []string
+	Devices      deviceMembers
+	Overrides    []Override
+	Gateway      Route
+	// Gateway6 is the original IPv6 gateway; IPv6 is routed only when
+	// it is set
+	Gateway6 Route
+	TunDev   string
+}
+
+func (in inputs) ipv6() bool {
+	return in.Gateway6.Dev != ""
+}
+
+// desiredState is the kernel state of running smart routing. The chain
+// first leaves local networks alone, then applies temporary overrides and
+// device policies by source address. With the tunnel_default policy it
+// then checks, in order: force-direct networks, force-tunnel networks,
+// destinations resolved from bypass_domains.txt (direct) and domains.txt
+// (tunnel), and home-country networks (direct); everything else follows
+// the main table (the tunnel). Every list has an IPv6 twin, checked right
+// after it in the IPv6 chain.
+func desiredState(in inputs) *State {
+	if in.Policy == PolicyDirectDefault {
+		return directDefaultState(in)
+	}
+	v6 := in.ipv6()
+	devSets, devRules := deviceSets(in.Devices, 0)
+	ovrSets, ovrRules := overrideSets(in.Overrides, 0, v6)
+	sets := append(append(in.localSets(), ovrSets...), devSets...)
+	sets = append(sets, familySets(SetSpec{Name: setStaticDirect, Net: true, MaxElem: staticMaxElem}, in.StaticDirect, false, v6)...)
+	sets = append(sets, familySets(SetSpec{Name: setStaticTunnel, Net: true, MaxElem: staticMaxElem}, in.StaticTunnel, false, v6)...)
+	sets = append(sets, familySets(SetSpec{Name: setDomestic, Net: true, MaxElem: 65536}, in.Domestic, false, v6)...)
+	sets = append(sets, familySets(SetSpec{Name: setBypass, MaxElem: 4096}, nil, true, v6)...)
+	sets = append(sets, familySets(SetSpec{Name: setTunnel, MaxElem: 4096}, nil, true, v6)...)
+
+	rules := append(append(familyRules(MangleRule{Set: setLocal}, v6), ovrRules...), devRules...)
+	for _, r := range []MangleRule{
+		{Set: setStaticDirect, Mark: directMark},
+		{Set: setStaticTunnel},
+		{Set: setBypass, Mark: directMark},
+		{Set: setTunnel},
+		{Set: setDomestic, Mark: directMark},
+	} {
+		rules = append(rules, familyRules(r, v6)...)
+	}
+
+	st := &State{
+		Sets:        sets,
+		Routes:      []Route{in.route(directTable, false)},
+		PolicyRules: []PolicyRule{{Mark: directMark, Table: directTable, Priority: rulePriority}},
+		Tables:      []int{directTable, tunnelTable},
+	}
+	if v6 {
+		st.Routes = append(st.Routes, in.route(directTable, true))
+		st.PolicyRules = append(st.PolicyRules,
+			PolicyRule{Table: mainTable, Priority: noDefaultPriority, NoDefault: true, V6: true},
+			PolicyRule{Mark: directMark, Table: directTable, Priority: rulePriority, V6: true})
+	}
+	st.Rules, st.Rules6 = splitRules(sets, rules, v6)
+	return st
+}
+
+// directDefaultState inverts the policy: only force-tunnel networks and
+// destinations resolved from domains.txt are marked for tunnelTable, and
+// everything else but local networks is marked for the original gateway.
+// The country list is not used.
+func directDefaultState(in inputs) *State {
+	v6 := in.ipv6()
+	devSets, devRules := deviceSets(in.Devices, tunnelMark)
+	ovrSets, ovrRules := overrideSets(in.Overrides, tunnelMark, v6)
+	sets := append(append(in.localSets(), ovrSets...), devSets...)
+	sets = append(sets, familySets(SetSpec{Name: setStaticDirect, Net: true, MaxElem: staticMaxElem}, in.StaticDirect, false, v6)...)
+	sets = append(sets, familySets(SetSpec{Name: setStaticTunnel, Net: true, MaxElem: staticMaxElem}, in.StaticTunnel, false, v6)...)
+	sets = append(sets, familySets(SetSpec{Name: setBypass, MaxElem: 4096}, nil, true, v6)...)
+	sets = append(sets, familySets(SetSpec{Name: setTunnel, MaxElem: 4096}, nil, true, v6)...)
+
+	rules := append(append(familyRules(MangleRule{Set: setLocal}, v6), ovrRules...), devRules...)
+	for _, r := range []MangleRule{
+		{Set: setStaticDirect, Mark: directMark},
+		{Set: setStaticTunnel, Mark: tunnelMark},
+		{Set: setBypass, Mark: directMark},
+		{Set: setTunnel, Mark: tunnelMark},
+	} {
+		rules = append(rules, familyRules(r, v6)...)
+	}
+	rules = append(rules, MangleRule{Mark: directMark})
+
+	st := &State{
+		Sets:   sets,
+		Routes: []Route{in.route(directTable, false), {Table: tunnelTable, Dev: in.TunDev}},
+		PolicyRules: []PolicyRule{
+			{Mark: directMark, Table: directTable, Priority: rulePriority},
+			{Mark: tunnelMark, Table: tunnelTable, Priority: tunnelPriority},
+		},
+		Tables: []int{directTable, tunnelTable},
+	}
+	if v6 {
+		st.Routes = append(st.Routes, in.route(directTable, true), Route{Table: tunnelTable, Dev: in.TunDev, V6: true})
+		st.PolicyRules = append(st.PolicyRules,
+			PolicyRule{Table: mainTable, Priority: noDefaultPriority, NoDefault: true, V6: true},
+			PolicyRule{Mark: directMark, Table: directTable, Priority: rulePriority, V6: true},
+			PolicyRule{Mark: tunnelMark, Table: tunnelTable, Priority: tunnelPriority, V6: true})
+	}
+	st.Rules, st.Rules6 = splitRules(sets, rules, v6)
+	return st
+}
+
+// route returns the default route of table via the original gateway.
+func (in inputs) route(table int, v6 bool) Route {
+	gw := in.Gateway
+	if v6 {
+		gw = in.Gateway6
+	}
+	gw.Table, gw.V6 = table, v6
+	return gw
+}
+
+func (in inputs) localSets() []Set {
+	return familySets(SetSpec{Name: setLocal, Net: true, MaxElem: 64}, localNets, false, in.ipv6())
+}
+
+// familySets returns the set for spec with the IPv4 members and, with v6,
+// its IPv6 twin named spec.Name+"6" with the IPv6 members.
+func familySets(spec SetSpec, members []string, dynamic, v6 bool) []Set {
+	var members4, members6 []string
+	for _, m := range members {
+		if strings.Contains(m, ":") {
+			members6 = append(members6, m)
+		} else {
+			members4 = append(members4, m)
+		}
+	}
+	sets := []Set{{SetSpec: spec, Members: members4, Dynamic: dynamic}}
+	if v6 {
+		spec.Name += "6"
+		spec.V6 = true
+		sets = append(sets, Set{SetSpec: spec, Members: members6, Dynamic: dynamic})
+	}
+	return sets
+}
+
+// familyRules returns r and, with v6, the same rule on the IPv6 twin set.
+func familyRules(r MangleRule, v6 bool) []MangleRule {
+	if !v6 {
+		return []MangleRule{r}
+	}
+	r6 := r
+	r6.Set += "6"
+	return []MangleRule{r, r6}
+}
+
+// stoppedState removes everything smart routing owns.
+func stoppedState() *State {
+	return &State{Tables: []int{directTable, tunnelTable}}
+}
+
+// SaveOrigGateway records the current non-tunnel default routes; it is
+// called before the tunnel takes over the default route. Without an IPv6
+// default route (or ip6 firewall support) only IPv4 is saved.
+func (m *Manager) SaveOrigGateway() error {
+	fw, err := m.backend()
+	if err != nil {
+		return err
+	}
+	gw, dev, err := fw.DefaultGateway(false)
+	if err != nil {
+		logf("WARNING: could not detect original gateway: %v", err)
+		return err
+	}
+	content := fmt.Sprintf("GW=%s\nDEV=%s\n", gw, dev)
+	gw6, dev6 := "", ""
+	if fw.IPv6() {
+		gw6, dev6, _ = fw.DefaultGateway(true)
+	}
+	content += fmt.Sprintf("GW6=%s\nDEV6=%s\n", gw6, dev6)
+	if err := os.WriteFile(origGatewayFile, []byte(content), 0644); err != nil {
+		return err
+	}
+	logf("Saved original gateway: %s via %s", gw, dev)
+	if dev6 != "" {
+		logf("Saved original IPv6 gateway: %s via %s", gw6, dev6)
+	}
+	return nil
+}
+
+// origGateway returns the saved original gateways, saving them first if
+// the tunnel was started without smart routing. The IPv6 route is empty
+// when IPv6 is not routed.
+func (m *Manager) origGateway() (Route, Route, error) {
+	kv := readKV(origGatewayFile)
+	if _, ok := kv["DEV6"]; kv["DEV"] == "" || !ok {
+		// Files of earlier versions have no IPv6 keys
+		if err := m.SaveOrigGateway(); err != nil {
+			return Route{}, Route{}, fmt.Errorf("no original gateway saved: %w", err)
+		}
+		kv = readKV(origGatewayFile)
+	}
+	return Route{Gateway: kv["GW"], Dev: kv["DEV"]},
+		Route{Gateway: kv["GW6"], Dev: kv["DEV6"]}, nil
+}
+
+// routesIPv6 reports whether smart routing covers IPv6: the tunnel
+// carries IPv6, ip and the backend support it and the original IPv6
+// gateway is known. Otherwise IPv6 routes to the tunnel would blackhole.
+func (m *Manager) routesIPv6(fw FirewallBackend) bool {
+	if !tunnelCarriesIPv6() || !ipHasNoDefault() || !fw.IPv6() {
+		return false
+	}
+	_, gw6, err := m.origGateway()
+	return err == nil && gw6.Dev != ""
+}
+
+// tunnelCarriesIPv6 reports whether the tunnel was started with has_ipv6.
+func tunnelCarriesIPv6() bool {
+	data, err := os.ReadFile(ipv6StateFile)
+	return err == nil && strings.TrimSpace(string(data)) == "tunnel"
+}
+
+func (m *Manager) backend() (FirewallBackend, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.fw != nil {
+		return m.fw, nil
+	}
+	fw, err := NewFirewallBackend()
+	if err != nil {
+		return nil, err
+	}
+	m.fw = fw
+	return fw, nil
+}
+
+// Start sets smart routing up: sets, CIDR lists, dnsmasq, policy routing
+// and the mangle chain, like sr_start did.
+func (m *Manager) Start() error {
+	return withRoutingLock(func() error {
+		cfg := loadConfig()
+		fw, err := m.backend()
+		if err != nil {
+			return fmt.Errorf("smart routing: %w", err)
+		}
+		if !hasCommand("dnsmasq") {
+			return fmt.Errorf("smart routing: dnsmasq is not installed (opkg install dnsmasq-full)")
+		}
+		logf("Starting smart routing (FW backend: %s, policy: %s)", fw.Name(), cfg.Policy)
+
+		if err := os.MkdirAll(routingDir, 0755); err != nil {
+			return err
+		}
+		if _, err := os.Stat(domainsPath); os.IsNotExist(err) {
+			os.WriteFile(domainsPath, []byte(defaultDomains), 0644)
+		}
+		if _, err := os.Stat(bypassPath); os.IsNotExist(err) {
+			os.WriteFile(bypassPath, []byte(defaultBypassDomains), 0644)
+		}
+		if !cfg.directDefault() && netsStale() {
+			if err := downloadNets(cfg.HomeCountry); err != nil {
+				logf("ERROR: %v", err)
+				if _, statErr := os.Stat(netsFile); statErr != nil {
+					return err
+				}
+			}
+		} else if !cfg.directDefault() && nets6Missing() && m.routesIPv6(fw) {
+			// A fresh IPv4 list does not mean the IPv6 one was fetched
+			downloadNets6(cfg.HomeCountry)
+		}
+
+		if err := m.startDnsmasq(cfg, fw); err != nil {
+			return err
+		}
+		if err := m.applyState(fw, cfg); err != nil {
+			return err
+		}
+		logf("Smart routing started successfully")
+		return nil
+	})
+}
+
+// Stop removes the smart-routing state and stops its dnsmasq.
+func (m *Manager) Stop() error {
+	return withRoutingLock(func() error {
+		logf("Stopping smart routing")
+		fw, err := m.backend()
+		if err != nil {
+			return err
+		}
+		d, err := NewEngine(fw).Apply(stoppedState())
+		logDiff(d)
+		stopDnsmasq()
+		if err != nil {
+			return fmt.Errorf("stop smart routing: %w", err)
+		}
+		logf("Smart routing stopped")
+		return nil
+	})
+}
+
+// Restore re-applies the desired state, e.g. after NDM rebuilt the
+// firewall; only missing pieces are added back.
+func (m *Manager) Restore() error {
+	return withRoutingLock(func() error {
+		cfg := loadConfig()
+		if !cfg.Enabled {
+			return nil
+		}
+		fw, err := m.backend()
+		if err != nil {
+			return err
+		}
+		return m.applyState(fw, cfg)
+	})
+}
+
+// Plan returns the changes Restore would make, without applying them.
+func (m *Manager) Plan() (*Diff, error) {
+	fw, err := m.backend()
+	if err != nil {
+		return nil, err
+	}
+	want := stoppedState()
+	if cfg := loadConfig(); cfg.Enabled {
+		if want, err = m.desired(cfg); err != nil {
+			return nil, err
+		}
+	}
+	return NewEngine(fw).Plan(want)
+}
+
+func (m *Manager) desired(cfg Config) (*State, error) {
+	gw, gw6, err := m.origGateway()
+	if err != nil {
+		return nil, err
+	}
+	if fw, err := m.backend(); err != nil || !m.routesIPv6(fw) {
+		gw6 = Route{}
+	}
+	in := inputs{
+		Policy:       cfg.Policy,
+		StaticTunnel: staticMembers(staticTunnelPath),
+		StaticDirect: staticMembers(staticDirectPath),
+		Devices:      m.readDeviceMembers(),
+		Overrides:    readOverrides(time.Now()),
+		Gateway:      gw,
+		Gateway6:     gw6,
+		TunDev:       fmt.Sprintf("tun%d", cfg.TunIdx),
+	}
+	if !cfg.directDefault() {
+		if in.Domestic, err = readNets(); err != nil {
+			return nil, err
+		}
+	}
+	return desiredState(in), nil
+}
+
+func (m *Manager) applyState(fw FirewallBackend, cfg Config) error {
+	want, err := m.desired(cfg)
+	if err != nil {
+		return fmt.Errorf("apply smart routing: %w", err)
+	}
+	d, err := NewEngine(fw).Apply(want)
+	logDiff(d)
+	if err == nil {
+		// The IPv6 chain is never empty while IPv6 is routed
+		err = loadOverrides(fw, readOverrides(time.Now()), len(want.Rules6) > 0)
+	}
+	if err != nil {
+		return fmt.Errorf("apply smart routing: %w", err)
+	}
+	return nil
+}
+
+func logDiff(d *Diff) {
+	if d == nil {
+		return
+	}
+	if d.Empty() {
+		logf("Firewall state is up to date")
+		return
+	}
+	for _, line := range d.Summary() {
+		logf("%s", line)
+	}
+}
+
+func logf(format string, args ...any) {
+	log.Printf("[smart-routing] "+format, args...)
+}
+
+// withRoutingLock serializes changes between the manager and the
+// -routing commands run from the init script and NDM hooks.
+func withRoutingLock(fn func() error) error {
+	f, err := os.OpenFile(routingLock, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fn()
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		return fn()
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+	return fn()
+}
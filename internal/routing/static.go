@@ -0,0 +1,143 @@
+package routing
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	staticTunnelPath = "/opt/trusttunnel_client/routing/static_tunnel.txt"
+	staticDirectPath = "/opt/trusttunnel_client/routing/static_direct.txt"
+
+	setStaticTunnel = "tt_static_tunnel"
+	setStaticDirect = "tt_static_direct"
+	staticMaxElem   = 4096
+)
+
+// StaticEntry is a user-managed network with an optional comment.
+type StaticEntry struct {
+	CIDR    string `json:"cidr"`
+	Comment string `json:"comment,omitempty"`
+}
+
+// StaticLists are the networks always sent through the tunnel or always
+// sent directly, regardless of country and domain lists.
+type StaticLists struct {
+	Tunnel []StaticEntry `json:"tunnel"`
+	Direct []StaticEntry `json:"direct"`
+}
+
+// GetStatic returns the force-tunnel and force-direct lists.
+func (m *Manager) GetStatic() (*StaticLists, error) {
+	tunnel, err := readStaticList(staticTunnelPath)
+	if err != nil {
+		return nil, err
+	}
+	direct, err := readStaticList(staticDirectPath)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticLists{Tunnel: tunnel, Direct: direct}, nil
+}
+
+// SaveStatic validates and deduplicates the lists, stores them and loads
+// them into their sets when smart routing is running.
+func (m *Manager) SaveStatic(l StaticLists) (*StaticLists, error) {
+	tunnel, err := cleanStaticList(l.Tunnel)
+	if err != nil {
+		return nil, fmt.Errorf("force-tunnel: %w", err)
+	}
+	direct, err := cleanStaticList(l.Direct)
+	if err != nil {
+		return nil, fmt.Errorf("force-direct: %w", err)
+	}
+	inTunnel := make(map[string]bool, len(tunnel))
+	for _, e := range tunnel {
+		inTunnel[e.CIDR] = true
+	}
+	for _, e := range direct {
+		if inTunnel[e.CIDR] {
+			return nil, fmt.Errorf("%s is in both lists", e.CIDR)
+		}
+	}
+
+	if err := os.MkdirAll(routingDir, 0755); err != nil {
+		return nil, err
+	}
+	if err := writeStaticList(staticTunnelPath, tunnel); err != nil {
+		return nil, err
+	}
+	if err := writeStaticList(staticDirectPath, direct); err != nil {
+		return nil, err
+	}
+	out := &StaticLists{Tunnel: tunnel, Direct: direct}
+	if err := m.Restore(); err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+// cleanStaticList canonicalizes the networks, rejecting invalid ones, and
+// drops repeated entries, keeping the first comment.
+func cleanStaticList(list []StaticEntry) ([]StaticEntry, error) {
+	out := []StaticEntry{}
+	seen := make(map[string]bool)
+	for _, e := range list {
+		c, ok := canonicalCIDR(e.CIDR)
+		if !ok {
+			return nil, fmt.Errorf("invalid address or network %q", e.CIDR)
+		}
+		if seen[c] {
+			continue
+		}
+		seen[c] = true
+		comment := strings.TrimSpace(strings.ReplaceAll(e.Comment, "\n", " "))
+		out = append(out, StaticEntry{CIDR: c, Comment: comment})
+	}
+	return out, nil
+}
+
+// readStaticList reads "CIDR # comment" lines.
+func readStaticList(path string) ([]StaticEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return []StaticEntry{}, nil
+		}
+		return nil, err
+	}
+	list := []StaticEntry{}
+	for _, line := range strings.Split(string(data), "\n") {
+		cidr, comment, _ := strings.Cut(line, "#")
+		cidr = strings.TrimSpace(cidr)
+		if cidr == "" {
+			continue
+		}
+		list = append(list, StaticEntry{CIDR: cidr, Comment: strings.TrimSpace(comment)})
+	}
+	return list, nil
+}
+
+func writeStaticList(path string, list []StaticEntry) error {
+	var sb strings.Builder
+	for _, e := range list {
+		sb.WriteString(e.CIDR)
+		if e.Comment != "" {
+			sb.WriteString(" # " + e.Comment)
+		}
+		sb.WriteString("\n")
+	}
+	return os.WriteFile(path, []byte(sb.String()), 0644)
+}
+
+// staticMembers returns the networks of a list file ready for a set.
+func staticMembers(path string) []string {
+	list, _ := readStaticList(path)
+	cidrs := make([]string, len(list))
+	for i, e := range list {
+		cidrs[i] = e.CIDR
+	}
+	members, _ := normalizeCIDRs(cidrs)
+	return members
+}
@@ -0,0 +1,247 @@
+package service
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+const (
+	// Limits for release archives; the client tarball is a few MB
+	maxArchiveEntries  = 256
+	maxArchiveFileSize = 64 << 20
+	maxArchiveTotal    = 128 << 20
+)
+
+// extractArchive unpacks a .tar.gz into dir. Only regular files and
+// directories are extracted; links, devices and entries escaping dir are
+// rejected, as are archives exceeding the size limits.
+func extractArchive(archive, dir string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("gzip: %w", err)
+	}
+	defer gz.Close()
+
+	tr := tar.NewReader(gz)
+	var total int64
+	for entries := 0; ; entries++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("tar: %w", err)
+		}
+		if entries >= maxArchiveEntries {
+			return fmt.Errorf("archive has more than %d entries", maxArchiveEntries)
+		}
+
+		name, err := archivePath(hdr.Name)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			continue
+		}
+		target := filepath.Join(dir, name)
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if hdr.Size > maxArchiveFileSize {
+				return fmt.Errorf("%s is too large (%d bytes)", hdr.Name, hdr.Size)
+			}
+			total += hdr.Size
+			if total > maxArchiveTotal {
+				return fmt.Errorf("archive unpacks to more than %d bytes", maxArchiveTotal)
+			}
+			if err := ensureSpace(dir, hdr.Size); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := writeArchiveFile(tr, target, hdr); err != nil {
+				return err
+			}
+		default:
+			// Symlinks, hardlinks and special files are not needed and could
+			// point outside dir
+			continue
+		}
+	}
+}
+
+// archivePath cleans an entry name and rejects absolute paths and ".."
+// components. The archive root itself yields "".
+func archivePath(name string) (string, error) {
+	if strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return "", fmt.Errorf("unsafe path in archive: %q", name)
+	}
+	clean := path.Clean(name)
+	if clean == "." {
+		return "", nil
+	}
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("unsafe path in archive: %q", name)
+	}
+	return filepath.FromSlash(clean), nil
+}
+
+func writeArchiveFile(r io.Reader, target string, hdr *tar.Header) error {
+	mode := os.FileMode(0644)
+	if hdr.Mode&0111 != 0 {
+		mode = 0755
+	}
+	out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, mode)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(out, io.LimitReader(r, hdr.Size))
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && n != hdr.Size {
+		err = fmt.Errorf("%s: truncated archive", hdr.Name)
+	}
+	return err
+}
+
+// findClientBinary locates trusttunnel_client in an extracted release,
+// either at the top or inside a single top-level directory, and returns it
+// with that directory name (which carries the version).
+func findClientBinary(dir string) (string, string, error) {
+	if p := filepath.Join(dir, "trusttunnel_client"); isRegular(p) {
+		return p, "", nil
+	}
+	entries, _ := os.ReadDir(dir)
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		if p := filepath.Join(dir, e.Name(), "trusttunnel_client"); isRegular(p) {
+			return p, e.Name(), nil
+		}
+	}
+	return "", "", fmt.Errorf("trusttunnel_client not found in archive")
+}
+
+func isRegular(p string) bool {
+	fi, err := os.Lstat(p)
+	return err == nil && fi.Mode().IsRegular()
+}
+
+// elfTarget is what distinguishes binaries for different routers.
+type elfTarget struct {
+	Machine elf.Machine
+	Class   elf.Class
+	Data    elf.Data
+}
+
+func (t elfTarget) String() string {
+	bits := "32-bit"
+	if t.Class == elf.ELFCLASS64 {
+		bits = "64-bit"
+	}
+	endian := "little-endian"
+	if t.Data == elf.ELFDATA2MSB {
+		endian = "big-endian"
+	}
+	return fmt.Sprintf("%s %s %s", strings.TrimPrefix(t.Machine.String(), "EM_"), bits, endian)
+}
+
+func readELFTarget(p string) (elfTarget, error) {
+	f, err := elf.Open(p)
+	if err != nil {
+		return elfTarget{}, fmt.Errorf("%s is not an ELF binary: %w", filepath.Base(p), err)
+	}
+	defer f.Close()
+	if f.Type != elf.ET_EXEC && f.Type != elf.ET_DYN {
+		return elfTarget{}, fmt.Errorf("%s is not an executable", filepath.Base(p))
+	}
+	return elfTarget{Machine: f.Machine, Class: f.Class, Data: f.Data}, nil
+}
+
+var (
+	hostOnce   sync.Once
+	hostTarget elfTarget
+	hostErr    error
+)
+
+// hostELF returns the target of the running manager binary. Outside Linux
+// (development builds) there is no ELF to inspect.
+func hostELF() (elfTarget, error) {
+	hostOnce.Do(func() {
+		exe, err := os.Executable()
+		if err != nil {
+			hostErr = err
+			return
+		}
+		hostTarget, hostErr = readELFTarget(exe)
+	})
+	return hostTarget, hostErr
+}
+
+// checkBinaryArch fails unless the ELF binary at p runs on this router.
+func checkBinaryArch(p string) error {
+	got, err := readELFTarget(p)
+	if err != nil {
+		return err
+	}
+	want, err := hostELF()
+	if err != nil {
+		return fmt.Errorf("cannot inspect own binary: %w", err)
+	}
+	if got != want {
+		return fmt.Errorf("%s is built for %s, this router needs %s", filepath.Base(p), got, want)
+	}
+	return nil
+}
+
+// detectArch names the release architecture of this router from the ELF
+// header of the manager binary, falling back to the build target.
+func detectArch() string {
+	if t, err := hostELF(); err == nil {
+		switch t.Machine {
+		case elf.EM_MIPS:
+			if t.Data == elf.ELFDATA2LSB {
+				return "mipsel"
+			}
+			return "mips"
+		case elf.EM_AARCH64:
+			return "aarch64"
+		case elf.EM_ARM:
+			return "armv7"
+		}
+	}
+	switch runtime.GOARCH {
+	case "mipsle":
+		return "mipsel"
+	case "mips":
+		return "mips"
+	case "arm64":
+		return "aarch64"
+	case "arm":
+		return "armv7"
+	default:
+		return runtime.GOARCH
+	}
+}
@@ -0,0 +1,335 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	AutoUpdateOff     = "off"
+	AutoUpdateNotify  = "notify"
+	AutoUpdateInstall = "install"
+
+	defaultAutoWindow   = "03:00-05:00"
+	defaultAutoInterval = 12
+	defaultAutoMaxKbps  = 256
+
+	// autoTrafficSample is how long tunnel traffic is measured before an
+	// automatic install.
+	autoTrafficSample = 10 * time.Second
+	// autoRetryAfter keeps a failed automatic install from being retried
+	// every minute of the window.
+	autoRetryAfter = 24 * time.Hour
+)
+
+// AutoUpdateStatus reports the state of the auto-update scheduler.
+type AutoUpdateStatus struct {
+	Policy      string    `json:"policy"`
+	LastCheck   time.Time `json:"last_check,omitempty"`
+	NextCheck   time.Time `json:"next_check,omitempty"`
+	InWindow    bool      `json:"in_window"`
+	LastAttempt time.Time `json:"last_attempt,omitempty"`
+	LastResult  string    `json:"last_result,omitempty"`
+	// TimeZone is the zone the maintenance window is in
+	TimeZone string `json:"timezone"`
+}
+
+// SetTimeZoneSource sets where the router's time zone, which the
+// maintenance window is in, is read from.
+func (u *Updater) SetTimeZoneSource(src TimeZoneSource) {
+	u.tz.setSource(src)
+}
+
+// RunAuto checks for updates on the configured interval. With the notify
+// policy new versions are reported as events; with the install policy they
+// are installed inside the maintenance window while the tunnels are idle.
+func (u *Updater) RunAuto(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			u.autoTick(time.Now())
+		}
+	}
+}
+
+func (u *Updater) autoTick(now time.Time) {
+	s := u.Settings()
+	loc, _ := u.tz.location()
+	inWindow := inMaintenanceWindow(s.AutoWindow, now.In(loc))
+
+	u.mu.Lock()
+	st := u.auto
+	st.Policy = s.AutoUpdate
+	st.InWindow = inWindow && s.AutoUpdate == AutoUpdateInstall
+	interval := time.Duration(s.AutoInterval) * time.Hour
+	due := now.Sub(st.LastCheck) >= interval
+	// Refresh at the start of the window so installs use recent data
+	if st.InWindow && now.Sub(st.LastCheck) >= time.Hour {
+		due = true
+	}
+	u.auto = st
+	u.mu.Unlock()
+
+	if s.AutoUpdate == AutoUpdateOff || (!due && !st.InWindow) {
+		return
+	}
+
+	if due {
+		u.InvalidateCache()
+	}
+	info, err := u.Check()
+	if err != nil {
+		return
+	}
+	if due {
+		u.mu.Lock()
+		u.auto.LastCheck = now
+		u.auto.NextCheck = now.Add(interval)
+		u.mu.Unlock()
+	}
+
+	if s.AutoUpdate == AutoUpdateNotify || !st.InWindow {
+		u.notifyAvailable(info)
+		return
+	}
+	u.autoInstall(info, s)
+}
+
+// notifyAvailable adds an event once per newly available version.
+func (u *Updater) notifyAvailable(info *UpdateInfo) {
+	notify := func(component, current, latest string) {
+		key := component + " " + latest
+		u.mu.Lock()
+		seen := u.notified[key]
+		u.notified[key] = true
+		u.mu.Unlock()
+		if seen {
+			return
+		}
+		u.events.Add(Event{
+			Type:    "update_available",
+			Message: fmt.Sprintf("%s %s is available (installed %s)", component, latest, current),
+		})
+	}
+	if info.ClientUpdateAvailable {
+		notify("client", info.ClientCurrentVersion, info.ClientLatestVersion)
+	}
+	if info.ManagerUpdateAvailable {
+		notify("manager", info.ManagerCurrentVersion, info.ManagerLatestVersion)
+	}
+}
+
+// autoInstall installs pending updates, the client first. The manager is
+// only replaced once no client update is being watched, since its restart
+// would end the watch.
+func (u *Updater) autoInstall(info *UpdateInfo, s UpdateSettings) {
+	client := info.ClientUpdateAvailable && u.autoAllowed("client", info.ClientLatestVersion)
+	manager := info.ManagerUpdateAvailable && u.autoAllowed("manager", info.ManagerLatestVersion)
+	if info.Rollback != nil && info.Rollback.State == "watching" {
+		return
+	}
+	if !client && !manager {
+		return
+	}
+
+	if kbps, name := tunnelTrafficKbps(autoTrafficSample); kbps > float64(s.AutoMaxKbps) {
+		u.setAutoResult(fmt.Sprintf("skipped: instance %s carries %.0f kbit/s (limit %d)", name, kbps, s.AutoMaxKbps), false)
+		return
+	}
+
+	component, version := "client", info.ClientLatestVersion
+	install := u.Install
+	if !client {
+		component, version = "manager", info.ManagerLatestVersion
+		install = u.InstallManager
+	}
+
+	u.mu.Lock()
+	u.attempted[component+" "+version] = time.Now()
+	u.mu.Unlock()
+
+	log.Printf("[auto-update] installing %s %s", component, version)
+	res, err := install(context.Background(), nil, version)
+	if err != nil {
+		u.setAutoResult(fmt.Sprintf("%s %s failed: %v", component, version, err), true)
+		return
+	}
+	u.setAutoResult(fmt.Sprintf("%s updated to %s", component, res.Version), true)
+}
+
+// autoAllowed reports whether version of component may be installed now: it
+// was not rolled back and has not failed recently.
+func (u *Updater) autoAllowed(component, version string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if component == "client" && u.rollback != nil && u.rollback.State == "rolled_back" && u.rollback.Version == version {
+		return false
+	}
+	at, ok := u.attempted[component+" "+version]
+	return !ok || time.Since(at) >= autoRetryAfter
+}
+
+// setAutoResult records the outcome of an automatic install. Skips are only
+// reported as events when the reason changes.
+func (u *Updater) setAutoResult(result string, attempted bool) {
+	u.mu.Lock()
+	changed := u.auto.LastResult != result
+	u.auto.LastResult = result
+	if attempted {
+		u.auto.LastAttempt = time.Now()
+	}
+	u.mu.Unlock()
+
+	log.Printf("[auto-update] %s", result)
+	if attempted || changed {
+		u.events.Add(Event{Type: "auto_update", Message: result})
+	}
+}
+
+// inMaintenanceWindow reports whether now (wall time in its location) falls into a
+// "HH:MM-HH:MM" window. Windows may wrap past midnight.
+func inMaintenanceWindow(window string, now time.Time) bool {
+	from, to, ok := parseWindow(window)
+	if !ok {
+		return false
+	}
+	cur := now.Hour()*60 + now.Minute()
+	if from <= to {
+		return cur >= from && cur < to
+	}
+	return cur >= from || cur < to
+}
+
+func parseWindow(window string) (int, int, bool) {
+	a, b, ok := strings.Cut(strings.ReplaceAll(window, " ", ""), "-")
+	if !ok {
+		return 0, 0, false
+	}
+	from, ok1 := parseClock(a)
+	to, ok2 := parseClock(b)
+	return from, to, ok1 && ok2 && from != to
+}
+
+func parseClock(s string) (int, bool) {
+	h, m, ok := strings.Cut(s, ":")
+	if !ok {
+		return 0, false
+	}
+	hh, err1 := strconv.Atoi(h)
+	mm, err2 := strconv.Atoi(m)
+	if err1 != nil || err2 != nil || hh < 0 || hh > 23 || mm < 0 || mm > 59 {
+		return 0, false
+	}
+	return hh*60 + mm, true
+}
+
+// tunnelTrafficKbps samples the traffic of every running instance and
+// returns the busiest one. TUN instances are measured on their tunN device
+// (S99trusttunnel renames the OpkgTun kernel device), SOCKS5 instances by the I/O of the client process.
+func tunnelTrafficKbps(sample time.Duration) (float64, string) {
+	type counter struct {
+		name  string
+		read  func() int64
+		start int64
+	}
+	var counters []*counter
+	instances := NewInstances()
+	for _, name := range instances.Names() {
+		m, cfg, err := instances.Get(name)
+		if err != nil {
+			continue
+		}
+		st, _ := m.Status()
+		if st == nil || !st.Running {
+			continue
+		}
+		mode, err := cfg.ReadMode()
+		if err != nil {
+			continue
+		}
+		c := &counter{name: name}
+		if mode.Mode == "tun" {
+			dev := fmt.Sprintf("tun%d", mode.TunIdx)
+			c.read = func() int64 { return interfaceBytes(dev) }
+		} else {
+			pidFile := pathsFor(name).pidFile
+			c.read = func() int64 { return processIOBytes(readPIDFile(pidFile)) }
+		}
+		c.start = c.read()
+		counters = append(counters, c)
+	}
+	if len(counters) == 0 {
+		return 0, ""
+	}
+
+	time.Sleep(sample)
+	var max float64
+	busiest := ""
+	for _, c := range counters {
+		delta := c.read() - c.start
+		if delta < 0 {
+			continue
+		}
+		if kbps := float64(delta) * 8 / 1000 / sample.Seconds(); kbps > max {
+			max, busiest = kbps, c.name
+		}
+	}
+	return max, busiest
+}
+
+// interfaceBytes returns rx+tx bytes of a network interface from
+// /proc/net/dev.
+func interfaceBytes(dev string) int64 {
+	f, err := os.Open("/proc/net/dev")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name, rest, ok := strings.Cut(scanner.Text(), ":")
+		if !ok || strings.TrimSpace(name) != dev {
+			continue
+		}
+		fields := strings.Fields(rest)
+		if len(fields) < 9 {
+			return 0
+		}
+		rx, _ := strconv.ParseInt(fields[0], 10, 64)
+		tx, _ := strconv.ParseInt(fields[8], 10, 64)
+		return rx + tx
+	}
+	return 0
+}
+
+// processIOBytes returns the bytes read and written by a process, which for
+// the client is dominated by proxied traffic.
+func processIOBytes(pid int) int64 {
+	if pid <= 0 {
+		return 0
+	}
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/io", pid))
+	if err != nil {
+		return 0
+	}
+	var total int64
+	for _, line := range strings.Split(string(data), "\n") {
+		key, val, ok := strings.Cut(line, ":")
+		if !ok || (key != "rchar" && key != "wchar") {
+			continue
+		}
+		n, _ := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+		total += n
+	}
+	return total
+}
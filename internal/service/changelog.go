@@ -0,0 +1,129 @@
+package service
+
+import (
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// maxNotesLength caps a release body; GitHub allows 125000 characters.
+const maxNotesLength = 16 << 10
+
+type AssetInfo struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+}
+
+// ChangelogEntry is one release between the installed and the latest
+// version.
+type ChangelogEntry struct {
+	Tag         string    `json:"tag"`
+	Name        string    `json:"name"`
+	PublishedAt time.Time `json:"published_at"`
+	Prerelease  bool      `json:"prerelease"`
+	// Body is the release notes as markdown with HTML removed
+	Body   string      `json:"body"`
+	Assets []AssetInfo `json:"assets"`
+}
+
+type Changelog struct {
+	Client       []ChangelogEntry `json:"client"`
+	ClientError  string           `json:"client_error,omitempty"`
+	Manager      []ChangelogEntry `json:"manager"`
+	ManagerError string           `json:"manager_error,omitempty"`
+}
+
+// Changelog returns the release notes of every client and manager version
+// newer than the installed one, up to the latest on the configured channel,
+// newest first.
+func (u *Updater) Changelog() *Changelog {
+	out := &Changelog{}
+	var err error
+	if out.Client, err = u.changelog(clientRepo, detectClientVersion()); err != nil {
+		out.ClientError = err.Error()
+	}
+	if out.Manager, err = u.changelog(managerRepo, managerVersion()); err != nil {
+		out.ManagerError = err.Error()
+	}
+	return out
+}
+
+func (u *Updater) changelog(repo, current string) ([]ChangelogEntry, error) {
+	latest, err := u.fetchLatestRelease(repo)
+	if err != nil {
+		return []ChangelogEntry{}, err
+	}
+	releases, err := u.listReleases(repo)
+	if err != nil {
+		return []ChangelogEntry{}, err
+	}
+	prerelease := u.Settings().Channel == ChannelPrerelease
+
+	list := []ChangelogEntry{}
+	for _, r := range releases {
+		if r.Draft || (r.Prerelease && !prerelease) {
+			continue
+		}
+		if r.TagName != latest.TagName && !isNewer(latest.TagName, r.TagName) {
+			continue
+		}
+		// Without a numeric current version only the latest release is shown
+		if len(parseVersion(current)) == 0 {
+			if r.TagName != latest.TagName {
+				continue
+			}
+		} else if !isNewer(r.TagName, current) {
+			continue
+		}
+		entry := ChangelogEntry{
+			Tag:         r.TagName,
+			Name:        sanitizeNotes(r.Name, 200),
+			PublishedAt: r.PublishedAt,
+			Prerelease:  r.Prerelease,
+			Body:        sanitizeNotes(r.Body, maxNotesLength),
+			Assets:      make([]AssetInfo, 0, len(r.Assets)),
+		}
+		for _, a := range r.Assets {
+			entry.Assets = append(entry.Assets, AssetInfo{Name: a.Name, Size: a.Size})
+		}
+		list = append(list, entry)
+	}
+	return list, nil
+}
+
+var (
+	htmlCommentRe = regexp.MustCompile(`(?s)<!--.*?-->`)
+	htmlTagRe     = regexp.MustCompile(`</?[a-zA-Z][^>]*>`)
+	// unsafeLinkRe matches markdown link targets with script-capable schemes
+	unsafeLinkRe = regexp.MustCompile(`(?i)\]\(\s*(javascript|data|vbscript):[^)]*\)`)
+)
+
+// sanitizeNotes makes release notes safe to render: HTML tags and comments
+// are removed, links with script schemes are neutralized, control
+// characters are dropped and the text is truncated.
+func sanitizeNotes(s string, limit int) string {
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	s = htmlCommentRe.ReplaceAllString(s, "")
+	s = htmlTagRe.ReplaceAllString(s, "")
+	s = unsafeLinkRe.ReplaceAllString(s, "](#)")
+	s = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || !unicode.IsControl(r) {
+			return r
+		}
+		return -1
+	}, s)
+	s = strings.TrimSpace(s)
+	if len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8Start(s[cut]) {
+			cut--
+		}
+		s = s[:cut] + "…"
+	}
+	return s
+}
+
+func utf8Start(b byte) bool {
+	return b&0xC0 != 0x80
+}
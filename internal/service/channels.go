@@ -0,0 +1,237 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ChannelStable     = "stable"
+	ChannelPrerelease = "prerelease"
+
+	updateConfig = "/opt/trusttunnel_client/update.conf"
+)
+
+// UpdateSettings are the persisted update preferences. A pin holds a
+// component at a version: no update is offered for it while set.
+type UpdateSettings struct {
+	Channel    string `json:"channel"`
+	ClientPin  string `json:"client_pin"`
+	ManagerPin string `json:"manager_pin"`
+	// AutoUpdate is "off", "notify" or "install"
+	AutoUpdate   string `json:"auto_update"`
+	AutoWindow   string `json:"auto_update_window"`
+	AutoInterval int    `json:"auto_update_interval"`
+	AutoMaxKbps  int    `json:"auto_update_max_kbps"`
+	// Sources is the comma-separated UPDATE_SOURCES list, see releaseSource
+	Sources string `json:"sources"`
+	// DownloadDir holds downloads; point it at USB storage on small routers
+	DownloadDir string `json:"download_dir"`
+}
+
+// ReleaseInfo describes one GitHub release as listed by Releases.
+type ReleaseInfo struct {
+	Tag         string    `json:"tag"`
+	Name        string    `json:"name"`
+	PublishedAt time.Time `json:"published_at"`
+	Prerelease  bool      `json:"prerelease"`
+	// HasAsset is true when the release ships a build for this router's arch
+	HasAsset bool `json:"has_asset"`
+	Current  bool `json:"current"`
+	Latest   bool `json:"latest"`
+}
+
+type ReleaseList struct {
+	Channel      string        `json:"channel"`
+	Client       []ReleaseInfo `json:"client"`
+	ClientError  string        `json:"client_error,omitempty"`
+	Manager      []ReleaseInfo `json:"manager"`
+	ManagerError string        `json:"manager_error,omitempty"`
+}
+
+// Settings reads update.conf, falling back to the stable channel and
+// disabled auto-updates.
+func (u *Updater) Settings() UpdateSettings {
+	values := readConfFile(updateConfig)
+	s := UpdateSettings{
+		Channel:     values["UPDATE_CHANNEL"],
+		ClientPin:   values["CLIENT_PIN"],
+		ManagerPin:  values["MANAGER_PIN"],
+		AutoUpdate:  values["AUTO_UPDATE"],
+		AutoWindow:  values["AUTO_UPDATE_WINDOW"],
+		Sources:     values["UPDATE_SOURCES"],
+		DownloadDir: values["DOWNLOAD_DIR"],
+	}
+	s.AutoInterval, _ = strconv.Atoi(values["AUTO_UPDATE_INTERVAL"])
+	s.AutoMaxKbps, _ = strconv.Atoi(values["AUTO_UPDATE_MAX_KBPS"])
+	if s.Channel != ChannelPrerelease {
+		s.Channel = ChannelStable
+	}
+	if s.AutoUpdate != AutoUpdateNotify && s.AutoUpdate != AutoUpdateInstall {
+		s.AutoUpdate = AutoUpdateOff
+	}
+	if _, _, ok := parseWindow(s.AutoWindow); !ok {
+		s.AutoWindow = defaultAutoWindow
+	}
+	if s.AutoInterval <= 0 {
+		s.AutoInterval = defaultAutoInterval
+	}
+	if s.Sources == "" {
+		s.Sources = defaultUpdateSources
+	}
+	if !filepath.IsAbs(s.DownloadDir) {
+		s.DownloadDir = defaultDownloadDir
+	}
+	if _, ok := values["AUTO_UPDATE_MAX_KBPS"]; !ok {
+		s.AutoMaxKbps = defaultAutoMaxKbps
+	}
+	return s
+}
+
+func (u *Updater) WriteSettings(s UpdateSettings) error {
+	if s.Channel != ChannelStable && s.Channel != ChannelPrerelease {
+		return fmt.Errorf("channel must be %q or %q", ChannelStable, ChannelPrerelease)
+	}
+	for _, pin := range []string{s.ClientPin, s.ManagerPin} {
+		if !ValidTag(pin) {
+			return fmt.Errorf("invalid pin %q", pin)
+		}
+	}
+	switch s.AutoUpdate {
+	case AutoUpdateOff, AutoUpdateNotify, AutoUpdateInstall:
+	default:
+		return fmt.Errorf("auto_update must be off, notify or install")
+	}
+	if _, _, ok := parseWindow(s.AutoWindow); !ok {
+		return fmt.Errorf("auto_update_window must be HH:MM-HH:MM")
+	}
+	if s.AutoInterval < 1 || s.AutoInterval > 168 {
+		return fmt.Errorf("auto_update_interval must be 1..168 hours")
+	}
+	if s.AutoMaxKbps < 0 {
+		return fmt.Errorf("auto_update_max_kbps must not be negative")
+	}
+	sources, err := parseSources(s.Sources)
+	if err != nil {
+		return err
+	}
+	if strings.ContainsAny(s.Sources, "\"\n$`") {
+		return fmt.Errorf("invalid characters in sources")
+	}
+	if s.DownloadDir == "" {
+		s.DownloadDir = defaultDownloadDir
+	}
+	if !filepath.IsAbs(s.DownloadDir) || strings.ContainsAny(s.DownloadDir, "\"\n$`") {
+		return fmt.Errorf("download_dir must be an absolute path")
+	}
+	if fi, err := os.Stat(s.DownloadDir); err != nil || !fi.IsDir() {
+		return fmt.Errorf("download_dir %s is not a directory", s.DownloadDir)
+	}
+	if err := rewriteConfFile(updateConfig,
+		confEntry{"UPDATE_CHANNEL", s.Channel},
+		confEntry{"CLIENT_PIN", s.ClientPin},
+		confEntry{"MANAGER_PIN", s.ManagerPin},
+		confEntry{"AUTO_UPDATE", s.AutoUpdate},
+		confEntry{"AUTO_UPDATE_WINDOW", s.AutoWindow},
+		confEntry{"AUTO_UPDATE_INTERVAL", strconv.Itoa(s.AutoInterval)},
+		confEntry{"AUTO_UPDATE_MAX_KBPS", strconv.Itoa(s.AutoMaxKbps)},
+		confEntry{"UPDATE_SOURCES", formatSources(sources)},
+		confEntry{"DOWNLOAD_DIR", filepath.Clean(s.DownloadDir)},
+	); err != nil {
+		return err
+	}
+	u.InvalidateCache()
+	return nil
+}
+
+// Releases lists recent client and manager releases, including
+// pre-releases, with the ones that would be installed by default marked.
+func (u *Updater) Releases() *ReleaseList {
+	out := &ReleaseList{Channel: u.Settings().Channel}
+
+	prefix, suffix := clientAssetPattern()
+	list, err := u.releaseInfos(clientRepo, detectClientVersion(), func(r *githubRelease) bool {
+		return r.hasAsset(prefix, suffix)
+	})
+	if err != nil {
+		out.ClientError = err.Error()
+	}
+	out.Client = list
+
+	name := managerAssetName()
+	list, err = u.releaseInfos(managerRepo, managerVersion(), func(r *githubRelease) bool {
+		return r.hasAsset(name, "")
+	})
+	if err != nil {
+		out.ManagerError = err.Error()
+	}
+	out.Manager = list
+	return out
+}
+
+func (u *Updater) releaseInfos(repo, current string, hasAsset func(*githubRelease) bool) ([]ReleaseInfo, error) {
+	releases, err := u.listReleases(repo)
+	if err != nil {
+		return []ReleaseInfo{}, err
+	}
+	latest := ""
+	if rel, err := u.fetchLatestRelease(repo); err == nil {
+		latest = rel.TagName
+	}
+	list := make([]ReleaseInfo, 0, len(releases))
+	for i := range releases {
+		r := &releases[i]
+		if r.Draft {
+			continue
+		}
+		list = append(list, ReleaseInfo{
+			Tag:         r.TagName,
+			Name:        r.Name,
+			PublishedAt: r.PublishedAt,
+			Prerelease:  r.Prerelease,
+			HasAsset:    hasAsset(r),
+			Current:     r.TagName == current,
+			Latest:      r.TagName == latest,
+		})
+	}
+	return list, nil
+}
+
+func (r *githubRelease) hasAsset(prefix, suffix string) bool {
+	for _, a := range r.Assets {
+		if strings.HasPrefix(a.Name, prefix) && (suffix == "" || strings.HasSuffix(a.Name, suffix)) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAssetPattern returns the name prefix and suffix of the client
+// archive built for this router.
+func clientAssetPattern() (string, string) {
+	return "trusttunnel_client", fmt.Sprintf("-linux-%s.tar.gz", detectArch())
+}
+
+func managerAssetName() string {
+	return fmt.Sprintf("trusttunnel-manager-linux-%s", detectArch())
+}
+
+// ValidTag reports whether tag looks like a release tag. Empty is allowed.
+func ValidTag(tag string) bool {
+	if len(tag) > 64 {
+		return false
+	}
+	for _, r := range tag {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '.', r == '-', r == '_', r == '+':
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -10,6 +10,7 @@ import (
 const (
 	clientConfigPath = "/opt/trusttunnel_client/trusttunnel_client.toml"
 	modeConfigPath   = "/opt/trusttunnel_client/mode.conf"
+	defaultSocksPort = 1080
 )
 
 type AllConfig struct {
@@ -22,6 +23,8 @@ type ModeInfo struct {
 	Mode     string `json:"mode"`
 	TunIdx   int    `json:"tun_idx"`
 	ProxyIdx int    `json:"proxy_idx"`
+	// SocksPort is the local SOCKS5 listener port of the client
+	SocksPort int `json:"socks_port"`
 	// Health check settings
 	HCEnabled       string `json:"hc_enabled"`
 	HCInterval      int    `json:"hc_interval"`
@@ -32,20 +35,46 @@ type ModeInfo struct {
 	HCSocks5Proxy   string `json:"hc_socks5_proxy"`
 	// Smart routing settings
 	SREnabled     string `json:"sr_enabled"`
+	SRPolicy      string `json:"sr_policy"`
 	SRHomeCountry string `json:"sr_home_country"`
 	SRDNSPort     int    `json:"sr_dns_port"`
 	SRDNSUpstream string `json:"sr_dns_upstream"`
+	// DNS leak protection (TUN mode)
+	DNSPolicy   string `json:"dns_policy"`
+	DNSBlockDoT string `json:"dns_block_dot"`
+	// DNSLanIface lists the LAN bridges whose DNS is redirected
+	DNSLanIface string `json:"dns_lan_iface"`
+	// Endpoint failover
+	FOEnabled       string `json:"fo_enabled"`
+	FOSource        string `json:"fo_source"`
+	FOProfiles      string `json:"fo_profiles"`
+	FOThreshold     int    `json:"fo_threshold"`
+	FOFailback      string `json:"fo_failback"`
+	FOFailbackAfter int    `json:"fo_failback_after"`
+	// Endpoint address prober
+	EPProbeAuto       string `json:"ep_probe_auto"`
+	EPProbeInterval   int    `json:"ep_probe_interval"`
+	EPProbeHysteresis int    `json:"ep_probe_hysteresis"`
 }
 
-type ConfigManager struct{}
+// ConfigManager reads and writes the client TOML and mode.conf of a single
+// tunnel instance.
+type ConfigManager struct {
+	clientConfig string
+	modeConfig   string
+}
 
+// NewConfigManager returns the config manager of the default instance.
 func NewConfigManager() *ConfigManager {
-	return &ConfigManager{}
+	return &ConfigManager{
+		clientConfig: clientConfigPath,
+		modeConfig:   modeConfigPath,
+	}
 }
 
 func (c *ConfigManager) ReadAll() (*AllConfig, error) {
-	clientCfg, _ := os.ReadFile(clientConfigPath)
-	modeCfg, _ := os.ReadFile(modeConfigPath)
+	clientCfg, _ := os.ReadFile(c.clientConfig)
+	modeCfg, _ := os.ReadFile(c.modeConfig)
 
 	mode, _ := c.ReadMode()
 
@@ -58,12 +87,12 @@ func (c *ConfigManager) ReadAll() (*AllConfig, error) {
 
 func (c *ConfigManager) WriteAll(clientConfig, modeConfig string) error {
 	if clientConfig != "" {
-		if err := os.WriteFile(clientConfigPath, []byte(clientConfig), 0644); err != nil {
+		if err := os.WriteFile(c.clientConfig, []byte(clientConfig), 0644); err != nil {
 			return fmt.Errorf("write client config: %w", err)
 		}
 	}
 	if modeConfig != "" {
-		if err := os.WriteFile(modeConfigPath, []byte(modeConfig), 0644); err != nil {
+		if err := os.WriteFile(c.modeConfig, []byte(modeConfig), 0644); err != nil {
 			return fmt.Errorf("write mode config: %w", err)
 		}
 	}
@@ -71,13 +100,14 @@ func (c *ConfigManager) WriteAll(clientConfig, modeConfig string) error {
 }
 
 func (c *ConfigManager) ReadMode() (*ModeInfo, error) {
-	data, err := os.ReadFile(modeConfigPath)
+	data, err := os.ReadFile(c.modeConfig)
 	if err != nil {
-		return &ModeInfo{Mode: "socks5"}, nil
+		return &ModeInfo{Mode: "socks5", SocksPort: defaultSocksPort}, nil
 	}
 
 	info := &ModeInfo{
 		Mode:            "socks5",
+		SocksPort:       defaultSocksPort,
 		HCEnabled:       "yes",
 		HCInterval:      30,
 		HCFailThreshold: 3,
@@ -89,6 +119,17 @@ func (c *ConfigManager) ReadMode() (*ModeInfo, error) {
 		SRHomeCountry:   "RU",
 		SRDNSPort:       5354,
 		SRDNSUpstream:   "1.1.1.1",
+		DNSPolicy:       "off",
+		DNSBlockDoT:     "no",
+		DNSLanIface:     "br0",
+		FOEnabled:       "no",
+		FOSource:        "addresses",
+		FOThreshold:     2,
+		FOFailback:      "no",
+		FOFailbackAfter: 600,
+		EPProbeAuto:       "no",
+		EPProbeInterval:   600,
+		EPProbeHysteresis: 20,
 	}
 
 	for _, line := range strings.Split(string(data), "\n") {
@@ -110,6 +151,8 @@ func (c *ConfigManager) ReadMode() (*ModeInfo, error) {
 			info.TunIdx, _ = strconv.Atoi(val)
 		case "PROXY_IDX":
 			info.ProxyIdx, _ = strconv.Atoi(val)
+		case "SOCKS_PORT":
+			info.SocksPort, _ = strconv.Atoi(val)
 		case "HC_ENABLED":
 			info.HCEnabled = val
 		case "HC_INTERVAL":
@@ -126,20 +169,48 @@ func (c *ConfigManager) ReadMode() (*ModeInfo, error) {
 			info.HCSocks5Proxy = val
 		case "SR_ENABLED":
 			info.SREnabled = val
+		case "SR_POLICY":
+			info.SRPolicy = val
 		case "SR_HOME_COUNTRY":
 			info.SRHomeCountry = val
 		case "SR_DNS_PORT":
 			info.SRDNSPort, _ = strconv.Atoi(val)
 		case "SR_DNS_UPSTREAM":
 			info.SRDNSUpstream = val
+		case "DNS_POLICY":
+			info.DNSPolicy = val
+		case "DNS_BLOCK_DOT":
+			info.DNSBlockDoT = val
+		case "DNS_LAN_IFACE":
+			info.DNSLanIface = val
+		case "FO_ENABLED":
+			info.FOEnabled = val
+		case "FO_SOURCE":
+			info.FOSource = val
+		case "FO_PROFILES":
+			info.FOProfiles = val
+		case "FO_THRESHOLD":
+			info.FOThreshold, _ = strconv.Atoi(val)
+		case "FO_FAILBACK":
+			info.FOFailback = val
+		case "FO_FAILBACK_AFTER":
+			info.FOFailbackAfter, _ = strconv.Atoi(val)
+		case "EP_PROBE_AUTO":
+			info.EPProbeAuto = val
+		case "EP_PROBE_INTERVAL":
+			info.EPProbeInterval, _ = strconv.Atoi(val)
+		case "EP_PROBE_HYSTERESIS":
+			info.EPProbeHysteresis, _ = strconv.Atoi(val)
 		}
 	}
 
 	return info, nil
 }
 
-func (c *ConfigManager) WriteSRConfig(enabled, homeCountry, dnsUpstream string, dnsPort int) error {
-	existing, _ := os.ReadFile(modeConfigPath)
+// WriteSRConfig stores the smart routing settings; policy is
+// "tunnel_default" or "direct_default".
+func (c *ConfigManager) WriteSRConfig(enabled, policy, homeCountry, dnsUpstream string, dnsPort int) error {
+	existing, _ := os.ReadFile(c.modeConfig)
 
 	var content string
 	if len(existing) > 0 {
@@ -154,7 +225,7 @@ func (c *ConfigManager) WriteSRConfig(enabled, homeCountry, dnsUpstream string,
 			}
 			key := strings.TrimSpace(parts[0])
 			switch key {
-			case "SR_ENABLED", "SR_HOME_COUNTRY", "SR_DNS_PORT", "SR_DNS_UPSTREAM":
+			case "SR_ENABLED", "SR_POLICY", "SR_HOME_COUNTRY", "SR_DNS_PORT", "SR_DNS_UPSTREAM":
 				continue
 			default:
 				content += line + "\n"
@@ -163,17 +234,116 @@ func (c *ConfigManager) WriteSRConfig(enabled, homeCountry, dnsUpstream string,
 	}
 
 	content += fmt.Sprintf("SR_ENABLED=\"%s\"\n", enabled)
+	content += fmt.Sprintf("SR_POLICY=\"%s\"\n", policy)
 	content += fmt.Sprintf("SR_HOME_COUNTRY=\"%s\"\n", homeCountry)
 	content += fmt.Sprintf("SR_DNS_PORT=\"%d\"\n", dnsPort)
 	content += fmt.Sprintf("SR_DNS_UPSTREAM=\"%s\"\n", dnsUpstream)
 
-	return os.WriteFile(modeConfigPath, []byte(content), 0644)
+	return os.WriteFile(c.modeConfig, []byte(content), 0644)
+}
+
+// WriteDNSConfig stores the DNS leak protection policy ("off" or "redirect"),
+// whether DNS-over-TLS (port 853) from LAN clients should be blocked and
+// the LAN bridges it applies to (space-separated).
+func (c *ConfigManager) WriteDNSConfig(policy, blockDoT, lanIface string) error {
+	return c.rewriteModeConf(
+		confEntry{"DNS_POLICY", policy},
+		confEntry{"DNS_BLOCK_DOT", blockDoT},
+		confEntry{"DNS_LAN_IFACE", lanIface},
+	)
+}
+
+// WriteFailoverConfig stores the endpoint failover policy. source is
+// "addresses" (rotate [endpoint] addresses) or "profiles" (switch between
+// endpoint profiles listed in profiles, space-separated).
+func (c *ConfigManager) WriteFailoverConfig(enabled, source, profiles string, threshold int, failback string, failbackAfter int) error {
+	return c.rewriteModeConf(
+		confEntry{"FO_ENABLED", enabled},
+		confEntry{"FO_SOURCE", source},
+		confEntry{"FO_PROFILES", profiles},
+		confEntry{"FO_THRESHOLD", strconv.Itoa(threshold)},
+		confEntry{"FO_FAILBACK", failback},
+		confEntry{"FO_FAILBACK_AFTER", strconv.Itoa(failbackAfter)},
+	)
+}
+
+// WriteProbeConfig stores the endpoint prober policy: automatic reordering,
+// probe interval in seconds and the hysteresis margin in percent.
+func (c *ConfigManager) WriteProbeConfig(auto string, interval, hysteresis int) error {
+	return c.rewriteModeConf(
+		confEntry{"EP_PROBE_AUTO", auto},
+		confEntry{"EP_PROBE_INTERVAL", strconv.Itoa(interval)},
+		confEntry{"EP_PROBE_HYSTERESIS", strconv.Itoa(hysteresis)},
+	)
+}
+
+type confEntry struct {
+	key   string
+	value string
+}
+
+// rewriteModeConf replaces the given keys in mode.conf, keeping all other
+// settings, and appends the new values at the end of the file.
+func (c *ConfigManager) rewriteModeConf(entries ...confEntry) error {
+	return rewriteConfFile(c.modeConfig, entries...)
+}
+
+// rewriteConfFile replaces or appends KEY="value" entries in a shell-style
+// config file, keeping other keys.
+func rewriteConfFile(path string, entries ...confEntry) error {
+	replaced := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		replaced[e.key] = true
+	}
+
+	existing, _ := os.ReadFile(path)
+
+	var content string
+	for _, line := range strings.Split(string(existing), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		if replaced[strings.TrimSpace(parts[0])] {
+			continue
+		}
+		content += line + "\n"
+	}
+
+	for _, e := range entries {
+		content += fmt.Sprintf("%s=\"%s\"\n", e.key, e.value)
+	}
+
+	return os.WriteFile(path, []byte(content), 0644)
+}
+
+// readConfFile parses a shell-style KEY="value" file.
+func readConfFile(path string) map[string]string {
+	values := make(map[string]string)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return values
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if k, v, ok := strings.Cut(line, "="); ok {
+			values[strings.TrimSpace(k)] = strings.Trim(strings.TrimSpace(v), "\"")
+		}
+	}
+	return values
 }
 
 // SyncVpnMode ensures the client TOML has the correct listener section for the
 // selected mode (tun/socks5) and that vpn_mode is set (default "general").
 func (c *ConfigManager) SyncVpnMode(mode string) error {
-	data, _ := os.ReadFile(clientConfigPath)
+	data, _ := os.ReadFile(c.clientConfig)
 	if len(data) == 0 {
 		return nil
 	}
@@ -192,13 +362,18 @@ func (c *ConfigManager) SyncVpnMode(mode string) error {
 
 	content = strings.TrimRight(content, "\n") + "\n"
 
+	socksPort := defaultSocksPort
+	if info, _ := c.ReadMode(); info != nil && info.SocksPort > 0 {
+		socksPort = info.SocksPort
+	}
+
 	if mode == "tun" {
 		content += "\n[listener.tun]\nmtu_size = 1280\n"
 	} else {
-		content += "\n[listener.socks]\naddress = \"127.0.0.1:1080\"\n"
+		content += fmt.Sprintf("\n[listener.socks]\naddress = \"127.0.0.1:%d\"\n", socksPort)
 	}
 
-	return os.WriteFile(clientConfigPath, []byte(content), 0644)
+	return os.WriteFile(c.clientConfig, []byte(content), 0644)
 }
 
 func ensureVpnMode(content string) string {
@@ -314,6 +489,239 @@ func ensureEndpointSection(content string) string {
 	return strings.Join(result, "\n")
 }
 
+// EndpointHasIPv6 reports whether has_ipv6 is enabled in the [endpoint]
+// section of the client TOML.
+func (c *ConfigManager) EndpointHasIPv6() bool {
+	data, _ := os.ReadFile(c.clientConfig)
+	content := ensureEndpointSection(string(data))
+	return tomlSectionValue(content, "[endpoint]", "has_ipv6") == "true"
+}
+
+// EndpointHostname returns the TLS server name of the [endpoint] section.
+func (c *ConfigManager) EndpointHostname() string {
+	data, _ := os.ReadFile(c.clientConfig)
+	return tomlSectionValue(ensureEndpointSection(string(data)), "[endpoint]", "hostname")
+}
+
+// EndpointAddresses returns the addresses array of the [endpoint] section.
+func (c *ConfigManager) EndpointAddresses() []string {
+	data, _ := os.ReadFile(c.clientConfig)
+	return tomlSectionArray(ensureEndpointSection(string(data)), "[endpoint]", "addresses")
+}
+
+// SetEndpointAddresses rewrites the addresses array of the [endpoint] section.
+func (c *ConfigManager) SetEndpointAddresses(addrs []string) error {
+	data, err := os.ReadFile(c.clientConfig)
+	if err != nil {
+		return fmt.Errorf("read client config: %w", err)
+	}
+	content := ensureEndpointSection(string(data))
+	content = setTomlSectionValue(content, "[endpoint]", "addresses", formatTomlStringArray(addrs))
+	return os.WriteFile(c.clientConfig, []byte(content), 0644)
+}
+
+// EndpointSection returns the [endpoint] section of the client TOML.
+func (c *ConfigManager) EndpointSection() string {
+	data, _ := os.ReadFile(c.clientConfig)
+	return extractTomlSection(ensureEndpointSection(string(data)), "[endpoint]")
+}
+
+// ReplaceEndpointSection swaps the [endpoint] section for the given one,
+// keeping the rest of the client TOML intact.
+func (c *ConfigManager) ReplaceEndpointSection(section string) error {
+	data, err := os.ReadFile(c.clientConfig)
+	if err != nil {
+		return fmt.Errorf("read client config: %w", err)
+	}
+	content := removeTomlSection(ensureEndpointSection(string(data)), "[endpoint]")
+	content = strings.TrimRight(content, "\n") + "\n\n" + strings.TrimSpace(section) + "\n"
+	return os.WriteFile(c.clientConfig, []byte(content), 0644)
+}
+
+// tomlSectionValue returns the raw value of a single-line key inside the
+// given section, without surrounding quotes. Returns "" if not found.
+func tomlSectionValue(content, section, key string) string {
+	inSection := false
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if strings.HasPrefix(trimmed, "[") {
+			inSection = trimmed == section
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		eqIdx := strings.Index(trimmed, "=")
+		if eqIdx <= 0 || strings.TrimSpace(trimmed[:eqIdx]) != key {
+			continue
+		}
+		val := strings.TrimSpace(trimmed[eqIdx+1:])
+		if idx := strings.Index(val, " #"); idx >= 0 {
+			val = strings.TrimSpace(val[:idx])
+		}
+		return strings.Trim(val, "\"")
+	}
+	return ""
+}
+
+// tomlSectionArray returns the string elements of an array key inside the
+// given section. Arrays may span several lines.
+func tomlSectionArray(content, section, key string) []string {
+	inSection := false
+	collecting := false
+	var raw string
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if collecting {
+			raw += " " + trimmed
+			if strings.Contains(trimmed, "]") {
+				break
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "[") && !strings.Contains(trimmed, "=") {
+			inSection = trimmed == section
+			continue
+		}
+		if !inSection {
+			continue
+		}
+		eqIdx := strings.Index(trimmed, "=")
+		if eqIdx <= 0 || strings.TrimSpace(trimmed[:eqIdx]) != key {
+			continue
+		}
+		raw = strings.TrimSpace(trimmed[eqIdx+1:])
+		if !strings.Contains(raw, "]") {
+			collecting = true
+			continue
+		}
+		break
+	}
+	return parseTomlStringArray(raw)
+}
+
+// parseTomlStringArray parses `["a", "b"]` into its elements.
+func parseTomlStringArray(raw string) []string {
+	raw = strings.TrimSpace(raw)
+	raw = strings.TrimPrefix(raw, "[")
+	if idx := strings.LastIndex(raw, "]"); idx >= 0 {
+		raw = raw[:idx]
+	}
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.Trim(strings.TrimSpace(part), "\"'")
+		if part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+func formatTomlStringArray(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = fmt.Sprintf("%q", v)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
+
+// setTomlSectionValue sets key = raw inside the given section, replacing an
+// existing (possibly multi-line array) value or appending the key to the end
+// of the section. The section must exist.
+func setTomlSectionValue(content, section, key, raw string) string {
+	lines := strings.Split(content, "\n")
+	var result []string
+	inSection := false
+	skipping := false
+	done := false
+	insertAt := -1
+
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if skipping {
+			if strings.Contains(trimmed, "]") {
+				skipping = false
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "[") && !strings.Contains(trimmed, "=") {
+			if inSection && !done {
+				insertAt = len(result)
+			}
+			inSection = trimmed == section
+			result = append(result, line)
+			continue
+		}
+		if inSection && !done {
+			if eqIdx := strings.Index(trimmed, "="); eqIdx > 0 && strings.TrimSpace(trimmed[:eqIdx]) == key {
+				result = append(result, key+" = "+raw)
+				done = true
+				val := strings.TrimSpace(trimmed[eqIdx+1:])
+				if strings.HasPrefix(val, "[") && !strings.Contains(val, "]") {
+					skipping = true
+				}
+				continue
+			}
+		}
+		result = append(result, line)
+	}
+
+	if done {
+		return strings.Join(result, "\n")
+	}
+	if insertAt < 0 {
+		if !inSection {
+			return content
+		}
+		insertAt = len(result)
+		for insertAt > 0 && strings.TrimSpace(result[insertAt-1]) == "" {
+			insertAt--
+		}
+	} else {
+		for insertAt > 0 && strings.TrimSpace(result[insertAt-1]) == "" {
+			insertAt--
+		}
+	}
+	result = append(result[:insertAt], append([]string{key + " = " + raw}, result[insertAt:]...)...)
+	return strings.Join(result, "\n")
+}
+
+// extractTomlSection returns the section header and its lines up to the next
+// section header, or "" if the section is absent.
+func extractTomlSection(content, section string) string {
+	var out []string
+	inSection := false
+	inMultiline := false
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if inMultiline {
+			if inSection {
+				out = append(out, line)
+			}
+			if strings.Contains(trimmed, `"""`) {
+				inMultiline = false
+			}
+			continue
+		}
+		if strings.HasPrefix(trimmed, "[") && !strings.Contains(trimmed, "=") {
+			if inSection {
+				break
+			}
+			inSection = trimmed == section
+		}
+		if inSection {
+			out = append(out, line)
+			if eqIdx := strings.Index(trimmed, "="); eqIdx > 0 {
+				val := strings.TrimSpace(trimmed[eqIdx+1:])
+				if strings.HasPrefix(val, `"""`) && !strings.HasSuffix(val, `"""`) {
+					inMultiline = true
+				}
+			}
+		}
+	}
+	return strings.TrimRight(strings.Join(out, "\n"), "\n ")
+}
+
 // removeTomlSection removes a TOML section header and all its key-value lines
 // up to the next section header or end of file.
 func removeTomlSection(content, section string) string {
@@ -366,7 +774,7 @@ TUN_IDX="%d"
 PROXY_IDX="%d"
 `, mode, tunIdx, proxyIdx)
 
-	existing, _ := os.ReadFile(modeConfigPath)
+	existing, _ := os.ReadFile(c.modeConfig)
 	if len(existing) > 0 {
 		for _, line := range strings.Split(string(existing), "\n") {
 			line = strings.TrimSpace(line)
@@ -387,6 +795,6 @@ PROXY_IDX="%d"
 		}
 	}
 
-	return os.WriteFile(modeConfigPath, []byte(content), 0644)
+	return os.WriteFile(c.modeConfig, []byte(content), 0644)
 }
 
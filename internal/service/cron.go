@@ -0,0 +1,125 @@
+package service
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cronSpec is a parsed five-field cron expression: minute, hour, day of
+// month, month and day of week. Fields accept "*", numbers, ranges
+// ("1-5"), steps ("*/15", "8-18/2") and lists; months and weekdays also
+// accept English names ("jan", "mon"). As in cron, when both day fields
+// are restricted a day matching either of them matches.
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	domAny, dowAny                bool
+}
+
+var (
+	cronMonths   = []string{"", "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"}
+	cronWeekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+)
+
+func parseCron(expr string) (*cronSpec, error) {
+	f := strings.Fields(expr)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("cron %q: need 5 fields (minute hour day month weekday)", expr)
+	}
+	var c cronSpec
+	var err error
+	if c.minute, err = parseCronField(f[0], 0, 59, nil); err != nil {
+		return nil, fmt.Errorf("cron minute: %w", err)
+	}
+	if c.hour, err = parseCronField(f[1], 0, 23, nil); err != nil {
+		return nil, fmt.Errorf("cron hour: %w", err)
+	}
+	if c.dom, err = parseCronField(f[2], 1, 31, nil); err != nil {
+		return nil, fmt.Errorf("cron day of month: %w", err)
+	}
+	if c.month, err = parseCronField(f[3], 1, 12, cronMonths); err != nil {
+		return nil, fmt.Errorf("cron month: %w", err)
+	}
+	// 7 is Sunday too
+	if c.dow, err = parseCronField(f[4], 0, 7, cronWeekdays); err != nil {
+		return nil, fmt.Errorf("cron weekday: %w", err)
+	}
+	if c.dow&(1<<7) != 0 {
+		c.dow |= 1
+	}
+	c.domAny = f[2] == "*"
+	c.dowAny = f[4] == "*"
+	return &c, nil
+}
+
+// parseCronField returns the allowed values of a field as a bit mask.
+func parseCronField(field string, lo, hi int, names []string) (uint64, error) {
+	var mask uint64
+	for _, part := range strings.Split(field, ",") {
+		rng, stepStr, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepStr)
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step %q", stepStr)
+			}
+			step = n
+		}
+		from, to := lo, hi
+		if rng != "*" {
+			a, b, isRange := strings.Cut(rng, "-")
+			var err error
+			if from, err = cronValue(a, lo, hi, names); err != nil {
+				return 0, err
+			}
+			to = from
+			if isRange {
+				if to, err = cronValue(b, lo, hi, names); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				to = hi
+			}
+			if to < from {
+				return 0, fmt.Errorf("invalid range %q", rng)
+			}
+		}
+		for v := from; v <= to; v += step {
+			mask |= 1 << uint(v)
+		}
+	}
+	return mask, nil
+}
+
+func cronValue(s string, lo, hi int, names []string) (int, error) {
+	for i, n := range names {
+		if n != "" && strings.EqualFold(s, n) {
+			return i, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < lo || v > hi {
+		return 0, fmt.Errorf("invalid value %q (%d-%d)", s, lo, hi)
+	}
+	return v, nil
+}
+
+// matches reports whether the expression fires at the minute of t.
+func (c *cronSpec) matches(t time.Time) bool {
+	if c.minute&(1<<uint(t.Minute())) == 0 || c.hour&(1<<uint(t.Hour())) == 0 ||
+		c.month&(1<<uint(t.Month())) == 0 {
+		return false
+	}
+	dom := c.dom&(1<<uint(t.Day())) != 0
+	dow := c.dow&(1<<uint(t.Weekday())) != 0
+	switch {
+	case c.domAny && c.dowAny:
+		return true
+	case c.domAny:
+		return dow
+	case c.dowAny:
+		return dom
+	}
+	return dom || dow
+}
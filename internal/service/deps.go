@@ -0,0 +1,99 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+)
+
+// Dependency is an Entware package needed by smart routing.
+type Dependency struct {
+	// Name is the opkg package name
+	Name      string `json:"name"`
+	Required  bool   `json:"required"`
+	Installed bool   `json:"installed"`
+	// Version is empty when the command is provided by the firmware
+	Version string `json:"version,omitempty"`
+
+	// command satisfies the dependency when found in PATH; empty when only
+	// the package will do (busybox ships a reduced ip and dnsmasq)
+	command string
+}
+
+// DepsStatus lists the smart-routing dependencies; Ready is set when all
+// required ones are installed.
+type DepsStatus struct {
+	FWBackend string       `json:"fw_backend"`
+	Deps      []Dependency `json:"deps"`
+	Ready     bool         `json:"ready"`
+	Missing   []string     `json:"missing,omitempty"`
+}
+
+// CheckDeps reports the smart-routing dependencies for the firewall backend
+// ("iptables" or "nftables"). ipset is required with iptables, nft with a
+// pure nftables firewall, mirroring sr_check_deps.
+func CheckDeps(fwBackend string) *DepsStatus {
+	nft := fwBackend == "nftables"
+	deps := []Dependency{
+		{Name: "curl", Required: true, command: "curl"},
+		{Name: "dnsmasq-full", Required: true},
+		{Name: "ipset", Required: !nft, command: "ipset"},
+		{Name: "nftables", Required: nft, command: "nft"},
+		{Name: "ip-full"},
+	}
+
+	installed := opkgInstalled()
+	st := &DepsStatus{FWBackend: fwBackend, Ready: true}
+	for i := range deps {
+		d := &deps[i]
+		if v, ok := installed[d.Name]; ok {
+			d.Installed, d.Version = true, v
+		} else if d.command != "" {
+			_, err := exec.LookPath(d.command)
+			d.Installed = err == nil
+		}
+		if d.Required && !d.Installed {
+			st.Ready = false
+			st.Missing = append(st.Missing, d.Name)
+		}
+	}
+	st.Deps = deps
+	return st
+}
+
+// InstallDeps installs the given packages, or the missing required ones
+// when none are given, with opkg. Output is streamed to the job log.
+func InstallDeps(ctx context.Context, j *Job, fwBackend string, names []string) (*DepsStatus, error) {
+	st := CheckDeps(fwBackend)
+	if len(names) == 0 {
+		names = st.Missing
+	}
+	known := make(map[string]bool, len(st.Deps))
+	for _, d := range st.Deps {
+		known[d.Name] = true
+	}
+	for _, n := range names {
+		if !known[n] {
+			return nil, fmt.Errorf("unknown package %q", n)
+		}
+	}
+	if len(names) == 0 {
+		j.Logf("all required packages are installed")
+		return st, nil
+	}
+
+	if err := runLogged(ctx, j, "opkg", "update"); err != nil {
+		return nil, err
+	}
+	j.SetProgress(30)
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	// Interrupting opkg halfway would leave dnsmasq-full, which replaces
+	// the firmware dnsmasq, half installed, so only opkg update is cancelled
+	if err := runLogged(context.WithoutCancel(ctx), j, "opkg", append([]string{"install"}, names...)...); err != nil {
+		return nil, err
+	}
+	j.SetProgress(100)
+	return CheckDeps(fwBackend), nil
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultDownloadDir = "/tmp"
+	// downloadReserve is kept free on the target filesystem so a download
+	// never fills a RAM disk completely.
+	downloadReserve = 2 << 20
+	// downloadIdleTimeout aborts a download that stops receiving data.
+	downloadIdleTimeout = 60 * time.Second
+	downloadAttempts    = 3
+)
+
+// downloadDir returns the configured DOWNLOAD_DIR, creating it if needed.
+func (u *Updater) downloadDir() (string, error) {
+	dir := u.Settings().DownloadDir
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", fmt.Errorf("download dir: %w", err)
+	}
+	return dir, nil
+}
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem holding path.
+func freeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// ensureSpace fails when need bytes (plus a reserve) do not fit into dir.
+func ensureSpace(dir string, need int64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		log.Printf("[update] statfs %s: %v", dir, err)
+		return nil
+	}
+	if need+downloadReserve > free {
+		return fmt.Errorf("not enough space in %s: need %s, free %s (set DOWNLOAD_DIR to a larger disk)",
+			dir, formatBytes(need), formatBytes(free))
+	}
+	return nil
+}
+
+// download fetches url into dir/name and returns the path. An interrupted
+// download is kept as name.part and resumed with an HTTP Range request on
+// the next attempt, also across calls. Progress goes to the job, if any.
+func (u *Updater) download(ctx context.Context, j *Job, src releaseSource, url, name string, size int64) (string, error) {
+	dir, err := u.downloadDir()
+	if err != nil {
+		return "", err
+	}
+	dest := filepath.Join(dir, name)
+	part := dest + ".part"
+
+	// A partial file is only resumed for the same URL
+	if prev := strings.TrimSpace(readFileStr(part + ".url")); prev != url {
+		os.Remove(part)
+		os.WriteFile(part+".url", []byte(url+"\n"), 0644)
+	}
+
+	for attempt := 1; ; attempt++ {
+		err = u.downloadOnce(ctx, j, src, url, part, size)
+		if err == nil || ctx.Err() != nil || attempt == downloadAttempts {
+			break
+		}
+		j.Logf("download interrupted: %v, retrying", err)
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Duration(attempt) * 2 * time.Second):
+		}
+	}
+	if err != nil {
+		return "", err
+	}
+
+	os.Remove(part + ".url")
+	if err := os.Rename(part, dest); err != nil {
+		return "", err
+	}
+	return dest, nil
+}
+
+func (u *Updater) downloadOnce(ctx context.Context, j *Job, src releaseSource, url, part string, size int64) error {
+	var offset int64
+	if fi, err := os.Stat(part); err == nil {
+		offset = fi.Size()
+	}
+	if size > 0 && offset > size {
+		os.Remove(part)
+		offset = 0
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+	idle := time.AfterFunc(downloadIdleTimeout, cancel)
+	defer idle.Stop()
+
+	header := http.Header{}
+	if offset > 0 {
+		header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	resp, err := src.getContext(ctx, url, 0, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		flags |= os.O_APPEND
+		j.Logf("resuming download at %s", formatBytes(offset))
+	case resp.StatusCode == http.StatusOK:
+		flags |= os.O_TRUNC
+		offset = 0
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0 && offset == size:
+		return nil
+	default:
+		return fmt.Errorf("HTTP %d %s", resp.StatusCode, resp.Status)
+	}
+
+	total := size
+	if resp.ContentLength > 0 {
+		total = offset + resp.ContentLength
+	}
+	if total > 0 {
+		if err := ensureSpace(filepath.Dir(part), total-offset); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	done := offset
+	lastPct := -1
+	buf := make([]byte, 32<<10)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			idle.Reset(downloadIdleTimeout)
+			if _, err := f.Write(buf[:n]); err != nil {
+				return err
+			}
+			done += int64(n)
+			if pct := int(done * 100 / max(total, 1)); total > 0 && pct != lastPct {
+				if pct/10 != lastPct/10 {
+					j.Logf("downloaded %s of %s", formatBytes(done), formatBytes(total))
+				}
+				lastPct = pct
+				j.SetProgress(pct)
+			}
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			if parent.Err() == nil && ctx.Err() != nil {
+				return fmt.Errorf("no data for %s", downloadIdleTimeout)
+			}
+			return rerr
+		}
+	}
+	if total > 0 && done != total {
+		return fmt.Errorf("short download: %d of %d bytes", done, total)
+	}
+	log.Printf("[update] saved %d bytes to %s", done, part)
+	return nil
+}
+
+func formatBytes(n int64) string {
+	switch {
+	case n >= 1<<20:
+		return strconv.FormatFloat(float64(n)/(1<<20), 'f', 1, 64) + " MB"
+	case n >= 1<<10:
+		return strconv.FormatFloat(float64(n)/(1<<10), 'f', 0, 64) + " KB"
+	}
+	return strconv.FormatInt(n, 10) + " B"
+}
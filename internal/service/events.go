@@ -0,0 +1,119 @@
+package service
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	eventsPath     = "/opt/var/log/trusttunnel_events.log"
+	maxEvents      = 200
+	maxEventsBytes = 256 * 1024
+)
+
+type Event struct {
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	Instance string    `json:"instance,omitempty"`
+	Message  string    `json:"message"`
+	Reason   string    `json:"reason,omitempty"`
+}
+
+// EventLog keeps the most recent manager events in memory and appends them
+// to a JSON-lines file so they survive manager restarts.
+type EventLog struct {
+	mu     sync.Mutex
+	path   string
+	events []Event
+}
+
+func NewEventLog() *EventLog {
+	l := &EventLog{path: eventsPath}
+	l.load()
+	return l
+}
+
+func (l *EventLog) load() {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err == nil {
+			l.events = append(l.events, e)
+		}
+	}
+	if len(l.events) > maxEvents {
+		l.events = l.events[len(l.events)-maxEvents:]
+	}
+}
+
+// Add records an event. A nil EventLog is valid and only logs the event.
+func (l *EventLog) Add(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	log.Printf("[event] %s: %s (%s)", e.Type, e.Message, e.Reason)
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.events = append(l.events, e)
+	if len(l.events) > maxEvents {
+		l.events = l.events[len(l.events)-maxEvents:]
+	}
+	l.persist(e)
+}
+
+func (l *EventLog) persist(e Event) {
+	if info, err := os.Stat(l.path); err == nil && info.Size() > maxEventsBytes {
+		l.rewrite()
+		return
+	}
+
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	json.NewEncoder(f).Encode(e)
+}
+
+// rewrite replaces the file with the in-memory tail.
+func (l *EventLog) rewrite() {
+	f, err := os.Create(l.path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
+	for _, e := range l.events {
+		enc.Encode(e)
+	}
+}
+
+// List returns up to limit most recent events, newest first.
+func (l *EventLog) List(limit int) []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if limit <= 0 || limit > len(l.events) {
+		limit = len(l.events)
+	}
+	out := make([]Event, 0, limit)
+	for i := len(l.events) - 1; i >= 0 && len(out) < limit; i-- {
+		out = append(out, l.events[i])
+	}
+	return out
+}
@@ -0,0 +1,403 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// profilesDir holds alternative endpoint profiles used by the "profiles"
+	// failover source: <name>.toml, each with an [endpoint] section.
+	profilesDir       = "/opt/trusttunnel_client/profiles"
+	failoverStateName = "failover_state.json"
+	failoverInterval  = 15 * time.Second
+	failoverDialTO    = 3 * time.Second
+	primaryEntryName  = "primary"
+)
+
+// FailoverState is persisted next to the instance mode.conf so the active
+// entry survives manager restarts.
+type FailoverState struct {
+	Source  string   `json:"source"`
+	Entries []string `json:"entries"`
+	Active  int      `json:"active"`
+	// PrimaryEndpoint is the original [endpoint] section, saved before the
+	// first switch to another profile.
+	PrimaryEndpoint string    `json:"primary_endpoint,omitempty"`
+	SwitchedAt      time.Time `json:"switched_at,omitempty"`
+	Reason          string    `json:"reason,omitempty"`
+}
+
+type FailoverStatus struct {
+	Instance      string     `json:"instance"`
+	Enabled       bool       `json:"enabled"`
+	Source        string     `json:"source"`
+	Entries       []string   `json:"entries"`
+	Active        int        `json:"active"`
+	ActiveEntry   string     `json:"active_entry"`
+	Restarts      int        `json:"restarts"`
+	Threshold     int        `json:"threshold"`
+	SwitchedAt    *time.Time `json:"switched_at,omitempty"`
+	Reason        string     `json:"reason,omitempty"`
+	PrimaryUpFrom *time.Time `json:"primary_up_since,omitempty"`
+}
+
+// Failover watches the watchdog restart counter of every instance and
+// rotates the endpoint once FO_THRESHOLD consecutive health-check restarts
+// happened. With FO_FAILBACK=yes it returns to the primary entry after the
+// primary has been reachable for FO_FAILBACK_AFTER seconds.
+type Failover struct {
+	instances *Instances
+	events    *EventLog
+
+	mu        sync.Mutex
+	primaryUp map[string]time.Time
+	// restarting holds the instances restarted after a switch; mu is
+	// released for the restart, which may take tens of seconds
+	restarting map[string]bool
+}
+
+func NewFailover(instances *Instances, events *EventLog) *Failover {
+	return &Failover{
+		instances:  instances,
+		events:     events,
+		primaryUp:  make(map[string]time.Time),
+		restarting: make(map[string]bool),
+	}
+}
+
+// Run polls all instances until ctx is cancelled.
+func (f *Failover) Run(ctx context.Context) {
+	ticker := time.NewTicker(failoverInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, name := range f.instances.Names() {
+				if err := f.check(name); err != nil {
+					log.Printf("failover %s: %v", name, err)
+				}
+			}
+		}
+	}
+}
+
+func (f *Failover) check(name string) error {
+	m, cfg, err := f.instances.Get(name)
+	if err != nil {
+		return err
+	}
+	mode, err := cfg.ReadMode()
+	if err != nil || mode.FOEnabled != "yes" {
+		return nil
+	}
+	switched, err := f.decide(name, m, cfg, mode)
+	if err != nil || !switched {
+		return err
+	}
+	return f.restart(m)
+}
+
+// decide switches the endpoint of an instance when its health checks
+// failed or the primary is back, and reports whether it did. The instance
+// still has to be restarted.
+func (f *Failover) decide(name string, m *Manager, cfg *ConfigManager, mode *ModeInfo) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.restarting[name] {
+		return false, nil
+	}
+	st := f.loadState(m, cfg, mode)
+	if len(st.Entries) < 2 {
+		return false, nil
+	}
+
+	restarts := readCounter(m.paths.hcRestarts)
+	threshold := mode.FOThreshold
+	if threshold < 1 {
+		threshold = 1
+	}
+	if restarts >= threshold {
+		next := (st.Active + 1) % len(st.Entries)
+		reason := fmt.Sprintf("health check failed, %d watchdog restarts in a row", restarts)
+		return true, f.switchTo(m, cfg, st, next, reason)
+	}
+
+	if mode.FOFailback != "yes" || st.Active == 0 {
+		delete(f.primaryUp, name)
+		return false, nil
+	}
+
+	if !primaryReachable(st) {
+		delete(f.primaryUp, name)
+		return false, nil
+	}
+	since, ok := f.primaryUp[name]
+	if !ok {
+		f.primaryUp[name] = time.Now()
+		return false, nil
+	}
+	after := time.Duration(mode.FOFailbackAfter) * time.Second
+	if time.Since(since) < after {
+		return false, nil
+	}
+	delete(f.primaryUp, name)
+	reason := fmt.Sprintf("primary reachable for %s", after)
+	return true, f.switchTo(m, cfg, st, 0, reason)
+}
+
+// Switch activates entry idx of an instance by hand.
+func (f *Failover) Switch(name string, idx int) error {
+	m, cfg, err := f.instances.Get(name)
+	if err != nil {
+		return err
+	}
+	mode, err := cfg.ReadMode()
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	if f.restarting[name] {
+		f.mu.Unlock()
+		return fmt.Errorf("instance %s is restarting after a switch", name)
+	}
+	st := f.loadState(m, cfg, mode)
+	if idx < 0 || idx >= len(st.Entries) {
+		f.mu.Unlock()
+		return fmt.Errorf("entry %d out of range (0..%d)", idx, len(st.Entries)-1)
+	}
+	if idx == st.Active {
+		f.mu.Unlock()
+		return nil
+	}
+	delete(f.primaryUp, name)
+	err = f.switchTo(m, cfg, st, idx, "manual switch")
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	return f.restart(m)
+}
+
+func (f *Failover) Status(name string) (*FailoverStatus, error) {
+	m, cfg, err := f.instances.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := cfg.ReadMode()
+	if err != nil {
+		return nil, err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	st := f.loadState(m, cfg, mode)
+	status := &FailoverStatus{
+		Instance:  name,
+		Enabled:   mode.FOEnabled == "yes",
+		Source:    st.Source,
+		Entries:   st.Entries,
+		Active:    st.Active,
+		Restarts:  readCounter(m.paths.hcRestarts),
+		Threshold: mode.FOThreshold,
+		Reason:    st.Reason,
+	}
+	if status.Entries == nil {
+		status.Entries = []string{}
+	}
+	if st.Active < len(st.Entries) {
+		status.ActiveEntry = st.Entries[st.Active]
+	}
+	if !st.SwitchedAt.IsZero() {
+		t := st.SwitchedAt
+		status.SwitchedAt = &t
+	}
+	if t, ok := f.primaryUp[name]; ok {
+		status.PrimaryUpFrom = &t
+	}
+	return status, nil
+}
+
+// loadState returns the saved state, rebuilding the entry list when there is
+// none or when the failover source changed.
+func (f *Failover) loadState(m *Manager, cfg *ConfigManager, mode *ModeInfo) *FailoverState {
+	st := &FailoverState{}
+	if data, err := os.ReadFile(statePath(m.paths)); err == nil {
+		json.Unmarshal(data, st)
+	}
+	if st.Source == mode.FOSource && len(st.Entries) > 0 && st.Active < len(st.Entries) {
+		switch st.Source {
+		case "profiles":
+			if strings.Join(st.Entries[1:], " ") == strings.Join(strings.Fields(mode.FOProfiles), " ") {
+				return st
+			}
+		default:
+			// Addresses edited by hand invalidate the saved order
+			if sameSet(st.Entries, cfg.EndpointAddresses()) {
+				return st
+			}
+		}
+	}
+
+	st = &FailoverState{Source: mode.FOSource}
+	switch mode.FOSource {
+	case "profiles":
+		st.Entries = append([]string{primaryEntryName}, strings.Fields(mode.FOProfiles)...)
+	default:
+		st.Source = "addresses"
+		st.Entries = cfg.EndpointAddresses()
+	}
+	return st
+}
+
+// switchTo rewrites the endpoint of the instance and saves the new state.
+// The caller holds mu and restarts the instance after releasing it.
+func (f *Failover) switchTo(m *Manager, cfg *ConfigManager, st *FailoverState, idx int, reason string) error {
+	from := st.Entries[st.Active]
+	to := st.Entries[idx]
+
+	switch st.Source {
+	case "profiles":
+		if st.Active == 0 && st.PrimaryEndpoint == "" {
+			st.PrimaryEndpoint = cfg.EndpointSection()
+		}
+		section := st.PrimaryEndpoint
+		if idx != 0 {
+			var err error
+			if section, err = readProfileEndpoint(to); err != nil {
+				return err
+			}
+		}
+		if err := cfg.ReplaceEndpointSection(section); err != nil {
+			return err
+		}
+	default:
+		// Put the selected address first, keep the rest in their original order
+		addrs := append([]string{to}, st.Entries[:idx]...)
+		addrs = append(addrs, st.Entries[idx+1:]...)
+		if err := cfg.SetEndpointAddresses(addrs); err != nil {
+			return err
+		}
+	}
+
+	st.Active = idx
+	st.SwitchedAt = time.Now()
+	st.Reason = reason
+	if err := saveState(m.paths, st); err != nil {
+		log.Printf("failover: save state: %v", err)
+	}
+	os.Remove(m.paths.hcRestarts)
+
+	f.events.Add(Event{
+		Type:     "failover",
+		Instance: m.Name(),
+		Message:  fmt.Sprintf("switched endpoint from %s to %s", from, to),
+		Reason:   reason,
+	})
+	f.restarting[m.Name()] = true
+	return nil
+}
+
+// restart restarts the instance after a switch without holding mu, so the
+// failover status stays available meanwhile.
+func (f *Failover) restart(m *Manager) error {
+	_, err := m.Control("restart")
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.restarting, m.Name())
+	if err != nil {
+		f.events.Add(Event{
+			Type:     "failover",
+			Instance: m.Name(),
+			Message:  fmt.Sprintf("restart after switch failed: %v", err),
+		})
+		return fmt.Errorf("restart after switch: %w", err)
+	}
+	return nil
+}
+
+// primaryReachable TCP-dials the first address of the primary entry.
+func primaryReachable(st *FailoverState) bool {
+	addr := st.Entries[0]
+	if st.Source == "profiles" {
+		addrs := tomlSectionArray(st.PrimaryEndpoint, "[endpoint]", "addresses")
+		if len(addrs) == 0 {
+			return false
+		}
+		addr = addrs[0]
+	}
+	conn, err := net.DialTimeout("tcp", addr, failoverDialTO)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	seen := make(map[string]int, len(a))
+	for _, v := range a {
+		seen[v]++
+	}
+	for _, v := range b {
+		if seen[v] == 0 {
+			return false
+		}
+		seen[v]--
+	}
+	return true
+}
+
+func readProfileEndpoint(name string) (string, error) {
+	if !instanceNameRe.MatchString(name) {
+		return "", fmt.Errorf("invalid profile name %q", name)
+	}
+	data, err := os.ReadFile(filepath.Join(profilesDir, name+".toml"))
+	if err != nil {
+		return "", fmt.Errorf("read profile %s: %w", name, err)
+	}
+	section := extractTomlSection(ensureEndpointSection(string(data)), "[endpoint]")
+	if strings.TrimSpace(section) == "" {
+		return "", fmt.Errorf("profile %s has no [endpoint] section", name)
+	}
+	return section, nil
+}
+
+func statePath(p instancePaths) string {
+	return filepath.Join(filepath.Dir(p.modeConfig), failoverStateName)
+}
+
+func saveState(p instancePaths, st *FailoverState) error {
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath(p), data, 0644)
+}
+
+func readCounter(path string) int {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	return n
+}
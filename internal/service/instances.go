@@ -0,0 +1,228 @@
+package service
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+const (
+	// DefaultInstance is the tunnel configured by the top-level files in
+	// /opt/trusttunnel_client; the pre-instance API endpoints act on it.
+	DefaultInstance = "default"
+	instancesDir    = "/opt/trusttunnel_client/instances"
+)
+
+var instanceNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,15}$`)
+
+// instancePaths holds the per-instance files shared with S99trusttunnel.
+type instancePaths struct {
+	name          string
+	clientConfig  string
+	modeConfig    string
+	logFile       string
+	pidFile       string
+	watchdogPID   string
+	hcStateFile   string
+	startTSFile   string
+	ipv6StateFile string
+	// hcRestarts counts consecutive watchdog restarts after health check
+	// failures; reset by the watchdog on the first successful check.
+	hcRestarts string
+}
+
+func pathsFor(name string) instancePaths {
+	if name == "" || name == DefaultInstance {
+		return instancePaths{
+			name:          DefaultInstance,
+			clientConfig:  clientConfigPath,
+			modeConfig:    modeConfigPath,
+			logFile:       "/opt/var/log/trusttunnel.log",
+			pidFile:       "/opt/var/run/trusttunnel.pid",
+			watchdogPID:   "/opt/var/run/trusttunnel_watchdog.pid",
+			hcStateFile:   "/opt/var/run/trusttunnel_hc_state",
+			startTSFile:   "/opt/var/run/trusttunnel_start_ts",
+			ipv6StateFile: "/opt/var/run/trusttunnel_ipv6_state",
+			hcRestarts:    "/opt/var/run/trusttunnel_hc_restarts",
+		}
+	}
+
+	dir := filepath.Join(instancesDir, name)
+	run := "/opt/var/run/trusttunnel-" + name
+	return instancePaths{
+		name:          name,
+		clientConfig:  filepath.Join(dir, "trusttunnel_client.toml"),
+		modeConfig:    filepath.Join(dir, "mode.conf"),
+		logFile:       "/opt/var/log/trusttunnel-" + name + ".log",
+		pidFile:       run + ".pid",
+		watchdogPID:   run + "_watchdog.pid",
+		hcStateFile:   run + "_hc_state",
+		startTSFile:   run + "_start_ts",
+		ipv6StateFile: run + "_ipv6_state",
+		hcRestarts:    run + "_hc_restarts",
+	}
+}
+
+type InstanceInfo struct {
+	Name      string         `json:"name"`
+	Default   bool           `json:"default"`
+	Mode      string         `json:"mode"`
+	TunIdx    int            `json:"tun_idx"`
+	ProxyIdx  int            `json:"proxy_idx"`
+	SocksPort int            `json:"socks_port"`
+	Status    *ServiceStatus `json:"status"`
+}
+
+type InstanceSpec struct {
+	Name         string `json:"name"`
+	Mode         string `json:"mode"`
+	TunIdx       int    `json:"tun_idx"`
+	ProxyIdx     int    `json:"proxy_idx"`
+	SocksPort    int    `json:"socks_port"`
+	ClientConfig string `json:"client_config"`
+}
+
+// Instances is the registry of named tunnel instances. Each instance has its
+// own TOML, mode.conf, interface index, PID and log file, and is supervised
+// by its own S99trusttunnel watchdog.
+type Instances struct {
+	mu sync.Mutex
+}
+
+func NewInstances() *Instances {
+	return &Instances{}
+}
+
+// Names returns all instance names, default first.
+func (i *Instances) Names() []string {
+	names := []string{DefaultInstance}
+	entries, err := os.ReadDir(instancesDir)
+	if err != nil {
+		return names
+	}
+	var extra []string
+	for _, e := range entries {
+		if !e.IsDir() || !instanceNameRe.MatchString(e.Name()) || e.Name() == DefaultInstance {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(instancesDir, e.Name(), "mode.conf")); err == nil {
+			extra = append(extra, e.Name())
+		}
+	}
+	sort.Strings(extra)
+	return append(names, extra...)
+}
+
+func (i *Instances) Exists(name string) bool {
+	for _, n := range i.Names() {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Get returns the service and config managers of an instance.
+func (i *Instances) Get(name string) (*Manager, *ConfigManager, error) {
+	if !i.Exists(name) {
+		return nil, nil, fmt.Errorf("instance %q not found", name)
+	}
+	m := newInstanceManager(name)
+	return m, m.config, nil
+}
+
+func (i *Instances) List() []InstanceInfo {
+	var list []InstanceInfo
+	for _, name := range i.Names() {
+		m := newInstanceManager(name)
+		info := InstanceInfo{Name: name, Default: name == DefaultInstance}
+		if mode, err := m.config.ReadMode(); err == nil {
+			info.Mode = mode.Mode
+			info.TunIdx = mode.TunIdx
+			info.ProxyIdx = mode.ProxyIdx
+			info.SocksPort = mode.SocksPort
+		}
+		info.Status, _ = m.Status()
+		list = append(list, info)
+	}
+	return list
+}
+
+// Create validates the spec against existing instances and writes the new
+// instance's TOML and mode.conf.
+func (i *Instances) Create(spec InstanceSpec) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if !instanceNameRe.MatchString(spec.Name) || spec.Name == DefaultInstance {
+		return fmt.Errorf("invalid instance name %q (a-z, 0-9, '-', '_', up to 16 chars)", spec.Name)
+	}
+	if spec.Mode != "socks5" && spec.Mode != "tun" {
+		return fmt.Errorf("mode must be 'socks5' or 'tun'")
+	}
+	if spec.SocksPort == 0 {
+		spec.SocksPort = defaultSocksPort
+	}
+	if i.Exists(spec.Name) {
+		return fmt.Errorf("instance %q already exists", spec.Name)
+	}
+
+	for _, other := range i.List() {
+		if other.SocksPort == spec.SocksPort {
+			return fmt.Errorf("socks port %d is used by instance %q", spec.SocksPort, other.Name)
+		}
+		if spec.Mode == "tun" && other.Mode == "tun" && other.TunIdx == spec.TunIdx {
+			return fmt.Errorf("TUN index %d is used by instance %q", spec.TunIdx, other.Name)
+		}
+		if spec.Mode == "socks5" && other.Mode == "socks5" && other.ProxyIdx == spec.ProxyIdx {
+			return fmt.Errorf("proxy index %d is used by instance %q", spec.ProxyIdx, other.Name)
+		}
+	}
+
+	p := pathsFor(spec.Name)
+	if err := os.MkdirAll(filepath.Dir(p.modeConfig), 0755); err != nil {
+		return fmt.Errorf("create instance dir: %w", err)
+	}
+
+	cfg := &ConfigManager{clientConfig: p.clientConfig, modeConfig: p.modeConfig}
+	if err := cfg.WriteMode(spec.Mode, spec.TunIdx, spec.ProxyIdx); err != nil {
+		return err
+	}
+	if err := cfg.rewriteModeConf(
+		confEntry{"SOCKS_PORT", fmt.Sprint(spec.SocksPort)},
+		confEntry{"HC_SOCKS5_PROXY", fmt.Sprintf("127.0.0.1:%d", spec.SocksPort)},
+	); err != nil {
+		return err
+	}
+	if err := cfg.WriteAll(spec.ClientConfig, ""); err != nil {
+		return err
+	}
+	return cfg.SyncVpnMode(spec.Mode)
+}
+
+// Delete stops the instance and removes its files.
+func (i *Instances) Delete(name string) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if name == DefaultInstance {
+		return fmt.Errorf("the default instance cannot be deleted")
+	}
+	if !instanceNameRe.MatchString(name) {
+		return fmt.Errorf("invalid instance name %q", name)
+	}
+
+	m := newInstanceManager(name)
+	m.Control("stop")
+
+	if err := os.RemoveAll(filepath.Join(instancesDir, name)); err != nil {
+		return fmt.Errorf("remove instance: %w", err)
+	}
+	for _, f := range []string{m.paths.pidFile, m.paths.watchdogPID, m.paths.hcStateFile, m.paths.startTSFile, m.paths.ipv6StateFile, m.paths.hcRestarts} {
+		os.Remove(f)
+	}
+	return nil
+}
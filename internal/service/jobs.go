@@ -0,0 +1,224 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxJobs       = 20
+	maxJobLogLine = 500
+)
+
+type JobState string
+
+const (
+	JobRunning   JobState = "running"
+	JobDone      JobState = "done"
+	JobFailed    JobState = "failed"
+	JobCancelled JobState = "cancelled"
+)
+
+// Job is a long-running manager operation (tuning, downloads, package
+// installs) that the UI polls by ID.
+type Job struct {
+	ID         string    `json:"id"`
+	Type       string    `json:"type"`
+	Instance   string    `json:"instance,omitempty"`
+	State      JobState  `json:"state"`
+	Progress   int       `json:"progress"`
+	Log        []string  `json:"log"`
+	Result     any       `json:"result,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at,omitempty"`
+
+	mu     sync.Mutex
+	cancel context.CancelFunc
+}
+
+// Logf appends a line to the job log. On a nil job the line is only
+// logged, so helpers can be shared with code running outside a job.
+func (j *Job) Logf(format string, args ...any) {
+	line := fmt.Sprintf(format, args...)
+	if j == nil {
+		log.Printf("%s", line)
+		return
+	}
+	log.Printf("[job %s] %s", j.ID, line)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.Log = append(j.Log, time.Now().Format("15:04:05")+" "+line)
+	if len(j.Log) > maxJobLogLine {
+		j.Log = j.Log[len(j.Log)-maxJobLogLine:]
+	}
+}
+
+// SetProgress records completion in percent.
+func (j *Job) SetProgress(pct int) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.Progress = pct
+	j.mu.Unlock()
+}
+
+// SetResult stores an intermediate or final result visible while running.
+func (j *Job) SetResult(v any) {
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	j.Result = v
+	j.mu.Unlock()
+}
+
+// snapshot returns a copy safe to serialize while the job runs.
+func (j *Job) snapshot() *Job {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return &Job{
+		ID:         j.ID,
+		Type:       j.Type,
+		Instance:   j.Instance,
+		State:      j.State,
+		Progress:   j.Progress,
+		Log:        append([]string{}, j.Log...),
+		Result:     j.Result,
+		Error:      j.Error,
+		StartedAt:  j.StartedAt,
+		FinishedAt: j.FinishedAt,
+	}
+}
+
+// Jobs runs background jobs, at most one per type at a time.
+type Jobs struct {
+	mu     sync.Mutex
+	seq    int
+	jobs   []*Job
+	events *EventLog
+}
+
+func NewJobs(events *EventLog) *Jobs {
+	return &Jobs{events: events}
+}
+
+// evict drops the oldest finished jobs beyond maxJobs. Running jobs are
+// kept, so they can still be watched and cancelled; the caller holds mu.
+func (js *Jobs) evict() {
+	excess := len(js.jobs) - maxJobs
+	if excess <= 0 {
+		return
+	}
+	kept := js.jobs[:0]
+	for _, j := range js.jobs {
+		if excess > 0 && j.snapshot().State != JobRunning {
+			excess--
+			continue
+		}
+		kept = append(kept, j)
+	}
+	clear(js.jobs[len(kept):])
+	js.jobs = kept
+}
+
+// Start launches fn in a goroutine. fn should return promptly once ctx is
+// cancelled.
+func (js *Jobs) Start(typ, instance string, fn func(ctx context.Context, j *Job) (any, error)) (*Job, error) {
+	js.mu.Lock()
+	for _, j := range js.jobs {
+		if j.Type == typ && j.snapshot().State == JobRunning {
+			js.mu.Unlock()
+			return nil, fmt.Errorf("%s job %s is already running", typ, j.ID)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	js.seq++
+	j := &Job{
+		ID:        strconv.FormatInt(time.Now().Unix(), 36) + "-" + strconv.Itoa(js.seq),
+		Type:      typ,
+		Instance:  instance,
+		State:     JobRunning,
+		Log:       []string{},
+		StartedAt: time.Now(),
+		cancel:    cancel,
+	}
+	js.jobs = append(js.jobs, j)
+	js.evict()
+	js.mu.Unlock()
+
+	go func() {
+		defer cancel()
+		result, err := fn(ctx, j)
+
+		j.mu.Lock()
+		if result != nil {
+			j.Result = result
+		}
+		j.FinishedAt = time.Now()
+		switch {
+		case ctx.Err() != nil:
+			j.State = JobCancelled
+		case err != nil:
+			j.State = JobFailed
+			j.Error = err.Error()
+		default:
+			j.State = JobDone
+			j.Progress = 100
+		}
+		state := j.State
+		j.mu.Unlock()
+
+		js.events.Add(Event{
+			Type:     "job",
+			Instance: instance,
+			Message:  fmt.Sprintf("%s job %s %s", typ, j.ID, state),
+			Reason:   j.Error,
+		})
+	}()
+	return j.snapshot(), nil
+}
+
+func (js *Jobs) Get(id string) (*Job, bool) {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	for _, j := range js.jobs {
+		if j.ID == id {
+			return j.snapshot(), true
+		}
+	}
+	return nil, false
+}
+
+// List returns all retained jobs, newest first.
+func (js *Jobs) List() []*Job {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	out := make([]*Job, 0, len(js.jobs))
+	for i := len(js.jobs) - 1; i >= 0; i-- {
+		out = append(out, js.jobs[i].snapshot())
+	}
+	return out
+}
+
+func (js *Jobs) Cancel(id string) error {
+	js.mu.Lock()
+	defer js.mu.Unlock()
+	for _, j := range js.jobs {
+		if j.ID == id {
+			if j.snapshot().State != JobRunning {
+				return fmt.Errorf("job %s is not running", id)
+			}
+			j.cancel()
+			return nil
+		}
+	}
+	return fmt.Errorf("job %s not found", id)
+}
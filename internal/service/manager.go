@@ -12,10 +12,6 @@ import (
 
 const (
 	initScript        = "/opt/etc/init.d/S99trusttunnel"
-	pidFile           = "/opt/var/run/trusttunnel.pid"
-	watchdogPID       = "/opt/var/run/trusttunnel_watchdog.pid"
-	hcStateFile       = "/opt/var/run/trusttunnel_hc_state"
-	startTSFile       = "/opt/var/run/trusttunnel_start_ts"
 	clientBin         = "/opt/trusttunnel_client/trusttunnel_client"
 	clientVersionFile = "/opt/trusttunnel_client/.client_version"
 )
@@ -28,49 +24,91 @@ type ServiceStatus struct {
 	WatchdogAlive bool   `json:"watchdog_alive"`
 	HealthCheck   string `json:"health_check"`
 	ClientVersion string `json:"client_version"`
+	// IPv6 is the effective LAN IPv6 state: "tunnel" (routed through the
+	// tunnel), "blocked" (forwarding blocked) or "direct" (not managed).
+	IPv6            string `json:"ipv6"`
+	EndpointHasIPv6 bool   `json:"endpoint_has_ipv6"`
 }
 
-type Manager struct{}
+// Manager controls a single tunnel instance through the init script.
+type Manager struct {
+	paths  instancePaths
+	config *ConfigManager
+}
 
+// NewManager returns the service manager of the default instance.
 func NewManager() *Manager {
-	return &Manager{}
+	return newInstanceManager(DefaultInstance)
+}
+
+func newInstanceManager(name string) *Manager {
+	p := pathsFor(name)
+	return &Manager{
+		paths:  p,
+		config: &ConfigManager{clientConfig: p.clientConfig, modeConfig: p.modeConfig},
+	}
+}
+
+// Name returns the instance name.
+func (m *Manager) Name() string {
+	return m.paths.name
+}
+
+// LogFile returns the path of the instance client log.
+func (m *Manager) LogFile() string {
+	return m.paths.logFile
 }
 
 func (m *Manager) Status() (*ServiceStatus, error) {
 	s := &ServiceStatus{}
 
-	pid := readPIDFile(pidFile)
+	pid := readPIDFile(m.paths.pidFile)
 	if pid > 0 && processAlive(pid) {
 		s.Running = true
 		s.PID = pid
 	}
 
-	if ts := readFileStr(startTSFile); ts != "" {
+	if ts := readFileStr(m.paths.startTSFile); ts != "" {
 		if t, err := strconv.ParseInt(strings.TrimSpace(ts), 10, 64); err == nil {
 			s.Uptime = time.Now().Unix() - t
 		}
 	}
 
-	wpid := readPIDFile(watchdogPID)
+	wpid := readPIDFile(m.paths.watchdogPID)
 	s.WatchdogAlive = wpid > 0 && processAlive(wpid)
 
-	s.HealthCheck = strings.TrimSpace(readFileStr(hcStateFile))
+	s.HealthCheck = strings.TrimSpace(readFileStr(m.paths.hcStateFile))
 	if s.HealthCheck == "" {
 		s.HealthCheck = "unknown"
 	}
 
-	modeConf := NewConfigManager()
-	if mode, err := modeConf.ReadMode(); err == nil {
+	if mode, err := m.config.ReadMode(); err == nil {
 		s.Mode = mode.Mode
 	}
 
+	s.EndpointHasIPv6 = m.config.EndpointHasIPv6()
+	s.IPv6 = strings.TrimSpace(readFileStr(m.paths.ipv6StateFile))
+	if !s.Running || s.IPv6 == "" {
+		s.IPv6 = "direct"
+	}
+
 	s.ClientVersion = detectClientVersion()
 
 	return s, nil
 }
 
+// Control runs an init script action for this instance only.
 func (m *Manager) Control(action string) (string, error) {
-	cmd := exec.Command(initScript, action)
+	return runInitScript(action, m.paths.name)
+}
+
+// ControlAll runs an init script action for every instance.
+func ControlAll(action string) (string, error) {
+	return runInitScript(action)
+}
+
+func runInitScript(action string, args ...string) (string, error) {
+	cmd := exec.Command(initScript, append([]string{action}, args...)...)
 	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return string(out), fmt.Errorf("%s failed: %w: %s", action, err, string(out))
@@ -0,0 +1,266 @@
+package service
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+)
+
+const (
+	opkgStatusFile = "/opt/lib/opkg/status"
+	managerPackage = "trusttunnel-manager"
+	// ipkManagerPath is the manager binary inside the package data archive
+	ipkManagerPath = "opt/trusttunnel_client/trusttunnel-manager"
+)
+
+// opkgInstalled parses the opkg status database and returns the versions
+// of all installed packages.
+func opkgInstalled() map[string]string {
+	pkgs := make(map[string]string)
+	f, err := os.Open(opkgStatusFile)
+	if err != nil {
+		return pkgs
+	}
+	defer f.Close()
+
+	var name, version, status string
+	flush := func() {
+		if name != "" && strings.HasSuffix(status, " installed") {
+			pkgs[name] = version
+		}
+		name, version, status = "", "", ""
+	}
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64<<10), 1<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" {
+			flush()
+			continue
+		}
+		key, val, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "Package":
+			name = strings.TrimSpace(val)
+		case "Version":
+			version = strings.TrimSpace(val)
+		case "Status":
+			status = strings.TrimSpace(val)
+		}
+	}
+	flush()
+	return pkgs
+}
+
+// managerFromOpkg reports whether the manager was installed from the .ipk,
+// in which case updates must go through opkg to keep its database and
+// conffiles consistent.
+func managerFromOpkg() bool {
+	_, ok := opkgInstalled()[managerPackage]
+	return ok
+}
+
+// managerInstallMethod is "opkg" or "binary", see UpdateInfo.ManagerInstall.
+func managerInstallMethod() string {
+	if managerFromOpkg() {
+		return "opkg"
+	}
+	return "binary"
+}
+
+// managerIPKSuffix is the file name ending of the manager package for this
+// router, e.g. "_mipsel-3.4.ipk".
+func managerIPKSuffix() string {
+	return "_" + opkgArch(detectArch()) + ".ipk"
+}
+
+// opkgArch maps a release architecture to the Entware package
+// architecture used in .ipk names (see packaging/build-ipk.sh).
+func opkgArch(arch string) string {
+	switch arch {
+	case "mipsel":
+		return "mipsel-3.4"
+	case "mips":
+		return "mips-3.4"
+	case "aarch64":
+		return "aarch64-3.10"
+	case "armv7":
+		return "armv7-3.2"
+	}
+	return arch
+}
+
+// runLogged runs a command and streams its combined output to the job log.
+func runLogged(ctx context.Context, j *Job, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+
+	j.Logf("$ %s %s", name, strings.Join(args, " "))
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		scanner := bufio.NewScanner(pr)
+		for scanner.Scan() {
+			if line := strings.TrimSpace(scanner.Text()); line != "" {
+				j.Logf("%s", line)
+			}
+		}
+		io.Copy(io.Discard, pr)
+	}()
+
+	err := cmd.Wait()
+	pw.Close()
+	wg.Wait()
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", name, args[0], err)
+	}
+	return nil
+}
+
+// extractIPKManager writes the manager binary contained in an .ipk to dest,
+// so it can be checked and self-tested before opkg installs the package.
+// Entware packages are a tar.gz holding control.tar.gz and data.tar.gz.
+func extractIPKManager(ipk, dest string) error {
+	f, err := os.Open(ipk)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	outer, err := openTarGz(f)
+	if err != nil {
+		return fmt.Errorf("ipk: %w", err)
+	}
+	for {
+		hdr, err := outer.Next()
+		if err == io.EOF {
+			return fmt.Errorf("ipk has no data.tar.gz")
+		}
+		if err != nil {
+			return fmt.Errorf("ipk: %w", err)
+		}
+		if path.Clean(hdr.Name) != "data.tar.gz" {
+			continue
+		}
+		data, err := openTarGz(io.LimitReader(outer, maxArchiveTotal))
+		if err != nil {
+			return fmt.Errorf("ipk data: %w", err)
+		}
+		for {
+			dh, err := data.Next()
+			if err == io.EOF {
+				return fmt.Errorf("ipk does not contain %s", ipkManagerPath)
+			}
+			if err != nil {
+				return fmt.Errorf("ipk data: %w", err)
+			}
+			if dh.Typeflag != tar.TypeReg || path.Clean(dh.Name) != ipkManagerPath {
+				continue
+			}
+			if dh.Size > maxArchiveFileSize {
+				return fmt.Errorf("%s is too large", ipkManagerPath)
+			}
+			return writeArchiveFile(data, dest, dh)
+		}
+	}
+}
+
+// installManagerIPK updates a package install: the release .ipk is
+// downloaded, its manager binary checked and self-tested, and the package
+// installed with opkg so the status database and conffiles stay
+// consistent. The restart is then confirmed like a binary replacement.
+func (u *Updater) installManagerIPK(ctx context.Context, j *Job, rel *githubRelease) (*UpdateResult, error) {
+	suffix := managerIPKSuffix()
+	log.Printf("[update-manager] searching package: %s*%s", managerPackage+"_", suffix)
+	asset, err := rel.findAsset(managerPackage+"_", suffix)
+	if err != nil {
+		return nil, fmt.Errorf("find package: %w", err)
+	}
+	j.Logf("downloading %s (%s) from %s", asset.Name, formatBytes(asset.Size), rel.src)
+
+	ipk, err := u.download(ctx, j, rel.src, asset.BrowserDownloadURL, asset.Name, asset.Size)
+	if err != nil {
+		return nil, fmt.Errorf("download: %w", err)
+	}
+	defer os.Remove(ipk)
+
+	ver, err := u.verifyAsset(rel, asset.Name, ipk, true)
+	if err != nil {
+		u.audit("manager", rel.TagName, nil, err)
+		return nil, fmt.Errorf("verify: %w", err)
+	}
+	j.Logf("verified %s: %s", asset.Name, ver)
+	return u.installIPK(ctx, j, ipk, rel.TagName, ver)
+}
+
+// installIPK self-tests the manager contained in a verified package and
+// installs it with opkg.
+func (u *Updater) installIPK(ctx context.Context, j *Job, ipk, latestVer string, ver *Verification) (*UpdateResult, error) {
+	staged := managerBinNew
+	os.Remove(staged)
+	if err := extractIPKManager(ipk, staged); err != nil {
+		u.audit("manager", latestVer, nil, err)
+		return nil, err
+	}
+	defer os.Remove(staged)
+	reported, err := stageManager(staged)
+	if err != nil {
+		u.audit("manager", latestVer, nil, err)
+		return nil, err
+	}
+	if latestVer == "" || latestVer == "upload" {
+		latestVer = reported
+	}
+	j.Logf("package contains trusttunnel-manager %s", reported)
+
+	if err := markManagerUpdate(latestVer); err != nil {
+		return nil, err
+	}
+	// opkg refuses downgrades and skips an installed version unless forced
+	args := []string{"install", ipk}
+	switch current := managerVersion(); {
+	case isNewer(current, reported):
+		args = append(args, "--force-downgrade")
+	case !isNewer(reported, current):
+		args = append(args, "--force-reinstall")
+	}
+	// Interrupting opkg halfway would leave a broken package, so a cancelled
+	// job no longer stops it
+	if err := runLogged(context.WithoutCancel(ctx), j, "opkg", args...); err != nil {
+		os.Remove(managerUpdateMarker)
+		u.audit("manager", latestVer, nil, err)
+		return nil, err
+	}
+
+	u.audit("manager", latestVer, ver, nil)
+	log.Printf("[update-manager] package installed, scheduling restart, new version: %s", latestVer)
+	return managerUpdated(latestVer, ver), nil
+}
+
+func openTarGz(r io.Reader) (*tar.Reader, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	return tar.NewReader(gz), nil
+}
@@ -0,0 +1,340 @@
+package service
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	probeAttempts = 3
+	probeTimeout  = 3 * time.Second
+	// probeMinGainMs keeps small absolute differences from triggering a
+	// reorder even when they exceed the relative hysteresis.
+	probeMinGainMs = 10
+	// probeLossPenaltyMs is added to the score per lost attempt ratio.
+	probeLossPenaltyMs = 1000
+)
+
+type AddressProbe struct {
+	Address  string  `json:"address"`
+	TCPMs    float64 `json:"tcp_ms"`
+	TLSMs    float64 `json:"tls_ms"`
+	Loss     float64 `json:"loss"`
+	Attempts int     `json:"attempts"`
+	Score    float64 `json:"score"`
+	Error    string  `json:"error,omitempty"`
+}
+
+type ProbeResult struct {
+	Instance  string         `json:"instance"`
+	Hostname  string         `json:"hostname"`
+	Interface string         `json:"interface"`
+	Results   []AddressProbe `json:"results"`
+	Current   string         `json:"current"`
+	Best      string         `json:"best"`
+	Reordered bool           `json:"reordered"`
+	Reason    string         `json:"reason,omitempty"`
+	Time      time.Time      `json:"time"`
+}
+
+// Prober measures TCP and TLS handshake latency to every [endpoint] address
+// over the WAN interface and can move the best one to the front of the list.
+type Prober struct {
+	instances *Instances
+	events    *EventLog
+
+	mu   sync.Mutex
+	last map[string]*ProbeResult
+	// running serializes the probe and reorder of each instance
+	running map[string]*sync.Mutex
+}
+
+func NewProber(instances *Instances, events *EventLog) *Prober {
+	return &Prober{
+		instances: instances,
+		events:    events,
+		last:      make(map[string]*ProbeResult),
+		running:   make(map[string]*sync.Mutex),
+	}
+}
+
+// Run probes instances with EP_PROBE_AUTO=yes on their configured interval
+// and reorders their addresses.
+func (p *Prober) Run(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, name := range p.instances.Names() {
+				_, cfg, err := p.instances.Get(name)
+				if err != nil {
+					continue
+				}
+				mode, err := cfg.ReadMode()
+				if err != nil || mode.EPProbeAuto != "yes" || !p.due(name, mode.EPProbeInterval) {
+					continue
+				}
+				if _, err := p.Probe(name, true); err != nil {
+					log.Printf("probe %s: %v", name, err)
+				}
+			}
+		}
+	}
+}
+
+func (p *Prober) due(name string, interval int) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	last, ok := p.last[name]
+	if !ok {
+		return true
+	}
+	if interval < 60 {
+		interval = 60
+	}
+	return time.Since(last.Time) >= time.Duration(interval)*time.Second
+}
+
+// instanceLock returns the lock held while an instance is probed.
+func (p *Prober) instanceLock(name string) *sync.Mutex {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	l, ok := p.running[name]
+	if !ok {
+		l = &sync.Mutex{}
+		p.running[name] = l
+	}
+	return l
+}
+
+// Last returns the most recent probe result of an instance, if any.
+func (p *Prober) Last(name string) *ProbeResult {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.last[name]
+}
+
+// Probe measures all addresses of an instance. With apply set, the best
+// address is moved to the front and the client restarted, unless it does not
+// beat the current first address by the hysteresis margin. Probes of the
+// same instance run one at a time, so two reorders never race on the TOML.
+func (p *Prober) Probe(name string, apply bool) (*ProbeResult, error) {
+	l := p.instanceLock(name)
+	l.Lock()
+	defer l.Unlock()
+
+	m, cfg, err := p.instances.Get(name)
+	if err != nil {
+		return nil, err
+	}
+	mode, err := cfg.ReadMode()
+	if err != nil {
+		return nil, err
+	}
+	addrs := cfg.EndpointAddresses()
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no addresses in [endpoint]")
+	}
+
+	res := &ProbeResult{
+		Instance:  name,
+		Hostname:  cfg.EndpointHostname(),
+		Interface: wanInterface(),
+		Current:   addrs[0],
+		Time:      time.Now(),
+	}
+
+	var wg sync.WaitGroup
+	res.Results = make([]AddressProbe, len(addrs))
+	for i, addr := range addrs {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			res.Results[i] = probeAddress(addr, res.Hostname, res.Interface)
+		}(i, addr)
+	}
+	wg.Wait()
+
+	ranked := append([]AddressProbe(nil), res.Results...)
+	sort.SliceStable(ranked, func(i, j int) bool { return ranked[i].Score < ranked[j].Score })
+	res.Best = ranked[0].Address
+
+	if apply {
+		p.apply(m, cfg, mode, res, addrs, ranked)
+	}
+
+	p.mu.Lock()
+	p.last[name] = res
+	p.mu.Unlock()
+	return res, nil
+}
+
+func (p *Prober) apply(m *Manager, cfg *ConfigManager, mode *ModeInfo, res *ProbeResult, addrs []string, ranked []AddressProbe) {
+	if mode.FOEnabled == "yes" && mode.FOSource == "addresses" {
+		res.Reason = "address order is managed by failover"
+		return
+	}
+	if res.Best == res.Current {
+		res.Reason = "current address is already the best"
+		return
+	}
+
+	best := ranked[0]
+	var current AddressProbe
+	for _, r := range res.Results {
+		if r.Address == res.Current {
+			current = r
+		}
+	}
+	if best.Loss >= 1 {
+		res.Reason = "no address is reachable"
+		return
+	}
+	margin := float64(mode.EPProbeHysteresis) / 100
+	if current.Loss < 1 && (best.Score > current.Score*(1-margin) || current.Score-best.Score < probeMinGainMs) {
+		res.Reason = fmt.Sprintf("gain below hysteresis (%.0f ms vs %.0f ms)", best.Score, current.Score)
+		return
+	}
+
+	order := []string{best.Address}
+	for _, a := range addrs {
+		if a != best.Address {
+			order = append(order, a)
+		}
+	}
+	if err := cfg.SetEndpointAddresses(order); err != nil {
+		res.Reason = "write config: " + err.Error()
+		return
+	}
+	res.Reordered = true
+	res.Reason = fmt.Sprintf("%s: %.0f ms, %s: %.0f ms", best.Address, best.Score, current.Address, current.Score)
+	if current.Loss >= 1 {
+		res.Reason = fmt.Sprintf("%s unreachable, %s: %.0f ms", current.Address, best.Address, best.Score)
+	}
+
+	p.events.Add(Event{
+		Type:     "endpoint_reorder",
+		Instance: m.Name(),
+		Message:  fmt.Sprintf("moved %s ahead of %s", best.Address, current.Address),
+		Reason:   res.Reason,
+	})
+
+	if st, _ := m.Status(); st != nil && st.Running {
+		if _, err := m.Control("restart"); err != nil {
+			log.Printf("probe: restart after reorder: %v", err)
+		}
+	}
+}
+
+// probeAddress runs probeAttempts TCP connects and TLS handshakes against
+// addr and averages the successful ones.
+func probeAddress(addr, serverName, iface string) AddressProbe {
+	r := AddressProbe{Address: addr, Attempts: probeAttempts}
+	if serverName == "" {
+		serverName, _, _ = net.SplitHostPort(addr)
+	}
+
+	dialer := &net.Dialer{Timeout: probeTimeout}
+	if iface != "" {
+		dialer.Control = func(network, address string, c syscall.RawConn) error {
+			var bindErr error
+			if err := c.Control(func(fd uintptr) { bindErr = bindToDevice(fd, iface) }); err != nil {
+				return err
+			}
+			return bindErr
+		}
+	}
+
+	var tcpSum, tlsSum float64
+	ok := 0
+	for i := 0; i < probeAttempts; i++ {
+		start := time.Now()
+		conn, err := dialer.Dial("tcp", addr)
+		if err != nil {
+			r.Error = err.Error()
+			continue
+		}
+		tcp := time.Since(start)
+
+		conn.SetDeadline(time.Now().Add(probeTimeout))
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName: serverName,
+			// Only the handshake time matters here; the client verifies the
+			// certificate itself.
+			InsecureSkipVerify: true,
+			NextProtos:         []string{"h2", "http/1.1"},
+		})
+		start = time.Now()
+		err = tlsConn.Handshake()
+		hs := time.Since(start)
+		tlsConn.Close()
+		if err != nil {
+			r.Error = err.Error()
+			continue
+		}
+
+		tcpSum += float64(tcp.Microseconds()) / 1000
+		tlsSum += float64(hs.Microseconds()) / 1000
+		ok++
+	}
+
+	r.Loss = float64(probeAttempts-ok) / probeAttempts
+	if ok == 0 {
+		r.Score = math.MaxFloat32
+		return r
+	}
+	r.Error = ""
+	r.TCPMs = round1(tcpSum / float64(ok))
+	r.TLSMs = round1(tlsSum / float64(ok))
+	r.Score = round1(r.TCPMs + r.TLSMs + r.Loss*probeLossPenaltyMs)
+	return r
+}
+
+func round1(v float64) float64 {
+	return math.Round(v*10) / 10
+}
+
+// wanInterface returns the interface of the lowest-metric default route that
+// is not a tunnel, read from /proc/net/route.
+func wanInterface() string {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+
+	best, bestMetric := "", -1
+	scanner := bufio.NewScanner(f)
+	scanner.Scan() // header
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 8 || fields[1] != "00000000" || fields[7] != "00000000" {
+			continue
+		}
+		iface := fields[0]
+		lower := strings.ToLower(iface)
+		if strings.HasPrefix(lower, "opkgtun") || strings.HasPrefix(lower, "tun") || strings.HasPrefix(lower, "nwg") {
+			continue
+		}
+		metric, _ := strconv.Atoi(fields[6])
+		if bestMetric < 0 || metric < bestMetric {
+			best, bestMetric = iface, metric
+		}
+	}
+	return best
+}
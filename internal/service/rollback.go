@@ -0,0 +1,237 @@
+package service
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	clientBinBackup     = clientBin + ".prev"
+	clientVersionBackup = clientVersionFile + ".prev"
+	rollbackPoll        = 5 * time.Second
+	defaultWatchWindow  = 300 * time.Second
+	// maxWatchRestarts is how many supervisor restarts of the new client are
+	// tolerated inside the watch window.
+	maxWatchRestarts = 1
+)
+
+// RollbackStatus reports the post-update watch of a client update.
+type RollbackStatus struct {
+	// State is "watching", "ok" or "rolled_back"
+	State           string    `json:"state"`
+	Version         string    `json:"version"`
+	PreviousVersion string    `json:"previous_version"`
+	Since           time.Time `json:"since"`
+	Until           time.Time `json:"until"`
+	Reason          string    `json:"reason,omitempty"`
+}
+
+// SetWatchWindow sets how long a freshly installed client is watched before
+// the update is considered good.
+func (u *Updater) SetWatchWindow(d time.Duration) {
+	if d > 0 {
+		u.watchWindow = d
+	}
+}
+
+// backupClient keeps the current binary and version next to the originals so
+// a failed update can be reverted.
+func backupClient() error {
+	if _, err := os.Stat(clientBin); err != nil {
+		return nil
+	}
+	if err := copyFile(clientBin, clientBinBackup, 0755); err != nil {
+		return fmt.Errorf("backup binary: %w", err)
+	}
+	os.Remove(clientVersionBackup)
+	if _, err := os.Stat(clientVersionFile); err == nil {
+		if err := copyFile(clientVersionFile, clientVersionBackup, 0644); err != nil {
+			return fmt.Errorf("backup version: %w", err)
+		}
+	}
+	return nil
+}
+
+// RollbackAvailable reports whether a previous client binary is kept.
+func RollbackAvailable() bool {
+	_, err := os.Stat(clientBinBackup)
+	return err == nil
+}
+
+func (u *Updater) RollbackStatus() *RollbackStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.rollback == nil {
+		return nil
+	}
+	st := *u.rollback
+	return &st
+}
+
+// Rollback restores the previous client binary and version and restarts all
+// instances. It fails while an install is writing the binary.
+func (u *Updater) Rollback(reason string) (*UpdateResult, error) {
+	if !u.installMu.TryLock() {
+		return nil, errUpdateInProgress
+	}
+	defer u.installMu.Unlock()
+	if !RollbackAvailable() {
+		return nil, fmt.Errorf("no previous client binary to roll back to")
+	}
+	failed := detectClientVersion()
+
+	log.Printf("[update] rolling back client %s: %s", failed, reason)
+	ControlAll("stop")
+	if err := copyFile(clientBinBackup, clientBin, 0755); err != nil {
+		ControlAll("start")
+		return nil, fmt.Errorf("restore binary: %w", err)
+	}
+	if _, err := os.Stat(clientVersionBackup); err == nil {
+		copyFile(clientVersionBackup, clientVersionFile, 0644)
+	} else {
+		os.Remove(clientVersionFile)
+	}
+	os.Remove(clientBinBackup)
+	os.Remove(clientVersionBackup)
+	ControlAll("start")
+
+	restored := detectClientVersion()
+	u.mu.Lock()
+	if u.rollback == nil {
+		u.rollback = &RollbackStatus{Version: failed, PreviousVersion: restored, Since: time.Now()}
+	}
+	u.rollback.State = "rolled_back"
+	u.rollback.Reason = reason
+	u.cache = nil
+	u.mu.Unlock()
+
+	u.events.Add(Event{
+		Type:    "update",
+		Message: fmt.Sprintf("client rolled back from %s to %s", failed, restored),
+		Reason:  reason,
+	})
+	return &UpdateResult{
+		Success: true,
+		Message: "Rolled back to " + restored,
+		Version: restored,
+	}, nil
+}
+
+// autoRollback rolls back from the update watch. A rollback skipped because
+// another install is running is left to that install.
+func (u *Updater) autoRollback(reason string) {
+	if _, err := u.Rollback(reason); err != nil {
+		log.Printf("[update] rollback: %v", err)
+	}
+}
+
+// watchUpdate follows the supervisor and health checks of every instance
+// that was running before the update and rolls back if the new client keeps
+// crashing or never passes a health check within the watch window.
+func (u *Updater) watchUpdate(running []string, version, previous string) {
+	now := time.Now()
+	st := &RollbackStatus{
+		State:           "watching",
+		Version:         version,
+		PreviousVersion: previous,
+		Since:           now,
+		Until:           now.Add(u.watchWindow),
+	}
+	u.mu.Lock()
+	u.rollback = st
+	gen := now
+	u.mu.Unlock()
+
+	type instWatch struct {
+		paths    instancePaths
+		startTS  string
+		restarts int
+		hcBase   int
+		down     int
+		healthy  bool
+	}
+	var watched []*instWatch
+	for _, name := range running {
+		p := pathsFor(name)
+		watched = append(watched, &instWatch{
+			paths:   p,
+			startTS: strings.TrimSpace(readFileStr(p.startTSFile)),
+			hcBase:  readCounter(p.hcRestarts),
+		})
+	}
+	if len(watched) == 0 {
+		u.finishWatch(gen, "ok", "no instance was running")
+		return
+	}
+
+	for time.Now().Before(st.Until) {
+		time.Sleep(rollbackPoll)
+		if cur := u.RollbackStatus(); cur == nil || cur.State != "watching" || !cur.Since.Equal(gen) {
+			return
+		}
+
+		for _, w := range watched {
+			if ts := strings.TrimSpace(readFileStr(w.paths.startTSFile)); ts != "" && ts != w.startTS {
+				w.startTS = ts
+				w.restarts++
+			}
+			if pid := readPIDFile(w.paths.pidFile); pid > 0 && processAlive(pid) {
+				w.down = 0
+			} else {
+				w.down++
+			}
+			if strings.TrimSpace(readFileStr(w.paths.hcStateFile)) == "ok" {
+				w.healthy = true
+			}
+
+			var reason string
+			switch {
+			case w.restarts > maxWatchRestarts:
+				reason = fmt.Sprintf("instance %s restarted %d times after update", w.paths.name, w.restarts)
+			case readCounter(w.paths.hcRestarts) > w.hcBase:
+				reason = fmt.Sprintf("instance %s failed health checks after update", w.paths.name)
+			case w.down >= 3:
+				reason = fmt.Sprintf("instance %s is not running after update", w.paths.name)
+			}
+			if reason != "" {
+				u.autoRollback(reason)
+				return
+			}
+		}
+	}
+
+	for _, w := range watched {
+		if !w.healthy {
+			u.autoRollback(fmt.Sprintf("instance %s did not pass a health check within %s", w.paths.name, u.watchWindow))
+			return
+		}
+	}
+	u.finishWatch(gen, "ok", "")
+}
+
+func (u *Updater) finishWatch(gen time.Time, state, reason string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.rollback == nil || !u.rollback.Since.Equal(gen) {
+		return
+	}
+	u.rollback.State = state
+	u.rollback.Reason = reason
+	log.Printf("[update] watch of client %s finished: %s", u.rollback.Version, state)
+}
+
+func copyFile(src, dst string, mode os.FileMode) error {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	if err := os.WriteFile(tmp, data, mode); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
@@ -0,0 +1,634 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jounts/TrustTunnel4keenetic/internal/routing"
+)
+
+const (
+	scheduleRulesPath = "/opt/trusttunnel_client/schedule.json"
+	scheduleStatePath = "/opt/trusttunnel_client/schedule_state.json"
+
+	scheduleInterval = 30 * time.Second
+	// scheduleHorizon bounds the transition preview; every weekly rule
+	// has an edge within it
+	scheduleHorizon = 8 * 24 * time.Hour
+	// scheduleMaxDuration is the longest window of a cron rule
+	scheduleMaxDuration = 7 * 24 * 60
+	// scheduleJump is the difference between wall-clock and monotonic time
+	// reported as a clock jump
+	scheduleJump = 2 * time.Minute
+	// scheduleSaveEvery limits flash writes of the evaluation time
+	scheduleSaveEvery = time.Hour
+)
+
+// minClockYear rejects the unset clock of a router that booted without NTP.
+const minClockYear = 2024
+
+// Schedule rule actions.
+const (
+	// ScheduleTunnel keeps an instance started (value "on") or stopped
+	// ("off") during the window and in the opposite state outside of it
+	ScheduleTunnel = "tunnel"
+	// SchedulePolicy switches the smart-routing policy during the window
+	SchedulePolicy = "policy"
+	// ScheduleDevice applies a device policy during the window
+	ScheduleDevice = "device"
+)
+
+// overlayOwner names the scheduler's part of the routing overlay.
+const overlayOwner = "schedule"
+
+// ScheduleRule is active during weekly windows (Days, From, To) or for
+// Duration minutes after each match of a cron expression.
+type ScheduleRule struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+	// Days are weekday names ("mon".."sun"); empty means every day. A
+	// window ending before it starts ends on the next day.
+	Days []string `json:"days,omitempty"`
+	From string   `json:"from,omitempty"`
+	To   string   `json:"to,omitempty"`
+	// Cron is a five-field cron expression starting a window of Duration
+	// minutes
+	Cron     string `json:"cron,omitempty"`
+	Duration int    `json:"duration,omitempty"`
+
+	Action   string `json:"action"`
+	Instance string `json:"instance,omitempty"`
+	Device   string `json:"device,omitempty"`
+	// Value is "on"/"off" for tunnel rules, the routing policy for policy
+	// rules and the device policy for device rules
+	Value string `json:"value"`
+}
+
+// ScheduleTransition is an upcoming start or end of a rule's window.
+type ScheduleTransition struct {
+	Time   time.Time `json:"time"`
+	RuleID string    `json:"rule_id"`
+	Rule   string    `json:"rule"`
+	Active bool      `json:"active"`
+	Action string    `json:"action"`
+}
+
+// ScheduleStatus reports the rules and what the scheduler currently applies.
+type ScheduleStatus struct {
+	Rules       []ScheduleRule `json:"rules"`
+	Active      []string       `json:"active"`
+	ClockSynced bool           `json:"clock_synced"`
+	LastEval    *time.Time     `json:"last_eval,omitempty"`
+	// TimeZone is the zone the windows are evaluated in
+	TimeZone string `json:"timezone"`
+}
+
+type scheduleState struct {
+	LastEval time.Time `json:"last_eval"`
+	// Active is the state of each enabled rule at LastEval
+	Active map[string]bool `json:"active,omitempty"`
+}
+
+type span struct {
+	start, end time.Time
+}
+
+// Scheduler applies schedule rules. Each tick it works out from the wall
+// clock which rules are active and acts on the rules whose state changed,
+// so missed edges (reboot, clock jump after NTP sync) are caught up on the
+// next tick and a manual start or stop holds until the next edge. The
+// rule states are saved with the last evaluation, so a restart of the
+// manager is not an edge; rules without a saved state count as changed.
+// Windows are in the router's time zone (see resolveLocation).
+type Scheduler struct {
+	instances *Instances
+	routing   *routing.Manager
+	events    *EventLog
+
+	mu    sync.Mutex
+	rules []ScheduleRule
+	tz    zoneCache
+
+	// evalMu serializes evaluations, which may run the init script
+	evalMu    sync.Mutex
+	active    map[string]bool
+	overlay   *routing.Overlay
+	synced    bool
+	waiting   bool
+	lastTick  time.Time
+	savedEval time.Time
+}
+
+func NewScheduler(instances *Instances, rm *routing.Manager, events *EventLog) *Scheduler {
+	s := &Scheduler{instances: instances, routing: rm, events: events}
+	if data, err := os.ReadFile(scheduleRulesPath); err == nil {
+		if err := json.Unmarshal(data, &s.rules); err != nil {
+			log.Printf("[schedule] %s: %v", scheduleRulesPath, err)
+		}
+	}
+	var st scheduleState
+	if data, err := os.ReadFile(scheduleStatePath); err == nil {
+		json.Unmarshal(data, &st)
+	}
+	s.savedEval = st.LastEval
+	s.active = st.Active
+	return s
+}
+
+// SetTimeZoneSource sets where the router's time zone is read from.
+func (s *Scheduler) SetTimeZoneSource(src TimeZoneSource) {
+	s.tz.setSource(src)
+}
+
+// Run evaluates the rules until ctx is cancelled.
+func (s *Scheduler) Run(ctx context.Context) {
+	s.tick(time.Now())
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.tick(time.Now())
+		}
+	}
+}
+
+func (s *Scheduler) tick(now time.Time) {
+	s.evalMu.Lock()
+	defer s.evalMu.Unlock()
+
+	if !s.lastTick.IsZero() {
+		wall := now.Round(0).Sub(s.lastTick.Round(0))
+		if d := wall - now.Sub(s.lastTick); d > scheduleJump || d < -scheduleJump {
+			s.events.Add(Event{Type: "schedule", Message: fmt.Sprintf("clock jumped by %s, re-evaluating schedule", d.Round(time.Second))})
+		}
+	}
+	s.lastTick = now
+
+	if !s.clockSynced(now) {
+		return
+	}
+	s.evaluate(now)
+	if now.Sub(s.savedEval) >= scheduleSaveEvery || now.Before(s.savedEval) {
+		s.saveState(now)
+	}
+}
+
+// clockSynced reports whether the clock can be trusted. Until the first
+// good reading it must be past minClockYear and not before the last
+// evaluation saved on flash, which a router without NTP sync is.
+func (s *Scheduler) clockSynced(now time.Time) bool {
+	if s.synced {
+		return true
+	}
+	if now.Year() < minClockYear || now.Before(s.savedEval.Add(-scheduleJump)) {
+		if !s.waiting {
+			log.Printf("[schedule] clock not synchronized (%s), waiting", now.Format(time.RFC3339))
+			s.waiting = true
+		}
+		return false
+	}
+	if s.waiting {
+		s.events.Add(Event{Type: "schedule", Message: "clock synchronized, schedule started"})
+	}
+	s.synced = true
+	return true
+}
+
+func (s *Scheduler) saveState(now time.Time) {
+	data, _ := json.Marshal(scheduleState{LastEval: now, Active: s.active})
+	if err := os.WriteFile(scheduleStatePath, data, 0644); err != nil {
+		log.Printf("[schedule] save state: %v", err)
+		return
+	}
+	s.savedEval = now
+}
+
+// evaluate applies the rules whose state changed since the previous
+// evaluation. The caller holds evalMu.
+func (s *Scheduler) evaluate(now time.Time) {
+	loc, _ := s.tz.location()
+	now = now.In(loc)
+	rules := s.Rules()
+	cur := make(map[string]bool, len(rules))
+	for _, r := range rules {
+		if r.Enabled {
+			cur[r.ID] = r.activeAt(now)
+		}
+	}
+
+	// Tunnel rules: the last active rule of an instance wins; when none is
+	// active the instance goes to the opposite of the rule that ended
+	want := make(map[string]string)
+	var order []string
+	for _, r := range rules {
+		if !r.Enabled || r.Action != ScheduleTunnel {
+			continue
+		}
+		prev, known := s.active[r.ID]
+		if known && prev == cur[r.ID] {
+			continue
+		}
+		if _, ok := want[r.Instance]; !ok {
+			order = append(order, r.Instance)
+		}
+		want[r.Instance] = r.stateFor(cur[r.ID])
+	}
+	for _, r := range rules {
+		if r.Enabled && r.Action == ScheduleTunnel && cur[r.ID] && slices.Contains(order, r.Instance) {
+			want[r.Instance] = r.Value
+		}
+	}
+	for _, inst := range order {
+		s.setTunnel(inst, want[inst] == "on")
+	}
+
+	// Policy and device rules are level-triggered through the overlay
+	o := routing.Overlay{Devices: map[string]string{}}
+	for _, r := range rules {
+		if !r.Enabled || !cur[r.ID] {
+			continue
+		}
+		switch r.Action {
+		case SchedulePolicy:
+			o.Policy = r.Value
+		case ScheduleDevice:
+			o.Devices[r.Device] = r.Value
+		}
+	}
+	if s.routing != nil && (s.overlay == nil || !overlayEqual(*s.overlay, o)) {
+		if err := s.routing.SetOverlay(overlayOwner, o); err != nil {
+			log.Printf("[schedule] apply routing overlay: %v", err)
+		} else if s.overlay != nil {
+			s.events.Add(Event{Type: "schedule", Message: "routing schedule: " + describeOverlay(o)})
+		}
+		s.overlay = &o
+	}
+	changed := !maps.Equal(s.active, cur)
+	s.active = cur
+	if changed {
+		s.saveState(now)
+	}
+}
+
+func overlayEqual(a, b routing.Overlay) bool {
+	if a.Policy != b.Policy || len(a.Devices) != len(b.Devices) {
+		return false
+	}
+	for k, v := range a.Devices {
+		if b.Devices[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func describeOverlay(o routing.Overlay) string {
+	var parts []string
+	if o.Policy != "" {
+		parts = append(parts, "policy "+o.Policy)
+	}
+	keys := make([]string, 0, len(o.Devices))
+	for k := range o.Devices {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		parts = append(parts, k+" "+o.Devices[k])
+	}
+	if len(parts) == 0 {
+		return "no active rules, stored settings apply"
+	}
+	return strings.Join(parts, ", ")
+}
+
+// setTunnel starts or stops an instance unless it already is in that state.
+func (s *Scheduler) setTunnel(name string, on bool) {
+	m, _, err := s.instances.Get(name)
+	if err != nil {
+		log.Printf("[schedule] %v", err)
+		return
+	}
+	st, err := m.Status()
+	if err == nil && st.Running == on {
+		return
+	}
+	action := "stop"
+	if on {
+		action = "start"
+	}
+	ev := Event{Type: "schedule", Instance: name, Message: "scheduled " + action}
+	if out, err := m.Control(action); err != nil {
+		ev.Message = fmt.Sprintf("scheduled %s failed: %v", action, err)
+		ev.Reason = out
+	}
+	s.events.Add(ev)
+}
+
+// Rules returns a copy of the rules.
+func (s *Scheduler) Rules() []ScheduleRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return slices.Clone(s.rules)
+}
+
+// Status returns the rules with the currently active ones.
+func (s *Scheduler) Status() ScheduleStatus {
+	st := ScheduleStatus{Rules: s.Rules(), Active: []string{}}
+	s.evalMu.Lock()
+	defer s.evalMu.Unlock()
+	for _, r := range st.Rules {
+		if s.active[r.ID] {
+			st.Active = append(st.Active, r.ID)
+		}
+	}
+	st.ClockSynced = s.synced
+	_, st.TimeZone = s.tz.location()
+	if !s.savedEval.IsZero() {
+		t := s.savedEval
+		st.LastEval = &t
+	}
+	return st
+}
+
+// Create adds a rule and applies the schedule.
+func (s *Scheduler) Create(r ScheduleRule) (ScheduleRule, error) {
+	if err := s.validate(&r); err != nil {
+		return r, err
+	}
+	s.mu.Lock()
+	r.ID = strconv.FormatInt(time.Now().UnixNano(), 36)
+	s.rules = append(s.rules, r)
+	err := s.saveRules()
+	s.mu.Unlock()
+	if err != nil {
+		return r, err
+	}
+	s.reevaluate(r.ID)
+	return r, nil
+}
+
+// Update replaces the rule with the given ID and applies the schedule.
+func (s *Scheduler) Update(id string, r ScheduleRule) (ScheduleRule, error) {
+	if err := s.validate(&r); err != nil {
+		return r, err
+	}
+	r.ID = id
+	s.mu.Lock()
+	i := slices.IndexFunc(s.rules, func(x ScheduleRule) bool { return x.ID == id })
+	if i < 0 {
+		s.mu.Unlock()
+		return r, fmt.Errorf("rule %s not found", id)
+	}
+	s.rules[i] = r
+	err := s.saveRules()
+	s.mu.Unlock()
+	if err != nil {
+		return r, err
+	}
+	s.reevaluate(id)
+	return r, nil
+}
+
+// Delete removes a rule. A running or stopped tunnel stays as it is;
+// routing changes of the rule are reverted.
+func (s *Scheduler) Delete(id string) error {
+	s.mu.Lock()
+	i := slices.IndexFunc(s.rules, func(x ScheduleRule) bool { return x.ID == id })
+	if i < 0 {
+		s.mu.Unlock()
+		return fmt.Errorf("rule %s not found", id)
+	}
+	s.rules = slices.Delete(s.rules, i, i+1)
+	err := s.saveRules()
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	s.reevaluate("")
+	return nil
+}
+
+// reevaluate applies a changed rule as if it had just reached its current
+// state.
+func (s *Scheduler) reevaluate(id string) {
+	s.evalMu.Lock()
+	defer s.evalMu.Unlock()
+	if !s.synced {
+		return
+	}
+	delete(s.active, id)
+	s.evaluate(time.Now())
+}
+
+// saveRules writes the rules; the caller holds mu.
+func (s *Scheduler) saveRules() error {
+	data, err := json.MarshalIndent(s.rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(scheduleRulesPath, append(data, '\n'), 0644)
+}
+
+// Preview returns the next n transitions of the enabled rules, with times
+// in the router's time zone.
+func (s *Scheduler) Preview(now time.Time, n int) []ScheduleTransition {
+	loc, _ := s.tz.location()
+	now = now.In(loc)
+	out := []ScheduleTransition{}
+	horizon := now.Add(scheduleHorizon)
+	for _, r := range s.Rules() {
+		if !r.Enabled {
+			continue
+		}
+		for _, sp := range mergeSpans(r.spans(now, horizon)) {
+			if sp.start.After(now) {
+				out = append(out, ScheduleTransition{Time: sp.start, RuleID: r.ID, Rule: r.Name, Active: true, Action: r.describe(true)})
+			}
+			if sp.end.After(now) && !sp.end.After(horizon) {
+				out = append(out, ScheduleTransition{Time: sp.end, RuleID: r.ID, Rule: r.Name, Active: false, Action: r.describe(false)})
+			}
+		}
+	}
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+	if len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+func (s *Scheduler) validate(r *ScheduleRule) error {
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		r.Name = r.Action
+	}
+	switch {
+	case r.Cron != "":
+		if r.From != "" || r.To != "" || len(r.Days) > 0 {
+			return fmt.Errorf("use either cron or days/from/to")
+		}
+		if _, err := parseCron(r.Cron); err != nil {
+			return err
+		}
+		if r.Duration < 1 || r.Duration > scheduleMaxDuration {
+			return fmt.Errorf("duration must be 1-%d minutes", scheduleMaxDuration)
+		}
+	default:
+		from, ok1 := parseClock(r.From)
+		to, ok2 := parseClock(r.To)
+		if !ok1 || !ok2 || from == to {
+			return fmt.Errorf("from and to must be different HH:MM times")
+		}
+		for i, d := range r.Days {
+			d = strings.ToLower(strings.TrimSpace(d))
+			if !slices.Contains(cronWeekdays, d) {
+				return fmt.Errorf("invalid day %q (mon..sun)", d)
+			}
+			r.Days[i] = d
+		}
+		r.Duration = 0
+	}
+
+	switch r.Action {
+	case ScheduleTunnel:
+		if r.Instance == "" {
+			r.Instance = DefaultInstance
+		}
+		if !s.instances.Exists(r.Instance) {
+			return fmt.Errorf("instance %q not found", r.Instance)
+		}
+		if r.Value != "on" && r.Value != "off" {
+			return fmt.Errorf("tunnel value must be on or off")
+		}
+		r.Device = ""
+	case SchedulePolicy:
+		if !routing.ValidPolicy(r.Value) {
+			return fmt.Errorf("policy must be %s or %s", routing.PolicyTunnelDefault, routing.PolicyDirectDefault)
+		}
+		r.Instance, r.Device = "", ""
+	case ScheduleDevice:
+		key, ok := routing.DeviceKey(r.Device)
+		if !ok {
+			return fmt.Errorf("invalid device %q: need a MAC or IPv4 address", r.Device)
+		}
+		switch r.Value {
+		case routing.DeviceTunnel, routing.DeviceDirect, routing.DeviceSmart:
+		default:
+			return fmt.Errorf("device policy must be tunnel, direct or smart")
+		}
+		r.Device, r.Instance = key, ""
+	default:
+		return fmt.Errorf("action must be tunnel, policy or device")
+	}
+	return nil
+}
+
+// stateFor returns the tunnel state ("on"/"off") while the rule is active
+// or inactive.
+func (r ScheduleRule) stateFor(active bool) string {
+	if active == (r.Value == "on") {
+		return "on"
+	}
+	return "off"
+}
+
+func (r ScheduleRule) describe(active bool) string {
+	switch r.Action {
+	case ScheduleTunnel:
+		if r.stateFor(active) == "on" {
+			return "start " + r.Instance
+		}
+		return "stop " + r.Instance
+	case SchedulePolicy:
+		if active {
+			return "policy " + r.Value
+		}
+		return "policy from settings"
+	case ScheduleDevice:
+		if active {
+			return r.Device + " " + r.Value
+		}
+		return r.Device + " stored policy"
+	}
+	return r.Action
+}
+
+func (r ScheduleRule) activeAt(now time.Time) bool {
+	for _, sp := range r.spans(now, now.Add(time.Second)) {
+		if !now.Before(sp.start) && now.Before(sp.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// spans returns the windows of the rule overlapping [from, to).
+func (r ScheduleRule) spans(from, to time.Time) []span {
+	var out []span
+	if r.Cron != "" {
+		spec, err := parseCron(r.Cron)
+		if err != nil {
+			return nil
+		}
+		dur := time.Duration(r.Duration) * time.Minute
+		for t := from.Add(-dur).Truncate(time.Minute); t.Before(to); t = t.Add(time.Minute) {
+			if spec.matches(t) && t.Add(dur).After(from) {
+				out = append(out, span{t, t.Add(dur)})
+			}
+		}
+		return out
+	}
+
+	start, ok1 := parseClock(r.From)
+	end, ok2 := parseClock(r.To)
+	if !ok1 || !ok2 {
+		return nil
+	}
+	y, m, d := from.Date()
+	for day := time.Date(y, m, d-1, 0, 0, 0, 0, from.Location()); day.Before(to); day = day.AddDate(0, 0, 1) {
+		if len(r.Days) > 0 && !slices.Contains(r.Days, cronWeekdays[day.Weekday()]) {
+			continue
+		}
+		dy, dm, dd := day.Date()
+		sp := span{
+			start: time.Date(dy, dm, dd, start/60, start%60, 0, 0, day.Location()),
+			end:   time.Date(dy, dm, dd, end/60, end%60, 0, 0, day.Location()),
+		}
+		if end <= start {
+			sp.end = sp.end.AddDate(0, 0, 1)
+		}
+		if sp.end.After(from) && sp.start.Before(to) {
+			out = append(out, sp)
+		}
+	}
+	return out
+}
+
+// mergeSpans joins overlapping and adjacent windows of a rule, which are
+// sorted by start.
+func mergeSpans(spans []span) []span {
+	var out []span
+	for _, sp := range spans {
+		if n := len(out); n > 0 && !sp.start.After(out[n-1].end) {
+			if sp.end.After(out[n-1].end) {
+				out[n-1].end = sp.end
+			}
+			continue
+		}
+		out = append(out, sp)
+	}
+	return out
+}
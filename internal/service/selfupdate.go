@@ -0,0 +1,140 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const (
+	managerBinNew    = managerBin + ".new"
+	managerBinBackup = managerBin + ".prev"
+	// managerUpdateMarker holds "pending <new> <previous>" between the swap
+	// and the first healthy start of the new binary. The init script
+	// restores managerBinBackup if it is still pending after a timeout.
+	managerUpdateMarker = "/opt/var/run/trusttunnel_manager.update"
+
+	managerSelfTestTimeout = 10 * time.Second
+)
+
+// replaceManager installs a verified manager binary: it is written next to
+// the running one, test-executed, and atomically renamed over it with the
+// previous binary kept as .prev. The restart is then confirmed by the new
+// process (ConfirmManagerUpdate) or reverted by the init script.
+func (u *Updater) replaceManager(tmpFile, latestVer string, ver *Verification) (*UpdateResult, error) {
+	os.Remove(managerBinNew)
+	if err := copyFile(tmpFile, managerBinNew, 0755); err != nil {
+		return nil, fmt.Errorf("stage binary: %w", err)
+	}
+	reported, err := stageManager(managerBinNew)
+	if err != nil {
+		os.Remove(managerBinNew)
+		u.audit("manager", latestVer, nil, err)
+		return nil, err
+	}
+	if latestVer == "" || latestVer == "upload" {
+		latestVer = reported
+	} else if reported != latestVer {
+		log.Printf("[update-manager] release %s reports version %s", latestVer, reported)
+	}
+
+	if err := markManagerUpdate(latestVer); err != nil {
+		os.Remove(managerBinNew)
+		return nil, err
+	}
+	if err := os.Rename(managerBinNew, managerBin); err != nil {
+		os.Remove(managerBinNew)
+		os.Remove(managerUpdateMarker)
+		return nil, fmt.Errorf("replace binary: %w", err)
+	}
+
+	u.audit("manager", latestVer, ver, nil)
+	log.Printf("[update-manager] binary replaced, scheduling restart, new version: %s", latestVer)
+	return managerUpdated(latestVer, ver), nil
+}
+
+// managerUpdated schedules a detached restart, which survives termination
+// of the current process, and reports the installed version.
+func managerUpdated(version string, ver *Verification) *UpdateResult {
+	exec.Command("sh", "-c",
+		fmt.Sprintf("sleep 1 && %s restart", managerInitScript),
+	).Start()
+
+	return &UpdateResult{
+		Success:  true,
+		Message:  "Manager updated, restarting...",
+		Version:  version,
+		SHA256:   ver.SHA256,
+		Verified: ver.String(),
+	}
+}
+
+// stageManager checks the architecture of a new manager binary and
+// test-executes it, returning the version it reports.
+func stageManager(path string) (string, error) {
+	if err := checkBinaryArch(path); err != nil {
+		return "", err
+	}
+	return selfTestManager(path)
+}
+
+// markManagerUpdate keeps the running binary as .prev and records the
+// pending update, so the init script can restore it if the new version
+// does not confirm its start.
+func markManagerUpdate(newVer string) error {
+	if err := copyFile(managerBin, managerBinBackup, 0755); err != nil {
+		return fmt.Errorf("backup binary: %w", err)
+	}
+	marker := fmt.Sprintf("pending %s %s\n", newVer, managerVersion())
+	if err := os.WriteFile(managerUpdateMarker, []byte(marker), 0644); err != nil {
+		return fmt.Errorf("write update marker: %w", err)
+	}
+	return nil
+}
+
+// selfTestManager runs the staged binary with -version and returns the
+// version it reports.
+func selfTestManager(path string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), managerSelfTestTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, path, "-version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("self-test of new manager failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) < 2 || fields[0] != "trusttunnel-manager" {
+		return "", fmt.Errorf("self-test of new manager failed: unexpected output %q", strings.TrimSpace(string(out)))
+	}
+	return fields[1], nil
+}
+
+// ConfirmManagerUpdate is called once the manager is serving. If it was
+// started by a self-update, the pending marker is cleared so the init script
+// keeps the new binary.
+func ConfirmManagerUpdate(events *EventLog) {
+	data, err := os.ReadFile(managerUpdateMarker)
+	if err != nil {
+		return
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 || fields[0] != "pending" {
+		return
+	}
+	if err := os.Remove(managerUpdateMarker); err != nil {
+		log.Printf("[update-manager] clear update marker: %v", err)
+		return
+	}
+	prev := ""
+	if len(fields) > 2 {
+		prev = fields[2]
+	}
+	log.Printf("[update-manager] update to %s confirmed", managerVersion())
+	events.Add(Event{
+		Type:    "update",
+		Message: fmt.Sprintf("manager %s started, update from %s confirmed", managerVersion(), prev),
+	})
+}
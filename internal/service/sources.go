@@ -0,0 +1,360 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	SourceGitHub = "github"
+	SourceProxy  = "proxy"
+	SourceMirror = "mirror"
+	SourceTunnel = "tunnel"
+
+	defaultUpdateSources = SourceGitHub
+)
+
+// releaseSource is one place releases are fetched from. UPDATE_SOURCES in
+// update.conf lists them comma-separated and they are tried in order:
+//
+//	github                       api.github.com directly
+//	proxy:https://gh.example/    GitHub through a URL prefix proxy
+//	mirror:http://host/path      plain HTTP mirror, see mirrorReleases
+//	tunnel                       GitHub through the SOCKS5 listener of the
+//	                             default instance
+type releaseSource struct {
+	kind string
+	base string
+}
+
+func (s releaseSource) String() string {
+	if s.base == "" {
+		return s.kind
+	}
+	return s.kind + ":" + s.base
+}
+
+// parseSources parses an UPDATE_SOURCES value.
+func parseSources(spec string) ([]releaseSource, error) {
+	var list []releaseSource
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kind, base, _ := strings.Cut(item, ":")
+		src := releaseSource{kind: kind, base: strings.TrimRight(base, "/")}
+		switch kind {
+		case SourceGitHub, SourceTunnel:
+			if base != "" {
+				return nil, fmt.Errorf("source %q takes no URL", kind)
+			}
+		case SourceProxy, SourceMirror:
+			if u, err := url.Parse(src.base); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return nil, fmt.Errorf("source %q needs an http(s) URL", item)
+			}
+			if kind == SourceProxy {
+				// The proxied URL is appended verbatim
+				src.base += "/"
+			}
+		default:
+			return nil, fmt.Errorf("unknown update source %q", kind)
+		}
+		list = append(list, src)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("no update sources configured")
+	}
+	return list, nil
+}
+
+// formatSources is the inverse of parseSources.
+func formatSources(list []releaseSource) string {
+	parts := make([]string, 0, len(list))
+	for _, s := range list {
+		parts = append(parts, strings.TrimSuffix(s.String(), "/"))
+	}
+	return strings.Join(parts, ",")
+}
+
+// sources returns the configured release sources, falling back to GitHub.
+func (u *Updater) sources() []releaseSource {
+	list, err := parseSources(u.Settings().Sources)
+	if err != nil {
+		log.Printf("[update] %v, using GitHub", err)
+		list = []releaseSource{{kind: SourceGitHub}}
+	}
+	return list
+}
+
+// httpClient returns a client for this source. The tunnel source dials
+// through the SOCKS5 listener of the default instance.
+func (s releaseSource) httpClient(timeout time.Duration) (*http.Client, error) {
+	if s.kind != SourceTunnel {
+		return &http.Client{Timeout: timeout}, nil
+	}
+	mode, err := NewConfigManager().ReadMode()
+	if err != nil {
+		return nil, err
+	}
+	if mode.Mode != "socks5" {
+		return nil, fmt.Errorf("tunnel source needs the default instance in SOCKS5 mode")
+	}
+	proxy, _ := url.Parse(fmt.Sprintf("socks5://127.0.0.1:%d", mode.SocksPort))
+	return &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxy)},
+		Timeout:   timeout,
+	}, nil
+}
+
+// rewrite maps a GitHub URL to the URL fetched from this source.
+func (s releaseSource) rewrite(rawURL string) string {
+	if s.kind == SourceProxy {
+		return s.base + rawURL
+	}
+	return rawURL
+}
+
+// get performs a GET through the source.
+func (s releaseSource) get(rawURL string, timeout time.Duration, header http.Header) (*http.Response, error) {
+	return s.getContext(context.Background(), rawURL, timeout, header)
+}
+
+func (s releaseSource) getContext(ctx context.Context, rawURL string, timeout time.Duration, header http.Header) (*http.Response, error) {
+	client, err := s.httpClient(timeout)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("User-Agent", userAgent)
+	return client.Do(req)
+}
+
+// listReleases tries every source in order and returns the releases of the
+// first one that answers.
+func (u *Updater) listReleases(repo string) ([]githubRelease, error) {
+	var errs []error
+	for _, src := range u.sources() {
+		var list []githubRelease
+		var err error
+		if src.kind == SourceMirror {
+			list, err = mirrorReleases(src, repo)
+		} else {
+			list, err = u.githubReleases(src, repo)
+		}
+		if err == nil {
+			return list, nil
+		}
+		log.Printf("[update] source %s: %v", src, err)
+		errs = append(errs, fmt.Errorf("%s: %w", src, err))
+	}
+	return nil, errors.Join(errs...)
+}
+
+// githubReleases fetches recent releases of repo from the GitHub API,
+// directly, via a proxy prefix or through the tunnel. Responses are cached by
+// ETag so repeated checks do not eat into the GitHub rate limit.
+func (u *Updater) githubReleases(src releaseSource, repo string) ([]githubRelease, error) {
+	apiURL := src.rewrite(fmt.Sprintf("%s/%s/releases?per_page=%d", githubAPI, repo, releasesPerPage))
+	key := src.String() + " " + repo
+
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github.v3+json")
+
+	u.etagMu.Lock()
+	cached, hasCache := u.etagCache[key]
+	u.etagMu.Unlock()
+	if hasCache && cached.etag != "" {
+		header.Set("If-None-Match", cached.etag)
+	}
+
+	resp, err := src.get(apiURL, 15*time.Second, header)
+	if err != nil {
+		if hasCache && len(cached.releases) > 0 {
+			log.Printf("[update] request to %s failed: %v, using cached releases", apiURL, err)
+			return cached.releases, nil
+		}
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	remaining := resp.Header.Get("X-Ratelimit-Remaining")
+	log.Printf("[update] %s HTTP %d (rate-limit remaining: %s)", apiURL, resp.StatusCode, remaining)
+
+	if resp.StatusCode == http.StatusNotModified && hasCache {
+		return cached.releases, nil
+	}
+
+	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == 429 {
+		if hasCache && len(cached.releases) > 0 {
+			log.Printf("[update] rate limited, using cached releases")
+			return cached.releases, nil
+		}
+		return nil, fmt.Errorf("GitHub API rate limit exceeded (HTTP %d)", resp.StatusCode)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("GitHub API returned HTTP %d: %s", resp.StatusCode, string(body))
+	}
+
+	body, _ := io.ReadAll(resp.Body)
+
+	var list []githubRelease
+	if err := json.Unmarshal(body, &list); err != nil {
+		return nil, fmt.Errorf("json decode: %w", err)
+	}
+	for i := range list {
+		list[i].setSource(src)
+	}
+
+	u.etagMu.Lock()
+	u.etagCache[key] = etagEntry{etag: resp.Header.Get("ETag"), releases: list}
+	u.etagMu.Unlock()
+	return list, nil
+}
+
+// githubReleaseByTag asks the GitHub API for a single tag, for tags that are
+// too old to be in the recent list.
+func (u *Updater) githubReleaseByTag(src releaseSource, repo, tag string) (*githubRelease, error) {
+	header := http.Header{}
+	header.Set("Accept", "application/vnd.github.v3+json")
+	resp, err := src.get(src.rewrite(fmt.Sprintf("%s/%s/releases/tags/%s", githubAPI, repo, tag)), 15*time.Second, header)
+	if err != nil {
+		return nil, fmt.Errorf("request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("release %s not found in %s", tag, repo)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GitHub API returned HTTP %d", resp.StatusCode)
+	}
+	var rel githubRelease
+	if err := json.NewDecoder(resp.Body).Decode(&rel); err != nil {
+		return nil, fmt.Errorf("json decode: %w", err)
+	}
+	rel.setSource(src)
+	return &rel, nil
+}
+
+// setSource records where the release came from and points its asset URLs
+// at that source.
+func (r *githubRelease) setSource(src releaseSource) {
+	r.src = src
+	for i := range r.Assets {
+		r.Assets[i].BrowserDownloadURL = src.rewrite(r.Assets[i].BrowserDownloadURL)
+	}
+}
+
+// mirrorComponent is the directory of repo on a mirror.
+func mirrorComponent(repo string) string {
+	if repo == managerRepo {
+		return "manager"
+	}
+	return "client"
+}
+
+// mirrorReleases reads a plain HTTP mirror laid out as
+//
+//	<base>/client/releases.txt             tags, newest first; a second
+//	                                       field "prerelease" marks those
+//	<base>/client/<tag>/SHA256SUMS         checksums of every asset
+//	<base>/client/<tag>/<asset>
+//
+// and the same under manager/. The asset list of a release is taken from
+// its SHA256SUMS, which is needed for verification anyway.
+func mirrorReleases(src releaseSource, repo string) ([]githubRelease, error) {
+	dir := src.base + "/" + mirrorComponent(repo)
+	index, err := mirrorFetch(src, dir+"/releases.txt")
+	if err != nil {
+		return nil, err
+	}
+
+	var list []githubRelease
+	scanner := bufio.NewScanner(bytes.NewReader(index))
+	for scanner.Scan() && len(list) < releasesPerPage {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") || !ValidTag(fields[0]) {
+			continue
+		}
+		rel, err := mirrorRelease(src, repo, fields[0])
+		if err != nil {
+			log.Printf("[update] mirror %s: %v", src, err)
+			continue
+		}
+		rel.Prerelease = len(fields) > 1 && fields[1] == "prerelease"
+		list = append(list, *rel)
+	}
+	if len(list) == 0 {
+		return nil, fmt.Errorf("mirror lists no usable releases")
+	}
+	return list, nil
+}
+
+func mirrorRelease(src releaseSource, repo, tag string) (*githubRelease, error) {
+	dir := src.base + "/" + mirrorComponent(repo) + "/" + tag
+	sums, err := mirrorFetch(src, dir+"/SHA256SUMS")
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", tag, err)
+	}
+	rel := &githubRelease{TagName: tag, Name: tag, src: src}
+	rel.Assets = append(rel.Assets, githubAsset{Name: "SHA256SUMS", BrowserDownloadURL: dir + "/SHA256SUMS"})
+	for _, name := range sumsFileNames(sums) {
+		rel.Assets = append(rel.Assets, githubAsset{Name: name, BrowserDownloadURL: dir + "/" + name})
+	}
+	if repo == managerRepo {
+		// Signatures are optional; only list the ones the mirror has
+		for _, ext := range []string{".minisig", ".sig"} {
+			if _, err := mirrorFetch(src, dir+"/SHA256SUMS"+ext); err == nil {
+				rel.Assets = append(rel.Assets, githubAsset{Name: "SHA256SUMS" + ext, BrowserDownloadURL: dir + "/SHA256SUMS" + ext})
+			}
+		}
+	}
+	return rel, nil
+}
+
+func mirrorFetch(src releaseSource, rawURL string) ([]byte, error) {
+	resp, err := src.get(rawURL, 15*time.Second, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP %d", rawURL, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxSumsSize))
+}
+
+// sumsFileNames lists the file names in sha256sum output.
+func sumsFileNames(sums []byte) []string {
+	var names []string
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		name := strings.TrimPrefix(strings.TrimPrefix(fields[1], "*"), "./")
+		if name != "" && !strings.Contains(name, "/") {
+			names = append(names, name)
+		}
+	}
+	return names
+}
@@ -0,0 +1,125 @@
+package service
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// timeZoneRefresh is how long a resolved time zone is used before the
+// router is asked again, so a zone changed in the web UI is picked up.
+const timeZoneRefresh = 10 * time.Minute
+
+// TimeZoneSource returns the router's time zone: a name and a POSIX TZ
+// rule ("MSK-3", "CET-1CEST,M3.5.0,M10.5.0/3"); either may be empty.
+type TimeZoneSource func() (name, rule string, err error)
+
+// zoneCache keeps the router's time zone, resolving it again every
+// timeZoneRefresh.
+type zoneCache struct {
+	mu   sync.Mutex
+	src  TimeZoneSource
+	loc  *time.Location
+	zone string
+	at   time.Time
+}
+
+func (z *zoneCache) setSource(src TimeZoneSource) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.src = src
+	z.loc = nil
+}
+
+// location returns the time zone and its description.
+func (z *zoneCache) location() (*time.Location, string) {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if z.loc == nil || time.Since(z.at) > timeZoneRefresh {
+		loc, zone := resolveLocation(z.src)
+		if z.loc != nil && zone != z.zone {
+			log.Printf("[timezone] time zone changed: %s -> %s", z.zone, zone)
+		}
+		z.loc, z.zone, z.at = loc, zone, time.Now()
+	}
+	return z.loc, z.zone
+}
+
+// resolveLocation returns the router's time zone and a description
+// of it. An exported TZ wins, then the router's zone from src; without
+// either Go's local zone is used, which on Entware is usually UTC.
+func resolveLocation(src TimeZoneSource) (*time.Location, string) {
+	if tz := os.Getenv("TZ"); tz != "" {
+		if loc, err := loadZone(tz, tz); err == nil {
+			return loc, "TZ=" + tz
+		}
+	}
+	if src != nil {
+		name, rule, err := src()
+		if err == nil {
+			if loc, err := loadZone(name, rule); err == nil {
+				return loc, describeZone(name, rule)
+			}
+			err = fmt.Errorf("unknown time zone %q (%s)", name, rule)
+		}
+		log.Printf("[timezone] router time zone: %v", err)
+	}
+	return time.Local, time.Local.String()
+}
+
+func describeZone(name, rule string) string {
+	switch {
+	case name == "":
+		return rule
+	case rule == "" || rule == name:
+		return name
+	}
+	return name + " (" + rule + ")"
+}
+
+// loadZone loads a zone from the zoneinfo database by name or, as Entware
+// usually has no zoneinfo, from its POSIX TZ rule.
+func loadZone(name, rule string) (*time.Location, error) {
+	if name != "" {
+		if loc, err := time.LoadLocation(name); err == nil {
+			return loc, nil
+		}
+	}
+	if rule == "" {
+		return nil, fmt.Errorf("unknown time zone %q", name)
+	}
+	return posixLocation(describeZone(name, rule), rule)
+}
+
+// posixLocation builds a zone from a POSIX TZ rule. Go only reads such
+// rules as the footer of TZif data, so it is wrapped in a TZif file without
+// transitions; the footer then applies to all times.
+func posixLocation(name, rule string) (*time.Location, error) {
+	var b bytes.Buffer
+	header := func() {
+		b.WriteString("TZif2")
+		b.Write(make([]byte, 15))
+		// isutcnt, isstdcnt, leapcnt, timecnt, typecnt, charcnt
+		for _, n := range []uint32{0, 0, 0, 0, 1, 1} {
+			binary.Write(&b, binary.BigEndian, n)
+		}
+		// One UTC type and an empty abbreviation
+		b.Write(make([]byte, 7))
+	}
+	header()
+	header()
+	b.WriteString("\n" + rule + "\n")
+	loc, err := time.LoadLocationFromTZData(name, b.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	// An invalid rule falls back to the UTC type, which has no name
+	if abbr, _ := time.Now().In(loc).Zone(); abbr == "" {
+		return nil, fmt.Errorf("invalid TZ rule %q", rule)
+	}
+	return loc, nil
+}
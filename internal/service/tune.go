@@ -0,0 +1,277 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	tuneStartupWait  = 8 * time.Second
+	tuneLatencyTries = 3
+	tuneSpeedLimit   = 10 * time.Second
+	// tuneSpeedURL serves a fixed-size body for the throughput measurement.
+	tuneSpeedURL = "https://speed.cloudflare.com/__down?bytes=5000000"
+)
+
+// TuneCandidate is one upstream transport combination.
+type TuneCandidate struct {
+	Protocol string `json:"upstream_protocol"`
+	AntiDPI  bool   `json:"anti_dpi"`
+}
+
+func (c TuneCandidate) String() string {
+	return fmt.Sprintf("%s, anti_dpi=%t", c.Protocol, c.AntiDPI)
+}
+
+type TuneResult struct {
+	TuneCandidate
+	Healthy   bool    `json:"healthy"`
+	LatencyMs float64 `json:"latency_ms"`
+	SpeedKbps float64 `json:"speed_kbps"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type TuneReport struct {
+	Original TuneCandidate `json:"original"`
+	Results  []TuneResult  `json:"results"`
+	Winner   *TuneResult   `json:"winner,omitempty"`
+	Applied  bool          `json:"applied"`
+}
+
+// TuneCandidates lists the combinations tried by Tune.
+func TuneCandidates() []TuneCandidate {
+	var list []TuneCandidate
+	for _, proto := range []string{"http2", "http3"} {
+		for _, anti := range []bool{false, true} {
+			list = append(list, TuneCandidate{Protocol: proto, AntiDPI: anti})
+		}
+	}
+	return list
+}
+
+// Tune stops the instance, runs the client with a temporary SOCKS5 config
+// for each candidate, measures health, latency and throughput, and ranks the
+// results. The instance TOML is only touched when apply is set and a
+// candidate passed; the instance is restarted if it was running before.
+func Tune(ctx context.Context, j *Job, m *Manager, apply bool) (*TuneReport, error) {
+	cfg := m.config
+	mode, err := cfg.ReadMode()
+	if err != nil {
+		return nil, err
+	}
+	original, err := os.ReadFile(cfg.clientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("read client config: %w", err)
+	}
+	base := ensureEndpointSection(string(original))
+
+	report := &TuneReport{Original: TuneCandidate{
+		Protocol: tomlSectionValue(base, "[endpoint]", "upstream_protocol"),
+		AntiDPI:  tomlSectionValue(base, "[endpoint]", "anti_dpi") == "true",
+	}}
+	if report.Original.Protocol == "" {
+		report.Original.Protocol = "http2"
+	}
+
+	wasRunning := false
+	if st, _ := m.Status(); st != nil && st.Running {
+		wasRunning = true
+		j.Logf("stopping instance %s", m.Name())
+		if _, err := m.Control("stop"); err != nil {
+			return nil, err
+		}
+	}
+	defer func() {
+		if wasRunning {
+			j.Logf("starting instance %s", m.Name())
+			if _, err := m.Control("start"); err != nil {
+				j.Logf("start failed: %v", err)
+			}
+		}
+	}()
+
+	tmpConf := filepath.Join(os.TempDir(), "trusttunnel_tune_"+m.Name()+".toml")
+	defer os.Remove(tmpConf)
+
+	candidates := TuneCandidates()
+	for i, cand := range candidates {
+		if ctx.Err() != nil {
+			j.Logf("cancelled, original config kept")
+			return report, ctx.Err()
+		}
+		j.Logf("trying %s", cand)
+		res := tuneOne(ctx, base, tmpConf, mode, cand)
+		if res.Healthy {
+			j.Logf("%s: latency %.0f ms, %.0f kbit/s", cand, res.LatencyMs, res.SpeedKbps)
+		} else {
+			j.Logf("%s: failed: %s", cand, res.Error)
+		}
+		report.Results = append(report.Results, res)
+		j.SetProgress((i + 1) * 100 / (len(candidates) + 1))
+		partial := *report
+		partial.Results = append([]TuneResult(nil), report.Results...)
+		j.SetResult(&partial)
+	}
+
+	sort.SliceStable(report.Results, func(a, b int) bool {
+		ra, rb := report.Results[a], report.Results[b]
+		if ra.Healthy != rb.Healthy {
+			return ra.Healthy
+		}
+		if ra.SpeedKbps != rb.SpeedKbps {
+			return ra.SpeedKbps > rb.SpeedKbps
+		}
+		return ra.LatencyMs < rb.LatencyMs
+	})
+	if len(report.Results) > 0 && report.Results[0].Healthy {
+		w := report.Results[0]
+		report.Winner = &w
+	}
+
+	switch {
+	case report.Winner == nil:
+		j.Logf("no combination passed the health check, original config kept")
+	case !apply:
+		j.Logf("winner: %s (not applied)", report.Winner.TuneCandidate)
+	default:
+		content := applyTuneCandidate(string(original), report.Winner.TuneCandidate)
+		if err := os.WriteFile(cfg.clientConfig, []byte(content), 0644); err != nil {
+			return report, fmt.Errorf("write client config: %w", err)
+		}
+		report.Applied = true
+		j.Logf("applied %s", report.Winner.TuneCandidate)
+	}
+	return report, nil
+}
+
+// applyTuneCandidate sets the transport keys of the [endpoint] section. The
+// fallback protocol is cleared when it equals the chosen protocol.
+func applyTuneCandidate(content string, c TuneCandidate) string {
+	content = ensureEndpointSection(content)
+	content = setTomlSectionValue(content, "[endpoint]", "upstream_protocol", strconv.Quote(c.Protocol))
+	content = setTomlSectionValue(content, "[endpoint]", "anti_dpi", strconv.FormatBool(c.AntiDPI))
+	if tomlSectionValue(content, "[endpoint]", "upstream_fallback_protocol") == c.Protocol {
+		other := "http2"
+		if c.Protocol == "http2" {
+			other = "http3"
+		}
+		content = setTomlSectionValue(content, "[endpoint]", "upstream_fallback_protocol", strconv.Quote(other))
+	}
+	return content
+}
+
+func tuneOne(ctx context.Context, base, tmpConf string, mode *ModeInfo, cand TuneCandidate) TuneResult {
+	res := TuneResult{TuneCandidate: cand}
+
+	// Fallback is disabled so a failing protocol is not masked by the other one
+	content := ensureVpnMode(applyTuneCandidate(base, cand))
+	section := removeTomlKey(extractTomlSection(content, "[endpoint]"), "upstream_fallback_protocol")
+	for _, s := range []string{"[endpoint]", "[listener.tun]", "[listener.socks]"} {
+		content = removeTomlSection(content, s)
+	}
+	content = strings.TrimRight(content, "\n") + "\n\n" + section + "\n"
+	content += fmt.Sprintf("\n[listener.socks]\naddress = \"127.0.0.1:%d\"\n", mode.SocksPort)
+
+	if err := os.WriteFile(tmpConf, []byte(content), 0600); err != nil {
+		res.Error = err.Error()
+		return res
+	}
+
+	cmd := exec.Command(clientBin, "--config", tmpConf)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		res.Error = "start client: " + err.Error()
+		return res
+	}
+	defer func() {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGTERM)
+		done := make(chan struct{})
+		go func() { cmd.Wait(); close(done) }()
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+			<-done
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+		res.Error = "cancelled"
+		return res
+	case <-time.After(tuneStartupWait):
+	}
+
+	proxy, _ := url.Parse(fmt.Sprintf("socks5://127.0.0.1:%d", mode.SocksPort))
+	client := &http.Client{
+		Transport: &http.Transport{Proxy: http.ProxyURL(proxy)},
+		Timeout:   time.Duration(mode.HCCurlTimeout+5) * time.Second,
+	}
+
+	var total time.Duration
+	ok := 0
+	for i := 0; i < tuneLatencyTries; i++ {
+		start := time.Now()
+		req, _ := http.NewRequestWithContext(ctx, http.MethodGet, mode.HCTargetURL, nil)
+		resp, err := client.Do(req)
+		if err != nil {
+			res.Error = err.Error()
+			continue
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			res.Error = "health check: HTTP " + strconv.Itoa(resp.StatusCode)
+			continue
+		}
+		total += time.Since(start)
+		ok++
+	}
+	if ok == 0 {
+		return res
+	}
+	res.Healthy = true
+	res.Error = ""
+	res.LatencyMs = round1(float64(total.Microseconds()) / 1000 / float64(ok))
+
+	speedCtx, cancel := context.WithTimeout(ctx, tuneSpeedLimit)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(speedCtx, http.MethodGet, tuneSpeedURL, nil)
+	client.Timeout = 0
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		res.Error = "throughput: " + err.Error()
+		return res
+	}
+	n, _ := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+		res.SpeedKbps = round1(float64(n) * 8 / 1000 / elapsed)
+	}
+	return res
+}
+
+// removeTomlKey drops a single-line key from a TOML fragment.
+func removeTomlKey(content, key string) string {
+	var out []string
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if eqIdx := strings.Index(trimmed, "="); eqIdx > 0 && strings.TrimSpace(trimmed[:eqIdx]) == key {
+			continue
+		}
+		out = append(out, line)
+	}
+	return strings.Join(out, "\n")
+}
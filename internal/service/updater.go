@@ -1,14 +1,13 @@
 package service
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
-	"net/http"
 	"os"
 	"os/exec"
-	"runtime"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -30,34 +29,77 @@ type UpdateInfo struct {
 	ManagerLatestVersion  string `json:"manager_latest_version"`
 	ManagerUpdateAvailable bool  `json:"manager_update_available"`
 	ManagerCheckError     string `json:"manager_check_error,omitempty"`
+	Channel               string `json:"channel"`
+	ClientPin             string `json:"client_pin,omitempty"`
+	ManagerPin            string `json:"manager_pin,omitempty"`
+	RollbackAvailable     bool            `json:"rollback_available"`
+	Rollback              *RollbackStatus `json:"rollback,omitempty"`
+	AutoUpdate            AutoUpdateStatus `json:"auto_update"`
+	// ManagerInstall is "opkg" for package installs, updated with opkg, or
+	// "binary" for script installs, updated by replacing the binary
+	ManagerInstall string `json:"manager_install"`
 }
 
 type UpdateResult struct {
 	Success bool   `json:"success"`
 	Message string `json:"message"`
 	Version string `json:"version"`
+	// SHA256 of the installed asset, checked against the release SHA256SUMS
+	SHA256   string `json:"sha256,omitempty"`
+	Verified string `json:"verified,omitempty"`
 }
 
 const userAgent = "TrustTunnel-Manager/1.0"
 
+var errUpdateInProgress = errors.New("another update is in progress")
+
+const releasesPerPage = 20
+
 type etagEntry struct {
-	etag    string
-	version string
+	etag     string
+	releases []githubRelease
 }
 
 type Updater struct {
 	mu         sync.Mutex
-	httpClient *http.Client
 	cache      *UpdateInfo
 	cacheTime  time.Time
+	etagMu     sync.Mutex
 	etagCache  map[string]etagEntry
+	events     *EventLog
+	verify     string
+
+	watchWindow time.Duration
+	rollback    *RollbackStatus
+
+	// installMu serializes manual and automatic installs
+	installMu sync.Mutex
+	auto      AutoUpdateStatus
+	tz        zoneCache
+	notified  map[string]bool
+	attempted map[string]time.Time
 }
 
-func NewUpdater() *Updater {
+func NewUpdater(events *EventLog) *Updater {
 	return &Updater{
-		httpClient: &http.Client{Timeout: 15 * time.Second},
 		etagCache:  make(map[string]etagEntry),
+		events:      events,
+		verify:      VerifyChecksum,
+		watchWindow: defaultWatchWindow,
+		notified:    make(map[string]bool),
+		attempted:   make(map[string]time.Time),
+	}
+}
+
+// SetVerifyPolicy selects how downloaded releases are verified:
+// VerifyChecksum (SHA256SUMS required) or VerifySignature (SHA256SUMS and a
+// valid signature required for manager releases).
+func (u *Updater) SetVerifyPolicy(policy string) {
+	if policy == VerifySignature {
+		u.verify = VerifySignature
+		return
 	}
+	u.verify = VerifyChecksum
 }
 
 func (u *Updater) InvalidateCache() {
@@ -72,17 +114,22 @@ func (u *Updater) Check() (*UpdateInfo, error) {
 
 	if u.cache != nil && time.Since(u.cacheTime) < 30*time.Minute {
 		log.Printf("[update] returning cached result (age %s)", time.Since(u.cacheTime).Round(time.Second))
-		return u.cache, nil
+		return u.withRollback(u.cache), nil
 	}
 
-	info := &UpdateInfo{}
+	settings := u.Settings()
+	info := &UpdateInfo{
+		Channel:    settings.Channel,
+		ClientPin:  settings.ClientPin,
+		ManagerPin: settings.ManagerPin,
+	}
 
 	info.ClientCurrentVersion = detectClientVersion()
 	log.Printf("[update] client current version: %s", info.ClientCurrentVersion)
 
 	if latest, err := u.latestRelease(clientRepo); err == nil {
 		info.ClientLatestVersion = latest
-		info.ClientUpdateAvailable = isNewer(latest, info.ClientCurrentVersion)
+		info.ClientUpdateAvailable = settings.ClientPin == "" && isNewer(latest, info.ClientCurrentVersion)
 	} else {
 		info.ClientCheckError = err.Error()
 		log.Printf("[update] failed to check client release: %v", err)
@@ -93,7 +140,7 @@ func (u *Updater) Check() (*UpdateInfo, error) {
 
 	if latest, err := u.latestRelease(managerRepo); err == nil {
 		info.ManagerLatestVersion = latest
-		info.ManagerUpdateAvailable = isNewer(latest, info.ManagerCurrentVersion)
+		info.ManagerUpdateAvailable = settings.ManagerPin == "" && isNewer(latest, info.ManagerCurrentVersion)
 	} else {
 		info.ManagerCheckError = err.Error()
 		log.Printf("[update] failed to check manager release: %v", err)
@@ -105,67 +152,107 @@ func (u *Updater) Check() (*UpdateInfo, error) {
 
 	u.cache = info
 	u.cacheTime = time.Now()
-	return info, nil
+	return u.withRollback(info), nil
 }
 
-func (u *Updater) Install() (*UpdateResult, error) {
-	arch := detectArch()
-	osName := "linux"
+// withRollback returns a copy of info with the current rollback and
+// auto-update state; the caller holds u.mu.
+func (u *Updater) withRollback(info *UpdateInfo) *UpdateInfo {
+	out := *info
+	out.AutoUpdate = u.auto
+	_, out.AutoUpdate.TimeZone = u.tz.location()
+	out.ManagerInstall = managerInstallMethod()
+	out.RollbackAvailable = RollbackAvailable()
+	if u.rollback != nil {
+		st := *u.rollback
+		out.Rollback = &st
+	}
+	return &out
+}
+
+// Install downloads and installs the client release with the given tag, or
+// the latest release on the configured channel when tag is empty. Progress
+// is reported to j, which may be nil.
+func (u *Updater) Install(ctx context.Context, j *Job, tag string) (*UpdateResult, error) {
+	if !u.installMu.TryLock() {
+		return nil, errUpdateInProgress
+	}
+	defer u.installMu.Unlock()
 
-	assetSuffix := fmt.Sprintf("-%s-%s.tar.gz", osName, arch)
-	log.Printf("[update] searching asset: prefix=%q suffix=%q", "trusttunnel_client", assetSuffix)
+	prefix, suffix := clientAssetPattern()
+	log.Printf("[update] searching asset: prefix=%q suffix=%q", prefix, suffix)
 
-	downloadURL, err := u.findAssetURL(clientRepo, "trusttunnel_client", assetSuffix)
+	rel, err := u.fetchRelease(clientRepo, tag)
+	if err != nil {
+		return nil, fmt.Errorf("find asset: %w", err)
+	}
+	asset, err := rel.findAsset(prefix, suffix)
 	if err != nil {
 		return nil, fmt.Errorf("find asset: %w", err)
 	}
-	log.Printf("[update] downloading %s", downloadURL)
+	j.Logf("downloading %s (%s) from %s", asset.Name, formatBytes(asset.Size), rel.src)
 
-	tmpFile := "/tmp/trusttunnel_update.tar.gz"
-	if err := u.download(downloadURL, tmpFile); err != nil {
+	tmpFile, err := u.download(ctx, j, rel.src, asset.BrowserDownloadURL, asset.Name, asset.Size)
+	if err != nil {
 		return nil, fmt.Errorf("download: %w", err)
 	}
 	defer os.Remove(tmpFile)
 
-	if info, err := os.Stat(tmpFile); err == nil {
-		log.Printf("[update] downloaded %d bytes", info.Size())
+	ver, err := u.verifyAsset(rel, asset.Name, tmpFile, false)
+	if err != nil {
+		u.audit("client", rel.TagName, nil, err)
+		return nil, fmt.Errorf("verify: %w", err)
 	}
+	j.Logf("verified %s: %s", asset.Name, ver)
 
-	svcMgr := NewManager()
-	log.Printf("[update] stopping TrustTunnel client")
-	svcMgr.Control("stop")
+	return u.installClientArchive(tmpFile, ver)
+}
 
-	log.Printf("[update] extracting to /opt/trusttunnel_client/")
-	tmpDir := "/tmp/trusttunnel_extract"
+// installClientArchive replaces the client binary with the one in a
+// verified release tarball, restarts all instances and starts watching the
+// new version for a rollback.
+func (u *Updater) installClientArchive(tmpFile string, ver *Verification) (*UpdateResult, error) {
+	dir, err := u.downloadDir()
+	if err != nil {
+		return nil, err
+	}
+	tmpDir := filepath.Join(dir, "trusttunnel_extract")
 	os.RemoveAll(tmpDir)
-	os.MkdirAll(tmpDir, 0755)
+	if err := os.MkdirAll(tmpDir, 0755); err != nil {
+		return nil, err
+	}
 	defer os.RemoveAll(tmpDir)
 
-	cmd := exec.Command("tar", "xzf", tmpFile, "-C", tmpDir)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		log.Printf("[update] extract failed: %v: %s", err, string(out))
-		svcMgr.Control("start")
-		return nil, fmt.Errorf("extract: %w: %s", err, string(out))
+	if err := extractArchive(tmpFile, tmpDir); err != nil {
+		return nil, fmt.Errorf("extract: %w", err)
+	}
+	srcBin, dirName, err := findClientBinary(tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkBinaryArch(srcBin); err != nil {
+		return nil, err
 	}
 
-	// BusyBox tar has no --strip-components; find the binary inside extracted subdirectory
-	entries, _ := os.ReadDir(tmpDir)
-	srcDir := tmpDir
-	dirName := ""
-	if len(entries) == 1 && entries[0].IsDir() {
-		dirName = entries[0].Name()
-		srcDir = tmpDir + "/" + dirName
+	var running []string
+	for _, name := range NewInstances().Names() {
+		if st, _ := newInstanceManager(name).Status(); st != nil && st.Running {
+			running = append(running, name)
+		}
 	}
+	prevVer := detectClientVersion()
 
-	srcBin := srcDir + "/trusttunnel_client"
-	if _, err := os.Stat(srcBin); err != nil {
-		svcMgr.Control("start")
-		return nil, fmt.Errorf("binary not found in archive at %s", srcBin)
+	log.Printf("[update] stopping TrustTunnel client")
+	ControlAll("stop")
+
+	if err := backupClient(); err != nil {
+		ControlAll("start")
+		return nil, err
 	}
 
 	if out, err := exec.Command("cp", "-f", srcBin, clientBin).CombinedOutput(); err != nil {
 		log.Printf("[update] copy failed: %v: %s", err, string(out))
-		svcMgr.Control("start")
+		ControlAll("start")
 		return nil, fmt.Errorf("copy binary: %w: %s", err, string(out))
 	}
 	os.Chmod(clientBin, 0755)
@@ -178,13 +265,17 @@ func (u *Updater) Install() (*UpdateResult, error) {
 	}
 
 	log.Printf("[update] starting TrustTunnel client")
-	svcMgr.Control("start")
+	ControlAll("start")
 	u.cache = nil
-	log.Printf("[update] complete, version: %s", newVer)
+	u.audit("client", newVer, ver, nil)
+	go u.watchUpdate(running, newVer, prevVer)
+	log.Printf("[update] complete, version: %s, watching for %s", newVer, u.watchWindow)
 	return &UpdateResult{
-		Success: true,
-		Message: "Updated successfully",
-		Version: newVer,
+		Success:  true,
+		Message:  "Updated successfully",
+		Version:  newVer,
+		SHA256:   ver.SHA256,
+		Verified: ver.String(),
 	}, nil
 }
 
@@ -193,191 +284,149 @@ const (
 	managerInitScript = "/opt/etc/init.d/S98trusttunnel-manager"
 )
 
-func (u *Updater) InstallManager() (*UpdateResult, error) {
-	arch := detectArch()
-	assetName := fmt.Sprintf("trusttunnel-manager-linux-%s", arch)
-	log.Printf("[update-manager] searching asset: %s", assetName)
+// InstallManager updates the manager to the release with the given tag, or
+// the latest release on the configured channel when tag is empty. Package
+// installs are updated with opkg, script installs by replacing the binary.
+func (u *Updater) InstallManager(ctx context.Context, j *Job, tag string) (*UpdateResult, error) {
+	if !u.installMu.TryLock() {
+		return nil, errUpdateInProgress
+	}
+	defer u.installMu.Unlock()
 
-	downloadURL, err := u.findAssetURL(managerRepo, assetName, "")
+	rel, err := u.fetchRelease(managerRepo, tag)
 	if err != nil {
 		return nil, fmt.Errorf("find asset: %w", err)
 	}
-	log.Printf("[update-manager] downloading %s", downloadURL)
-
-	tmpFile := "/tmp/trusttunnel-manager-new"
-	if err := u.download(downloadURL, tmpFile); err != nil {
-		os.Remove(tmpFile)
-		return nil, fmt.Errorf("download: %w", err)
+	if managerFromOpkg() {
+		return u.installManagerIPK(ctx, j, rel)
 	}
 
-	if info, err := os.Stat(tmpFile); err == nil {
-		log.Printf("[update-manager] downloaded %d bytes", info.Size())
+	assetName := managerAssetName()
+	log.Printf("[update-manager] searching asset: %s", assetName)
+	asset, err := rel.findAsset(assetName, "")
+	if err != nil {
+		return nil, fmt.Errorf("find asset: %w", err)
 	}
+	j.Logf("downloading %s (%s) from %s", asset.Name, formatBytes(asset.Size), rel.src)
 
-	if err := os.Chmod(tmpFile, 0755); err != nil {
-		os.Remove(tmpFile)
-		return nil, fmt.Errorf("chmod: %w", err)
+	tmpFile, err := u.download(ctx, j, rel.src, asset.BrowserDownloadURL, asset.Name, asset.Size)
+	if err != nil {
+		return nil, fmt.Errorf("download: %w", err)
 	}
+	defer os.Remove(tmpFile)
 
-	if out, err := exec.Command("cp", "-f", tmpFile, managerBin).CombinedOutput(); err != nil {
-		os.Remove(tmpFile)
-		return nil, fmt.Errorf("replace binary: %w: %s", err, string(out))
+	ver, err := u.verifyAsset(rel, asset.Name, tmpFile, true)
+	if err != nil {
+		u.audit("manager", rel.TagName, nil, err)
+		return nil, fmt.Errorf("verify: %w", err)
 	}
-	os.Remove(tmpFile)
-
-	latestVer, _ := u.latestRelease(managerRepo)
-	log.Printf("[update-manager] binary replaced, scheduling restart, new version: %s", latestVer)
-
-	// Detached restart: survives current process termination
-	exec.Command("sh", "-c",
-		fmt.Sprintf("sleep 1 && %s restart", managerInitScript),
-	).Start()
-
-	return &UpdateResult{
-		Success: true,
-		Message: "Manager updated, restarting...",
-		Version: latestVer,
-	}, nil
+	j.Logf("verified %s: %s", asset.Name, ver)
+	return u.replaceManager(tmpFile, rel.TagName, ver)
 }
 
+// latestRelease returns the newest release tag of repo on the configured
+// channel.
 func (u *Updater) latestRelease(repo string) (string, error) {
-	url := fmt.Sprintf("%s/%s/releases?per_page=1", githubAPI, repo)
-
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Accept", "application/vnd.github.v3+json")
-	req.Header.Set("User-Agent", userAgent)
-
-	if cached, ok := u.etagCache[repo]; ok && cached.etag != "" {
-		req.Header.Set("If-None-Match", cached.etag)
-	}
-
-	resp, err := u.httpClient.Do(req)
+	rel, err := u.fetchLatestRelease(repo)
 	if err != nil {
-		if cached, ok := u.etagCache[repo]; ok && cached.version != "" {
-			log.Printf("[update] request to %s failed: %v, using cached version %s", url, err, cached.version)
-			return cached.version, nil
-		}
-		return "", fmt.Errorf("request failed: %w", err)
+		return "", err
 	}
-	defer resp.Body.Close()
-
-	remaining := resp.Header.Get("X-Ratelimit-Remaining")
-	log.Printf("[update] %s HTTP %d (rate-limit remaining: %s)", url, resp.StatusCode, remaining)
-
-	if resp.StatusCode == http.StatusNotModified {
-		if cached, ok := u.etagCache[repo]; ok {
-			return cached.version, nil
-		}
-	}
-
-	if resp.StatusCode == http.StatusForbidden || resp.StatusCode == 429 {
-		if cached, ok := u.etagCache[repo]; ok && cached.version != "" {
-			log.Printf("[update] rate limited, using cached version %s", cached.version)
-			return cached.version, nil
-		}
-		return "", fmt.Errorf("GitHub API rate limit exceeded (HTTP %d)", resp.StatusCode)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("GitHub API returned HTTP %d: %s", resp.StatusCode, string(body))
-	}
-
-	body, _ := io.ReadAll(resp.Body)
-
-	type releaseObj struct {
-		TagName string `json:"tag_name"`
-	}
-	var list []releaseObj
-	if err := json.Unmarshal(body, &list); err != nil {
-		return "", fmt.Errorf("json decode: %w", err)
-	}
-	if len(list) == 0 || list[0].TagName == "" {
-		return "", fmt.Errorf("no releases found for %s", repo)
-	}
-
-	version := list[0].TagName
-	etag := resp.Header.Get("ETag")
-	u.etagCache[repo] = etagEntry{etag: etag, version: version}
+	return rel.TagName, nil
+}
 
-	return version, nil
+type githubAsset struct {
+	Name               string `json:"name"`
+	Size               int64  `json:"size"`
+	BrowserDownloadURL string `json:"browser_download_url"`
 }
 
-func (u *Updater) findAssetURL(repo, prefix, suffix string) (string, error) {
-	url := fmt.Sprintf("%s/%s/releases?per_page=1", githubAPI, repo)
+type githubRelease struct {
+	TagName     string        `json:"tag_name"`
+	Name        string        `json:"name"`
+	Draft       bool          `json:"draft"`
+	Prerelease  bool          `json:"prerelease"`
+	PublishedAt time.Time     `json:"published_at"`
+	Body        string        `json:"body"`
+	Assets      []githubAsset `json:"assets"`
 
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("Accept", "application/vnd.github.v3+json")
-	req.Header.Set("User-Agent", userAgent)
+	src releaseSource
+}
 
-	resp, err := u.httpClient.Do(req)
+// fetchLatestRelease returns the newest non-draft release of repo, skipping
+// pre-releases unless the prerelease channel is selected.
+func (u *Updater) fetchLatestRelease(repo string) (*githubRelease, error) {
+	list, err := u.listReleases(repo)
 	if err != nil {
-		return "", fmt.Errorf("request failed: %w", err)
+		return nil, err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		body, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("GitHub API returned HTTP %d: %s", resp.StatusCode, string(body))
+	prerelease := u.Settings().Channel == ChannelPrerelease
+	for i, r := range list {
+		if r.Draft || (r.Prerelease && !prerelease) {
+			continue
+		}
+		return &list[i], nil
 	}
+	return nil, fmt.Errorf("no releases found for %s", repo)
+}
 
-	body, _ := io.ReadAll(resp.Body)
-
-	type asset struct {
-		Name               string `json:"name"`
-		BrowserDownloadURL string `json:"browser_download_url"`
+// fetchRelease returns the release of repo with the given tag.
+func (u *Updater) fetchRelease(repo, tag string) (*githubRelease, error) {
+	if tag == "" {
+		return u.fetchLatestRelease(repo)
 	}
-	type releaseInfo struct {
-		Assets []asset `json:"assets"`
+	if !ValidTag(tag) {
+		return nil, fmt.Errorf("invalid tag %q", tag)
+	}
+	list, err := u.listReleases(repo)
+	if err == nil {
+		for i, r := range list {
+			if r.TagName == tag {
+				return &list[i], nil
+			}
+		}
 	}
 
-	var list []releaseInfo
-	if err := json.Unmarshal(body, &list); err != nil {
-		return "", fmt.Errorf("json decode: %w", err)
+	// Older tags are not in the recent list; ask each source for the tag
+	var errs []error
+	for _, src := range u.sources() {
+		var rel *githubRelease
+		var err error
+		if src.kind == SourceMirror {
+			rel, err = mirrorRelease(src, repo, tag)
+		} else {
+			rel, err = u.githubReleaseByTag(src, repo, tag)
+		}
+		if err == nil {
+			return rel, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", src, err))
 	}
-	if len(list) == 0 {
-		return "", fmt.Errorf("no releases found")
+	return nil, errors.Join(errs...)
+}
+
+func (r *githubRelease) assetNamed(name string) *githubAsset {
+	for i, a := range r.Assets {
+		if a.Name == name {
+			return &r.Assets[i]
+		}
 	}
+	return nil
+}
 
-	for _, a := range list[0].Assets {
+func (r *githubRelease) findAsset(prefix, suffix string) (*githubAsset, error) {
+	for i, a := range r.Assets {
 		if strings.HasPrefix(a.Name, prefix) && (suffix == "" || strings.HasSuffix(a.Name, suffix)) {
 			log.Printf("[update] matched asset: %s", a.Name)
-			return a.BrowserDownloadURL, nil
+			return &r.Assets[i], nil
 		}
 	}
 
-	names := make([]string, 0, len(list[0].Assets))
-	for _, a := range list[0].Assets {
+	names := make([]string, 0, len(r.Assets))
+	for _, a := range r.Assets {
 		names = append(names, a.Name)
 	}
 	log.Printf("[update] no match for %s*%s in assets: %v", prefix, suffix, names)
-	return "", fmt.Errorf("asset %q not found in release", prefix+"*"+suffix)
-}
-
-func (u *Updater) download(url, dest string) error {
-	dlClient := &http.Client{Timeout: 5 * time.Minute}
-	resp, err := dlClient.Get(url)
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP %d %s", resp.StatusCode, resp.Status)
-	}
-
-	f, err := os.Create(dest)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
-
-	n, err := io.Copy(f, resp.Body)
-	if err != nil {
-		return err
-	}
-	log.Printf("[update] saved %d bytes to %s", n, dest)
-	return nil
+	return nil, fmt.Errorf("asset %q not found in release", prefix+"*"+suffix)
 }
 
 // isNewer returns true if remote version is strictly newer than local.
@@ -422,21 +471,6 @@ func parseVersion(v string) []int {
 	return parts
 }
 
-func detectArch() string {
-	switch runtime.GOARCH {
-	case "mipsle":
-		return "mipsel"
-	case "mips":
-		return "mips"
-	case "arm64":
-		return "aarch64"
-	case "arm":
-		return "armv7"
-	default:
-		return runtime.GOARCH
-	}
-}
-
 var mgrVersion = "dev"
 
 func SetManagerVersion(v string) {
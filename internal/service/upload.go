@@ -0,0 +1,170 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+const (
+	ComponentClient  = "client"
+	ComponentManager = "manager"
+)
+
+// Upload is a release file supplied by the user for an offline install.
+type Upload struct {
+	// Component is "client" or "manager"; detected from the content if empty
+	Component string
+	// Path is the saved upload; Name its original file name
+	Path string
+	Name string
+	// Version is used for manager uploads, client versions are taken from
+	// the archive
+	Version string
+	// Sums and Sig are an optional SHA256SUMS and its detached signature
+	Sums []byte
+	Sig  []byte
+}
+
+// StageUpload saves an uploaded file into DOWNLOAD_DIR and returns its
+// path. need is the expected size, checked against the free space first.
+func (u *Updater) StageUpload(src io.Reader, need int64) (string, error) {
+	dir, err := u.downloadDir()
+	if err != nil {
+		return "", err
+	}
+	if err := ensureSpace(dir, need); err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp(dir, "trusttunnel_upload_*")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, src)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// InstallUpload installs an uploaded client tarball, manager binary or
+// manager package (.ipk, installed with opkg). With
+// SHA256SUMS the file is checked like a downloaded release; without it the
+// install is recorded as unverified. The signature policy still applies to
+// the manager.
+func (u *Updater) InstallUpload(up Upload) (*UpdateResult, error) {
+	if !u.installMu.TryLock() {
+		return nil, errUpdateInProgress
+	}
+	defer u.installMu.Unlock()
+
+	if up.Component == "" {
+		up.Component = detectComponent(up.Path)
+		if isIPK(up.Name) {
+			up.Component = ComponentManager
+		}
+	}
+	if up.Component != ComponentClient && up.Component != ComponentManager {
+		return nil, fmt.Errorf("cannot tell whether the upload is a client archive or a manager binary")
+	}
+	if up.Version == "" {
+		up.Version = "upload"
+	}
+
+	ver, err := u.verifyUpload(up)
+	if err != nil {
+		u.audit(up.Component, up.Name, nil, err)
+		return nil, fmt.Errorf("verify: %w", err)
+	}
+	log.Printf("[update] installing uploaded %s %s (%s)", up.Component, up.Name, ver)
+
+	switch {
+	case up.Component == ComponentClient:
+		return u.installClientArchive(up.Path, ver)
+	case isIPK(up.Name):
+		// opkg only installs local files named *.ipk
+		ipk := up.Path + ".ipk"
+		if err := os.Rename(up.Path, ipk); err != nil {
+			return nil, err
+		}
+		defer os.Remove(ipk)
+		return u.installIPK(context.Background(), nil, ipk, up.Version, ver)
+	case managerFromOpkg():
+		return nil, fmt.Errorf("the manager was installed with opkg: upload the %s*%s package instead of the binary",
+			managerPackage+"_", managerIPKSuffix())
+	}
+	return u.replaceManager(up.Path, up.Version, ver)
+}
+
+func isIPK(name string) bool {
+	return strings.HasSuffix(name, ".ipk")
+}
+
+func (u *Updater) verifyUpload(up Upload) (*Verification, error) {
+	got, err := fileSHA256(up.Path)
+	if err != nil {
+		return nil, err
+	}
+	manager := up.Component == ComponentManager
+
+	if len(up.Sums) == 0 {
+		if manager && u.verify == VerifySignature {
+			return nil, fmt.Errorf("signature required: upload SHA256SUMS and its signature with the binary")
+		}
+		return &Verification{SHA256: got, Unverified: true}, nil
+	}
+
+	v := &Verification{}
+	if manager && (len(up.Sig) > 0 || u.verify == VerifySignature) {
+		if releasePublicKey == "" {
+			return nil, fmt.Errorf("no public key is compiled into the manager")
+		}
+		if len(up.Sig) == 0 {
+			return nil, fmt.Errorf("signature required but none uploaded")
+		}
+		if err := verifySignature(releasePublicKey, up.Sums, up.Sig); err != nil {
+			return nil, err
+		}
+		v.Signed = true
+	}
+
+	want, ok := lookupSum(up.Sums, up.Name)
+	if !ok {
+		return nil, fmt.Errorf("%s not listed in SHA256SUMS", up.Name)
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", up.Name, want, got)
+	}
+	v.SHA256 = got
+	return v, nil
+}
+
+// detectComponent tells a gzip tarball (client) from an ELF binary
+// (manager) by its magic bytes.
+func detectComponent(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	magic := make([]byte, 4)
+	if _, err := io.ReadFull(f, magic); err != nil {
+		return ""
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return ComponentClient
+	case bytes.Equal(magic, []byte("\x7fELF")):
+		return ComponentManager
+	}
+	return ""
+}
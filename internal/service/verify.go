@@ -0,0 +1,252 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	VerifyChecksum  = "checksum"
+	VerifySignature = "signature"
+
+	maxSumsSize = 1 << 20
+)
+
+// releasePublicKey verifies signatures of manager releases. It is either a
+// minisign public key (base64 "RW...") or a raw base64 ed25519 key, set at
+// build time with -ldflags "-X .../internal/service.releasePublicKey=...".
+var releasePublicKey = ""
+
+var checksumAssets = []string{"SHA256SUMS", "SHA256SUMS.txt", "sha256sums.txt"}
+
+// Verification describes how an installed asset was checked.
+type Verification struct {
+	SHA256 string
+	Signed bool
+	// Unverified is set for uploads without SHA256SUMS; SHA256 is then only
+	// computed locally
+	Unverified bool
+}
+
+func (v *Verification) String() string {
+	if v.Unverified {
+		return "unverified"
+	}
+	if v.Signed {
+		return "sha256+signature"
+	}
+	return "sha256"
+}
+
+// verifyAsset checks the downloaded file against the release SHA256SUMS and,
+// for manager releases, the detached signature of SHA256SUMS. Any missing or
+// mismatching piece is an error: installs fail closed.
+func (u *Updater) verifyAsset(rel *githubRelease, assetName, path string, manager bool) (*Verification, error) {
+	var sumsAsset *githubAsset
+	for _, name := range checksumAssets {
+		if sumsAsset = rel.assetNamed(name); sumsAsset != nil {
+			break
+		}
+	}
+	if sumsAsset == nil {
+		return nil, fmt.Errorf("release %s has no SHA256SUMS, refusing to install", rel.TagName)
+	}
+
+	sums, err := u.fetchSmall(rel.src, sumsAsset.BrowserDownloadURL)
+	if err != nil {
+		return nil, fmt.Errorf("download %s: %w", sumsAsset.Name, err)
+	}
+
+	v := &Verification{}
+	if manager {
+		signed, err := u.verifySums(rel, sumsAsset.Name, sums)
+		if err != nil {
+			return nil, err
+		}
+		v.Signed = signed
+	}
+
+	want, ok := lookupSum(sums, assetName)
+	if !ok {
+		return nil, fmt.Errorf("%s not listed in %s", assetName, sumsAsset.Name)
+	}
+	got, err := fileSHA256(path)
+	if err != nil {
+		return nil, err
+	}
+	if subtle.ConstantTimeCompare([]byte(got), []byte(want)) != 1 {
+		return nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", assetName, want, got)
+	}
+	v.SHA256 = got
+	log.Printf("[update] %s verified: sha256 %s (signed: %t)", assetName, got, v.Signed)
+	return v, nil
+}
+
+// verifySums checks the detached signature of SHA256SUMS when a public key is
+// compiled in. It reports whether a signature was verified.
+func (u *Updater) verifySums(rel *githubRelease, sumsName string, sums []byte) (bool, error) {
+	required := u.verify == VerifySignature
+	if releasePublicKey == "" {
+		if required {
+			return false, fmt.Errorf("signature required but no public key is compiled into the manager")
+		}
+		return false, nil
+	}
+
+	var sigAsset *githubAsset
+	for _, ext := range []string{".minisig", ".sig"} {
+		if sigAsset = rel.assetNamed(sumsName + ext); sigAsset != nil {
+			break
+		}
+	}
+	if sigAsset == nil {
+		if required {
+			return false, fmt.Errorf("release %s has no signature for %s", rel.TagName, sumsName)
+		}
+		log.Printf("[update] release %s is not signed, checksum only", rel.TagName)
+		return false, nil
+	}
+
+	sig, err := u.fetchSmall(rel.src, sigAsset.BrowserDownloadURL)
+	if err != nil {
+		return false, fmt.Errorf("download %s: %w", sigAsset.Name, err)
+	}
+	if err := verifySignature(releasePublicKey, sums, sig); err != nil {
+		return false, fmt.Errorf("%s: %w", sigAsset.Name, err)
+	}
+	return true, nil
+}
+
+// verifySignature accepts a minisign signature (legacy "Ed" algorithm, as
+// produced by minisign -l) or a raw base64 ed25519 signature.
+func verifySignature(pubKey string, msg, sig []byte) error {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(pubKey))
+	if err != nil {
+		return fmt.Errorf("invalid public key: %w", err)
+	}
+
+	var keyID []byte
+	switch len(key) {
+	case ed25519.PublicKeySize:
+	case 2 + 8 + ed25519.PublicKeySize:
+		if string(key[:2]) != "Ed" {
+			return fmt.Errorf("unsupported public key algorithm %q", key[:2])
+		}
+		keyID = key[2:10]
+		key = key[10:]
+	default:
+		return fmt.Errorf("invalid public key length %d", len(key))
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(sig)), "\n")
+	if len(lines) == 1 {
+		raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[0]))
+		if err != nil || len(raw) != ed25519.SignatureSize {
+			return fmt.Errorf("malformed signature")
+		}
+		if !ed25519.Verify(key, msg, raw) {
+			return fmt.Errorf("signature verification failed")
+		}
+		return nil
+	}
+
+	// minisign: untrusted comment, signature, trusted comment, global signature
+	if len(lines) < 4 {
+		return fmt.Errorf("malformed minisign signature")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil || len(raw) != 2+8+ed25519.SignatureSize {
+		return fmt.Errorf("malformed minisign signature")
+	}
+	switch string(raw[:2]) {
+	case "Ed":
+	case "ED":
+		return fmt.Errorf("prehashed minisign signatures are not supported, sign with minisign -l")
+	default:
+		return fmt.Errorf("unsupported signature algorithm %q", raw[:2])
+	}
+	if keyID != nil && !bytes.Equal(raw[2:10], keyID) {
+		return fmt.Errorf("signature key ID does not match the compiled-in key")
+	}
+	if !ed25519.Verify(key, msg, raw[10:]) {
+		return fmt.Errorf("signature verification failed")
+	}
+
+	trusted := strings.TrimPrefix(strings.TrimRight(lines[2], "\r"), "trusted comment: ")
+	global, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	signed := append(append([]byte{}, raw[10:]...), trusted...)
+	if err != nil || !ed25519.Verify(key, signed, global) {
+		return fmt.Errorf("trusted comment signature verification failed")
+	}
+	return nil
+}
+
+// lookupSum finds the hex digest of name in sha256sum output.
+func lookupSum(sums []byte, name string) (string, bool) {
+	scanner := bufio.NewScanner(bytes.NewReader(sums))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		file := strings.TrimPrefix(strings.TrimPrefix(fields[1], "*"), "./")
+		if file == name && len(fields[0]) == sha256.Size*2 {
+			return strings.ToLower(fields[0]), true
+		}
+	}
+	return "", false
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (u *Updater) fetchSmall(src releaseSource, url string) ([]byte, error) {
+	resp, err := src.get(url, 30*time.Second, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxSumsSize))
+}
+
+// audit records an install attempt with its verification outcome.
+func (u *Updater) audit(component, version string, v *Verification, err error) {
+	if err != nil {
+		u.events.Add(Event{
+			Type:    "update",
+			Message: fmt.Sprintf("%s %s rejected", component, version),
+			Reason:  err.Error(),
+		})
+		return
+	}
+	u.events.Add(Event{
+		Type:    "update",
+		Message: fmt.Sprintf("%s updated to %s", component, version),
+		Reason:  fmt.Sprintf("%s %s", v, v.SHA256),
+	})
+}
@@ -0,0 +1,9 @@
+package service
+
+import "syscall"
+
+// bindToDevice pins a socket to iface so probes bypass the tunnel's
+// default route.
+func bindToDevice(fd uintptr, iface string) error {
+	return syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, iface)
+}
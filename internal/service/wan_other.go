@@ -0,0 +1,7 @@
+//go:build !linux
+
+package service
+
+func bindToDevice(fd uintptr, iface string) error {
+	return nil
+}
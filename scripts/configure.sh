@@ -57,6 +57,7 @@ fi
 
 # Smart routing
 sr_enabled="no"
+sr_policy="tunnel_default"
 sr_country="RU"
 sr_dns_port=5354
 sr_dns_upstream="1.1.1.1"
@@ -138,6 +139,10 @@ if [ "$mode" = "tun" ]; then
     sr_enabled=${sr_enabled:-no}
 
     if [ "$sr_enabled" = "yes" ]; then
+        ask "Политика: tunnel_default (всё через туннель, кроме домашней страны) или direct_default (всё напрямую, кроме списков) [tunnel_default]:"
+        read -r sr_policy
+        sr_policy=${sr_policy:-tunnel_default}
+
         ask "Домашняя страна (RU/UA/BY/KZ/...) [RU]:"
         read -r sr_country
         sr_country=${sr_country:-RU}
@@ -165,6 +170,7 @@ HC_TARGET_URL="http://connectivitycheck.gstatic.com/generate_204"
 HC_CURL_TIMEOUT="5"
 HC_SOCKS5_PROXY="127.0.0.1:1080"
 SR_ENABLED="$sr_enabled"
+SR_POLICY="$sr_policy"
 SR_HOME_COUNTRY="$sr_country"
 SR_DNS_PORT="$sr_dns_port"
 SR_DNS_UPSTREAM="$sr_dns_upstream"
@@ -40,6 +40,17 @@ if [ "$TT_MODE" = "tun" ]; then
             . "$SMART_ROUTING_SH"
             sr_restore_iptables
         fi
+
+        # Restore IPv6 leak prevention
+        if [ "$(cat /opt/var/run/trusttunnel_ipv6_state 2>/dev/null)" = "blocked" ]; then
+            fw_setup_ipv6_block "br0"
+        fi
+
+        # Restore DNS leak protection redirect
+        if [ "$DNS_POLICY" = "redirect" ] && [ -f "$SMART_ROUTING_SH" ]; then
+            . "$SMART_ROUTING_SH"
+            sr_dns_guard_restore
+        fi
     fi
 fi
 
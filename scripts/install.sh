@@ -217,9 +217,21 @@ HC_TARGET_URL="http://connectivitycheck.gstatic.com/generate_204"
 HC_CURL_TIMEOUT="5"
 HC_SOCKS5_PROXY="127.0.0.1:1080"
 SR_ENABLED="no"
+SR_POLICY="tunnel_default"
 SR_HOME_COUNTRY="RU"
 SR_DNS_PORT="5354"
 SR_DNS_UPSTREAM="1.1.1.1"
+DNS_POLICY="off"
+DNS_BLOCK_DOT="no"
+FO_ENABLED="no"
+FO_SOURCE="addresses"
+FO_PROFILES=""
+FO_THRESHOLD="2"
+FO_FAILBACK="no"
+FO_FAILBACK_AFTER="600"
+EP_PROBE_AUTO="no"
+EP_PROBE_INTERVAL="600"
+EP_PROBE_HYSTERESIS="20"
 MODECONF
         info "Default mode config created"
     fi
@@ -229,6 +241,10 @@ MODECONF
 LISTEN_ADDR=":8080"
 # AUTH_MODE: "ndm" (Keenetic router accounts, default), "none" (disabled)
 AUTH_MODE="ndm"
+# UPDATE_VERIFY: "checksum" (SHA256SUMS, default), "signature" (SHA256SUMS + signed manager releases)
+UPDATE_VERIFY="checksum"
+# UPDATE_WATCH_WINDOW: seconds to watch a client update before keeping it (rollback on failure)
+UPDATE_WATCH_WINDOW="300"
 MGRCONF
         info "Default manager config created"
     fi
@@ -260,5 +260,129 @@ fw_cleanup_mangle_smart() {
     fi
 }
 
+# --- DNS leak protection ---
+
+# Remove every jump to chain from table/parent, whatever interface it
+# was added for
+fw_delete_jumps() {
+    local table="$1" parent="$2" chain="$3"
+
+    iptables -t "$table" -S "$parent" 2>/dev/null | grep -- "-j $chain\$" | \
+        sed 's/^-A /-D /' | while read -r rule; do
+            eval "iptables -t $table $rule" 2>/dev/null
+        done
+}
+
+# Redirect LAN DNS (udp/tcp 53) to a local resolver port; lan_ifs is a
+# space-separated list of LAN bridges
+fw_setup_dns_redirect() {
+    local lan_ifs="$1"
+    local port="$2"
+    local lan_if
+
+    if [ "$NDMS_FW_BACKEND" = "nftables" ] && ! command -v iptables > /dev/null 2>&1; then
+        nft add table ip trusttunnel 2>/dev/null
+        nft add chain ip trusttunnel dns_redirect "{ type nat hook prerouting priority dstnat; policy accept; }" 2>/dev/null
+        nft flush chain ip trusttunnel dns_redirect 2>/dev/null
+        for lan_if in $lan_ifs; do
+            nft add rule ip trusttunnel dns_redirect iifname "$lan_if" udp dport 53 redirect to :"$port" 2>/dev/null
+            nft add rule ip trusttunnel dns_redirect iifname "$lan_if" tcp dport 53 redirect to :"$port" 2>/dev/null
+        done
+    else
+        iptables -t nat -N TT_DNS 2>/dev/null
+        iptables -t nat -F TT_DNS 2>/dev/null
+        iptables -t nat -A TT_DNS -p udp --dport 53 -j REDIRECT --to-ports "$port"
+        iptables -t nat -A TT_DNS -p tcp --dport 53 -j REDIRECT --to-ports "$port"
+
+        # Interfaces dropped from the list lose their redirect
+        fw_delete_jumps nat PREROUTING TT_DNS
+        for lan_if in $lan_ifs; do
+            iptables -t nat -I PREROUTING -i "$lan_if" -j TT_DNS
+        done
+    fi
+}
+
+# Remove the DNS redirect from all interfaces
+fw_cleanup_dns_redirect() {
+    if [ "$NDMS_FW_BACKEND" = "nftables" ] && ! command -v iptables > /dev/null 2>&1; then
+        nft delete chain ip trusttunnel dns_redirect 2>/dev/null
+    else
+        fw_delete_jumps nat PREROUTING TT_DNS
+        iptables -t nat -F TT_DNS 2>/dev/null
+        iptables -t nat -X TT_DNS 2>/dev/null
+    fi
+}
+
+# Reject DNS-over-TLS/QUIC (port 853) forwarded from the LAN bridges in
+# lan_ifs
+fw_setup_dot_block() {
+    local lan_ifs="$1"
+    local lan_if
+
+    if [ "$NDMS_FW_BACKEND" = "nftables" ] && ! command -v iptables > /dev/null 2>&1; then
+        nft add table ip trusttunnel 2>/dev/null
+        nft add chain ip trusttunnel dot_block "{ type filter hook forward priority -1; policy accept; }" 2>/dev/null
+        nft flush chain ip trusttunnel dot_block 2>/dev/null
+        for lan_if in $lan_ifs; do
+            nft add rule ip trusttunnel dot_block iifname "$lan_if" tcp dport 853 reject with tcp reset 2>/dev/null
+            nft add rule ip trusttunnel dot_block iifname "$lan_if" udp dport 853 reject 2>/dev/null
+        done
+    else
+        iptables -N TT_DOT 2>/dev/null
+        iptables -F TT_DOT 2>/dev/null
+        iptables -A TT_DOT -p tcp --dport 853 -j REJECT --reject-with tcp-reset
+        iptables -A TT_DOT -p udp --dport 853 -j REJECT
+
+        fw_delete_jumps filter FORWARD TT_DOT
+        for lan_if in $lan_ifs; do
+            iptables -I FORWARD -i "$lan_if" -j TT_DOT
+        done
+    fi
+}
+
+# Remove the DoT block from all interfaces
+fw_cleanup_dot_block() {
+    if [ "$NDMS_FW_BACKEND" = "nftables" ] && ! command -v iptables > /dev/null 2>&1; then
+        nft delete chain ip trusttunnel dot_block 2>/dev/null
+    else
+        fw_delete_jumps filter FORWARD TT_DOT
+        iptables -F TT_DOT 2>/dev/null
+        iptables -X TT_DOT 2>/dev/null
+    fi
+}
+
+# --- IPv6 leak prevention ---
+
+# Reject IPv6 traffic forwarded from LAN (the tunnel carries IPv4 only)
+fw_setup_ipv6_block() {
+    local lan_if="$1"
+
+    if [ "$NDMS_FW_BACKEND" = "nftables" ] && ! command -v ip6tables > /dev/null 2>&1; then
+        nft add table ip6 trusttunnel 2>/dev/null
+        nft add chain ip6 trusttunnel v6_block "{ type filter hook forward priority -1; policy accept; }" 2>/dev/null
+        nft flush chain ip6 trusttunnel v6_block 2>/dev/null
+        nft add rule ip6 trusttunnel v6_block iifname "$lan_if" reject with icmpv6 type admin-prohibited 2>/dev/null
+    else
+        ip6tables -N TT_V6BLOCK 2>/dev/null
+        ip6tables -F TT_V6BLOCK 2>/dev/null
+        ip6tables -A TT_V6BLOCK -j REJECT --reject-with icmp6-adm-prohibited
+
+        ip6tables -C FORWARD -i "$lan_if" -j TT_V6BLOCK 2>/dev/null || \
+            ip6tables -I FORWARD -i "$lan_if" -j TT_V6BLOCK
+    fi
+}
+
+fw_cleanup_ipv6_block() {
+    local lan_if="$1"
+
+    if [ "$NDMS_FW_BACKEND" = "nftables" ] && ! command -v ip6tables > /dev/null 2>&1; then
+        nft delete table ip6 trusttunnel 2>/dev/null
+    else
+        ip6tables -D FORWARD -i "$lan_if" -j TT_V6BLOCK 2>/dev/null
+        ip6tables -F TT_V6BLOCK 2>/dev/null
+        ip6tables -X TT_V6BLOCK 2>/dev/null
+    fi
+}
+
 # Initialize compat on source
 ndms_load_compat
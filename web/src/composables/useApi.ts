@@ -7,7 +7,8 @@ async function request<T>(path: string, options: RequestInit = {}): Promise<T> {
     ...options,
     credentials: 'same-origin',
     headers: {
-      'Content-Type': 'application/json',
+      // FormData sets its own multipart boundary
+      ...(options.body instanceof FormData ? {} : { 'Content-Type': 'application/json' }),
       ...(options.headers || {}),
     },
   })
@@ -33,12 +34,15 @@ export interface ServiceStatus {
   watchdog_alive: boolean
   health_check: string
   client_version: string
+  ipv6: string
+  endpoint_has_ipv6: boolean
 }
 
 export interface ModeInfo {
   mode: string
   tun_idx: number
   proxy_idx: number
+  socks_port: number
   hc_enabled: string
   hc_interval: number
   hc_fail_threshold: number
@@ -54,6 +58,14 @@ export interface AllConfig {
   mode: ModeInfo
 }
 
+export interface UpdateResult {
+  success: boolean
+  message: string
+  version: string
+  sha256?: string
+  verified?: string
+}
+
 export interface UpdateInfo {
   client_current_version: string
   client_latest_version: string
@@ -63,6 +75,78 @@ export interface UpdateInfo {
   manager_latest_version: string
   manager_update_available: boolean
   manager_check_error?: string
+  channel: 'stable' | 'prerelease'
+  client_pin?: string
+  manager_pin?: string
+  rollback_available: boolean
+  rollback?: RollbackStatus
+  auto_update: AutoUpdateStatus
+  manager_install: 'opkg' | 'binary'
+}
+
+export interface AutoUpdateStatus {
+  policy: 'off' | 'notify' | 'install'
+  last_check: string
+  next_check: string
+  in_window: boolean
+  last_attempt: string
+  last_result?: string
+  timezone: string
+}
+
+export interface UpdateSettings {
+  channel: 'stable' | 'prerelease'
+  client_pin: string
+  manager_pin: string
+  auto_update: 'off' | 'notify' | 'install'
+  auto_update_window: string
+  auto_update_interval: number
+  auto_update_max_kbps: number
+  sources: string
+  download_dir: string
+}
+
+export interface ReleaseInfo {
+  tag: string
+  name: string
+  published_at: string
+  prerelease: boolean
+  has_asset: boolean
+  current: boolean
+  latest: boolean
+}
+
+export interface ReleaseList {
+  channel: string
+  client: ReleaseInfo[]
+  client_error?: string
+  manager: ReleaseInfo[]
+  manager_error?: string
+}
+
+export interface ChangelogEntry {
+  tag: string
+  name: string
+  published_at: string
+  prerelease: boolean
+  body: string
+  assets: { name: string; size: number }[]
+}
+
+export interface Changelog {
+  client: ChangelogEntry[]
+  client_error?: string
+  manager: ChangelogEntry[]
+  manager_error?: string
+}
+
+export interface RollbackStatus {
+  state: 'watching' | 'ok' | 'rolled_back'
+  version: string
+  previous_version: string
+  since: string
+  until: string
+  reason?: string
 }
 
 export interface SystemInfo {
@@ -77,6 +161,7 @@ export interface SystemInfo {
 
 export interface RoutingConfig {
   sr_enabled: string
+  sr_policy: 'tunnel_default' | 'direct_default'
   sr_home_country: string
   sr_dns_port: number
   sr_dns_upstream: string
@@ -85,10 +170,15 @@ export interface RoutingConfig {
 export interface RoutingStats {
   domestic_entries: number
   tunnel_entries: number
+  bypass_entries: number
   dnsmasq_running: boolean
   nets_updated: string
   fw_backend: string
   ndms_major: number
+  ipv6: boolean
+  domestic_entries_v6: number
+  tunnel_entries_v6: number
+  bypass_entries_v6: number
 }
 
 export interface RoutingInfo {
@@ -100,6 +190,217 @@ export interface RoutingDomains {
   domains: string
 }
 
+export interface StaticEntry {
+  cidr: string
+  comment?: string
+}
+
+export interface StaticLists {
+  tunnel: StaticEntry[]
+  direct: StaticEntry[]
+}
+
+export interface DevicePolicy {
+  key: string
+  name?: string
+  policy: 'tunnel' | 'direct' | 'smart'
+}
+
+export interface RoutingOverride {
+  id: string
+  kind: 'device' | 'cidr' | 'domain' | 'tunnel'
+  target?: string
+  policy: 'tunnel' | 'direct'
+  expires: string
+  remaining: number
+}
+
+export interface LanHost {
+  mac: string
+  ip: string
+  name: string
+  active: boolean
+}
+
+export interface ScheduleRule {
+  id?: string
+  name: string
+  enabled: boolean
+  days?: string[]
+  from?: string
+  to?: string
+  cron?: string
+  duration?: number
+  action: 'tunnel' | 'policy' | 'device'
+  instance?: string
+  device?: string
+  value: string
+}
+
+export interface ScheduleStatus {
+  rules: ScheduleRule[]
+  active: string[]
+  clock_synced: boolean
+  last_eval?: string
+  timezone: string
+}
+
+export interface ScheduleTransition {
+  time: string
+  rule_id: string
+  rule: string
+  active: boolean
+  action: string
+}
+
+export interface Dependency {
+  name: string
+  required: boolean
+  installed: boolean
+  version?: string
+}
+
+export interface DepsStatus {
+  fw_backend: string
+  deps: Dependency[]
+  ready: boolean
+  missing?: string[]
+}
+
+export interface InstanceInfo {
+  name: string
+  default: boolean
+  mode: string
+  tun_idx: number
+  proxy_idx: number
+  socks_port: number
+  status: ServiceStatus | null
+}
+
+export interface InstanceSpec {
+  name: string
+  mode: string
+  tun_idx: number
+  proxy_idx: number
+  socks_port: number
+  client_config: string
+}
+
+export interface DNSConfig {
+  dns_policy: string
+  dns_block_dot: string
+  dns_lan_iface: string
+  lan_bridges?: string[]
+}
+
+export interface LeakProbe {
+  resolver: string
+  name: string
+  upstream: string
+  rtt_ms: number
+  error?: string
+}
+
+export interface LeakTestResult {
+  policy: string
+  tunnel: LeakProbe
+  system: LeakProbe
+  interfaces: { iface: string; configured: boolean; redirected: boolean }[]
+  leak: boolean
+  reasons?: string[]
+}
+
+export interface FailoverConfig {
+  fo_enabled: string
+  fo_source: string
+  fo_profiles: string
+  fo_threshold: number
+  fo_failback: string
+  fo_failback_after: number
+}
+
+export interface FailoverStatus {
+  instance: string
+  enabled: boolean
+  source: string
+  entries: string[]
+  active: number
+  active_entry: string
+  restarts: number
+  threshold: number
+  switched_at?: string
+  reason?: string
+  primary_up_since?: string
+}
+
+export interface ManagerEvent {
+  time: string
+  type: string
+  instance?: string
+  message: string
+  reason?: string
+}
+
+export interface AddressProbe {
+  address: string
+  tcp_ms: number
+  tls_ms: number
+  loss: number
+  attempts: number
+  score: number
+  error?: string
+}
+
+export interface ProbeResult {
+  instance: string
+  hostname: string
+  interface: string
+  results: AddressProbe[]
+  current: string
+  best: string
+  reordered: boolean
+  reason?: string
+  time: string
+}
+
+export interface ProbeSettings {
+  ep_probe_auto: string
+  ep_probe_interval: number
+  ep_probe_hysteresis: number
+}
+
+export interface Job<T = any> {
+  id: string
+  type: string
+  instance?: string
+  state: 'running' | 'done' | 'failed' | 'cancelled'
+  progress: number
+  log: string[]
+  result?: T
+  error?: string
+  started_at: string
+  finished_at?: string
+}
+
+export interface TuneCandidate {
+  upstream_protocol: string
+  anti_dpi: boolean
+}
+
+export interface TuneResult extends TuneCandidate {
+  healthy: boolean
+  latency_ms: number
+  speed_kbps: number
+  error?: string
+}
+
+export interface TuneReport {
+  original: TuneCandidate
+  results: TuneResult[]
+  winner?: TuneResult
+  applied: boolean
+}
+
 export async function checkAuth(): Promise<{ authenticated: boolean; authMode: string }> {
   try {
     const resp = await fetch(`${BASE}/auth/check`, {
@@ -151,8 +452,18 @@ export function useApi() {
       call(() => request<{ lines: string[]; count: number }>(`/logs?lines=${lines}&source=${source}`)),
     clearLogs: () => call(() => request<{ ok: boolean }>('/logs', { method: 'DELETE' })),
     checkUpdate: (force = false) => call(() => request<UpdateInfo>(`/update/check${force ? '?force=true' : ''}`)),
-    installUpdate: () => call(() => request<any>('/update/install', { method: 'POST' })),
-    installManagerUpdate: () => call(() => request<any>('/update/install-manager', { method: 'POST' })),
+    installUpdate: (tag = '') =>
+      call(() => request<Job<UpdateResult>>('/update/install', { method: 'POST', body: JSON.stringify({ tag }) })),
+    rollbackUpdate: () => call(() => request<UpdateResult>('/update/rollback', { method: 'POST' })),
+    installManagerUpdate: (tag = '') =>
+      call(() => request<Job<UpdateResult>>('/update/install-manager', { method: 'POST', body: JSON.stringify({ tag }) })),
+    uploadUpdate: (form: FormData) =>
+      call(() => request<UpdateResult>('/update/upload', { method: 'POST', body: form })),
+    getChangelog: () => call(() => request<Changelog>('/update/changelog')),
+    getReleases: () => call(() => request<ReleaseList>('/update/releases')),
+    getUpdateSettings: () => call(() => request<UpdateSettings>('/update/settings')),
+    saveUpdateSettings: (s: UpdateSettings) =>
+      call(() => request<any>('/update/settings', { method: 'PUT', body: JSON.stringify(s) })),
     getSystem: () => call(() => request<SystemInfo>('/system')),
     getRouting: () => call(() => request<RoutingInfo>('/routing')),
     putRouting: (data: RoutingConfig) =>
@@ -160,7 +471,60 @@ export function useApi() {
     getRoutingDomains: () => call(() => request<RoutingDomains>('/routing/domains')),
     putRoutingDomains: (data: { domains: string }) =>
       call(() => request<any>('/routing/domains', { method: 'PUT', body: JSON.stringify(data) })),
+    getRoutingBypass: () => call(() => request<RoutingDomains>('/routing/bypass-domains')),
+    putRoutingBypass: (data: { domains: string }) =>
+      call(() => request<any>('/routing/bypass-domains', { method: 'PUT', body: JSON.stringify(data) })),
+    getRoutingStatic: () => call(() => request<StaticLists>('/routing/static')),
+    putRoutingStatic: (data: StaticLists) =>
+      call(() => request<StaticLists>('/routing/static', { method: 'PUT', body: JSON.stringify(data) })),
+    getRoutingDevices: () => call(() => request<{ devices: DevicePolicy[] }>('/routing/devices')),
+    putRoutingDevices: (devices: DevicePolicy[]) =>
+      call(() => request<{ devices: DevicePolicy[] }>('/routing/devices', { method: 'PUT', body: JSON.stringify({ devices }) })),
+    getRoutingHosts: () => call(() => request<LanHost[]>('/routing/hosts')),
+    getRoutingOverrides: () => call(() => request<{ overrides: RoutingOverride[] }>('/routing/overrides')),
+    addRoutingOverride: (data: { kind: string; target: string; policy: string; ttl: number }) =>
+      call(() => request<RoutingOverride>('/routing/overrides', { method: 'POST', body: JSON.stringify(data) })),
+    deleteRoutingOverride: (id: string) =>
+      call(() => request<any>(`/routing/overrides/${id}`, { method: 'DELETE' })),
     updateRoutingNets: () =>
       call(() => request<any>('/routing/update-nets', { method: 'POST' })),
+    getDeps: () => call(() => request<DepsStatus>('/deps')),
+    installDeps: (packages: string[] = []) =>
+      call(() => request<Job<DepsStatus>>('/deps/install', { method: 'POST', body: JSON.stringify({ packages }) })),
+    getInstances: () => call(() => request<InstanceInfo[]>('/instances')),
+    createInstance: (data: InstanceSpec) =>
+      call(() => request<any>('/instances', { method: 'POST', body: JSON.stringify(data) })),
+    deleteInstance: (name: string) =>
+      call(() => request<any>(`/instances/${name}`, { method: 'DELETE' })),
+    getInstanceStatus: (name: string) => call(() => request<ServiceStatus>(`/instances/${name}/status`)),
+    instanceServiceAction: (name: string, action: string) =>
+      call(() => request<any>(`/instances/${name}/service/${action}`, { method: 'POST' })),
+    getDNS: () => call(() => request<DNSConfig>('/dns')),
+    putDNS: (data: DNSConfig) =>
+      call(() => request<any>('/dns', { method: 'PUT', body: JSON.stringify(data) })),
+    dnsLeakTest: () => call(() => request<LeakTestResult>('/dns/leak-test')),
+    getFailover: () => call(() => request<{ config: FailoverConfig; status: FailoverStatus }>('/failover')),
+    putFailover: (data: FailoverConfig) =>
+      call(() => request<any>('/failover', { method: 'PUT', body: JSON.stringify(data) })),
+    failoverSwitch: (index: number) =>
+      call(() => request<any>('/failover/switch', { method: 'POST', body: JSON.stringify({ index }) })),
+    probeEndpoint: (apply = false) =>
+      call(() => request<ProbeResult>('/endpoint/probe', { method: apply ? 'POST' : 'GET' })),
+    getProbeSettings: () => call(() => request<ProbeSettings>('/endpoint/probe/settings')),
+    putProbeSettings: (data: ProbeSettings) =>
+      call(() => request<any>('/endpoint/probe/settings', { method: 'PUT', body: JSON.stringify(data) })),
+    getJobs: () => call(() => request<Job[]>('/jobs')),
+    getJob: <T = any>(id: string) => call(() => request<Job<T>>(`/jobs/${id}`)),
+    cancelJob: (id: string) => call(() => request<any>(`/jobs/${id}/cancel`, { method: 'POST' })),
+    startTune: (apply: boolean) =>
+      call(() => request<Job<TuneReport>>('/tune', { method: 'POST', body: JSON.stringify({ apply }) })),
+    getSchedule: () => call(() => request<ScheduleStatus>('/schedule')),
+    createScheduleRule: (rule: ScheduleRule) =>
+      call(() => request<ScheduleRule>('/schedule', { method: 'POST', body: JSON.stringify(rule) })),
+    updateScheduleRule: (id: string, rule: ScheduleRule) =>
+      call(() => request<ScheduleRule>(`/schedule/${id}`, { method: 'PUT', body: JSON.stringify(rule) })),
+    deleteScheduleRule: (id: string) => call(() => request<any>(`/schedule/${id}`, { method: 'DELETE' })),
+    getSchedulePreview: () => call(() => request<ScheduleTransition[]>('/schedule/preview')),
+    getEvents: (limit = 50) => call(() => request<ManagerEvent[]>(`/events?limit=${limit}`)),
   }
 }
@@ -13,6 +13,11 @@ const router = createRouter({
       name: 'routing',
       component: () => import('@/views/RoutingView.vue'),
     },
+    {
+      path: '/schedule',
+      name: 'schedule',
+      component: () => import('@/views/ScheduleView.vue'),
+    },
     {
       path: '/config',
       name: 'config',